@@ -5,6 +5,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/spf13/cobra"
 )
@@ -45,8 +46,12 @@ func AutoGen() *cobra.Command {
 						continue
 					}
 					base, _ := splitTestExt(testPath)
-					fmt.Fprintf(out, `  "%s": { test: std.native("parseSQL")(importstr "%s"), expect: import "%s" },`+"\n",
-						base, filepath.Base(testPath), filepath.Base(resPath))
+					importExpect := "import"
+					if strings.HasSuffix(resPath, stdTextResExt) {
+						importExpect = "importstr"
+					}
+					fmt.Fprintf(out, `  "%s": { path: "%s", test: std.native("parseSQL")(importstr "%s"), expect: %s "%s" },`+"\n",
+						base, filepath.Base(testPath), filepath.Base(testPath), importExpect, filepath.Base(resPath))
 					break
 				}
 			}
@@ -1,7 +1,13 @@
 package command
 
 import (
+	"log"
+	"os"
+	"path/filepath"
 	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/zyguan/tidb-test-util/cmd/stmtflow/core"
 )
 
 const (
@@ -30,3 +36,95 @@ func resultPathForJson(path string) string {
 	base, _ := splitTestExt(path)
 	return base + stdJsonResExt
 }
+
+func isDir(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+// isManifest reports whether path is a jsonnet manifest rather than a directory, a glob pattern or a test file.
+func isManifest(path string) bool {
+	return !isDir(path) && !strings.HasSuffix(path, stdTestExt) && !strings.ContainsAny(path, "*?[")
+}
+
+// findTestFiles discovers test files by a directory, a glob pattern or a path.
+func findTestFiles(path string) ([]string, error) {
+	var (
+		files []string
+		err   error
+	)
+	if isDir(path) {
+		err = filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() && strings.HasSuffix(p, stdTestExt) {
+				files = append(files, p)
+			}
+			return err
+		})
+	} else {
+		files, err = filepath.Glob(path)
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	testFiles := files[:0]
+	for _, f := range files {
+		if strings.HasSuffix(f, stdTestExt) {
+			testFiles = append(testFiles, f)
+		}
+	}
+	return testFiles, nil
+}
+
+// globRoot returns the longest leading directory of a glob pattern without meta characters.
+func globRoot(pattern string) string {
+	dir := filepath.Dir(pattern)
+	for strings.ContainsAny(dir, "*?[") {
+		dir = filepath.Dir(dir)
+	}
+	return dir
+}
+
+// loadTests loads tests from a jsonnet manifest, or discovers test files by a directory, a glob pattern or a path.
+func loadTests(path string, filter string) ([]core.Test, error) {
+	if isManifest(path) {
+		return core.Load(path, filter)
+	}
+	files, err := findTestFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	// tests are named after their paths relative to the directory or the fixed part of the glob pattern
+	root := ""
+	if isDir(path) {
+		root = path
+	} else if strings.ContainsAny(path, "*?[") {
+		root = globRoot(path)
+	}
+	var tests []core.Test
+	for _, testPath := range files {
+		base, _ := splitTestExt(testPath)
+		name := filepath.Base(base)
+		if len(root) > 0 {
+			if rel, err := filepath.Rel(root, base); err == nil {
+				name = filepath.ToSlash(rel)
+			}
+		}
+		resPath := ""
+		for _, p := range []string{resultPathForJson(testPath), resultPathForText(testPath)} {
+			if fi, err := os.Stat(p); err == nil && !fi.IsDir() {
+				resPath = p
+				break
+			}
+		}
+		if len(resPath) == 0 {
+			log.Printf("[%s] no expected result found, ignored", testPath)
+			continue
+		}
+		t, err := core.LoadSQL(name, testPath, resPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "load "+testPath)
+		}
+		tests = append(tests, t)
+	}
+	return core.FilterTests(tests, filter)
+}
@@ -0,0 +1,56 @@
+package command
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zyguan/tidb-test-util/cmd/stmtflow/core"
+)
+
+func TestGlobRoot(t *testing.T) {
+	for pattern, root := range map[string]string{
+		"*.t.sql":              ".",
+		"tests/*.t.sql":        "tests",
+		"tests/*/x.t.sql":      "tests",
+		"tests/a/b?/*/*.t.sql": "tests/a",
+		"/abs/[ab]/t.t.sql":    "/abs",
+	} {
+		require.Equal(t, filepath.FromSlash(root), globRoot(filepath.FromSlash(pattern)), pattern)
+	}
+}
+
+func TestLoadTestNames(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a/t0", "b/t0", "b/t1"} {
+		writeFile(t, filepath.Join(dir, name+stdTestExt), "/* s1 */ select 1;\n")
+		writeFile(t, filepath.Join(dir, name+stdJsonResExt), "[]\n")
+	}
+	names := func(tests []core.Test) []string {
+		var ns []string
+		for _, t := range tests {
+			ns = append(ns, t.Name)
+		}
+		return ns
+	}
+
+	tests, err := loadTests(dir, "")
+	require.NoError(t, err)
+	require.Equal(t, []string{"a/t0", "b/t0", "b/t1"}, names(tests))
+
+	// tests in different directories matched by a glob pattern keep distinct names
+	tests, err = loadTests(filepath.Join(dir, "*", "t0"+stdTestExt), "")
+	require.NoError(t, err)
+	require.Equal(t, []string{"a/t0", "b/t0"}, names(tests))
+	tests, err = loadTests(filepath.Join(dir, "b", "*"+stdTestExt), "")
+	require.NoError(t, err)
+	require.Equal(t, []string{"t0", "t1"}, names(tests))
+
+	tests, err = loadTests(filepath.Join(dir, "b", "t1"+stdTestExt), "")
+	require.NoError(t, err)
+	require.Equal(t, []string{"t1"}, names(tests))
+
+	tests, err = loadTests(dir, `std.startsWith(test.name, "b/")`)
+	require.NoError(t, err)
+	require.Equal(t, []string{"b/t0", "b/t1"}, names(tests))
+}
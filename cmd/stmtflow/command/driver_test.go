@@ -0,0 +1,174 @@
+package command
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// fakeServer is the server of the fake driver, dsns are in the format of the mysql driver. Statements it knows:
+//   - `hang` blocks until it's killed by `kill [tidb] query`
+//   - `sleep <ms>` sleeps for a while
+//   - `fail` returns an error
+//   - `create database x` and `drop database [if exists] x` maintain databases
+//
+// Other statements return immediately, all of them are logged with the database in use.
+type fakeServer struct {
+	lock  sync.Mutex
+	seq   int64
+	kills map[int64]chan struct{}
+	dbs   map[string]bool
+	log   []string
+}
+
+func newFakeServer(dbs ...string) *fakeServer {
+	s := &fakeServer{kills: map[int64]chan struct{}{}, dbs: map[string]bool{}}
+	for _, db := range dbs {
+		s.dbs[db] = true
+	}
+	return s
+}
+
+var fakeServers = struct {
+	sync.Mutex
+	seq  int
+	srvs map[string]*fakeServer
+}{srvs: map[string]*fakeServer{}}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(dsn string) (driver.Conn, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	fakeServers.Lock()
+	s, ok := fakeServers.srvs[cfg.Addr]
+	fakeServers.Unlock()
+	if !ok {
+		return nil, errors.New("no such server: " + cfg.Addr)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.seq++
+	s.kills[s.seq] = make(chan struct{})
+	return &fakeConn{srv: s, id: s.seq, db: cfg.DBName}, nil
+}
+
+func init() { sql.Register("fake", fakeDriver{}) }
+
+// fakeOptions starts a fake server and returns common options connecting to it.
+func fakeOptions(dbs ...string) (*CommonOptions, *fakeServer) {
+	fakeServers.Lock()
+	defer fakeServers.Unlock()
+	fakeServers.seq++
+	addr := "fake-" + strconv.Itoa(fakeServers.seq) + ":4000"
+	s := newFakeServer(dbs...)
+	fakeServers.srvs[addr] = s
+	c := &CommonOptions{DSN: "root@tcp(" + addr + ")/test", Timeout: 5 * time.Second, BlockTime: 50 * time.Millisecond, PingTime: 10 * time.Millisecond, KillStuck: true, driver: "fake"}
+	return c, s
+}
+
+func (s *fakeServer) logs() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.log...)
+}
+
+func (s *fakeServer) hasDB(name string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.dbs[name]
+}
+
+type fakeConn struct {
+	srv *fakeServer
+	id  int64
+	db  string
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	switch query {
+	case "select connection_id()":
+		return &fakeRows{cols: []string{"id"}, vals: []driver.Value{c.id}}, nil
+	case "select version()":
+		return &fakeRows{cols: []string{"v"}, vals: []driver.Value{"5.7.25-TiDB-v5.4.0"}}, nil
+	case "select current_user(), database()":
+		return &fakeRows{cols: []string{"user", "db"}, vals: []driver.Value{"root@%", c.db}}, nil
+	}
+	return nil, errors.New("not supported")
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	s := c.srv
+	s.lock.Lock()
+	s.log = append(s.log, c.db+": "+query)
+	killed := s.kills[c.id]
+	s.lock.Unlock()
+	// statements of test files come with headers and semicolons
+	if k := strings.Index(query, "*/"); strings.HasPrefix(query, "/*") && k > 0 {
+		query = query[k+2:]
+	}
+	query = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(query), ";"))
+	fields := strings.Fields(strings.ReplaceAll(query, "`", ""))
+	switch {
+	case query == "hang":
+		<-killed
+		return nil, &mysql.MySQLError{Number: 1317, Message: "query interrupted"}
+	case query == "fail":
+		return nil, &mysql.MySQLError{Number: 1105, Message: "failed"}
+	case len(fields) == 2 && fields[0] == "sleep":
+		ms, _ := strconv.Atoi(fields[1])
+		time.Sleep(time.Duration(ms) * time.Millisecond)
+	case len(fields) > 2 && fields[0] == "create" && fields[1] == "database":
+		s.lock.Lock()
+		s.dbs[fields[len(fields)-1]] = true
+		s.lock.Unlock()
+	case len(fields) > 2 && fields[0] == "drop" && fields[1] == "database":
+		s.lock.Lock()
+		delete(s.dbs, fields[len(fields)-1])
+		s.lock.Unlock()
+	case len(fields) > 1 && fields[0] == "use":
+		c.db = fields[1]
+	case len(fields) > 2 && fields[0] == "kill":
+		id, _ := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+		s.lock.Lock()
+		if ch, ok := s.kills[id]; ok {
+			close(ch)
+			s.kills[id] = make(chan struct{})
+		}
+		s.lock.Unlock()
+	}
+	return driver.RowsAffected(0), nil
+}
+
+type fakeRows struct {
+	cols []string
+	vals []driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.cols }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.vals == nil {
+		return io.EOF
+	}
+	copy(dest, r.vals)
+	r.vals = nil
+	return nil
+}
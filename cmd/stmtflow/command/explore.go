@@ -0,0 +1,245 @@
+package command
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/zyguan/tidb-test-util/cmd/stmtflow/core"
+	"github.com/zyguan/tidb-test-util/pkg/stmtflow"
+)
+
+type exploreOptions struct {
+	Filter   string
+	Seed     int64
+	MaxCount int
+	Random   bool
+	Isolate  bool
+}
+
+func Explore(c *CommonOptions) *cobra.Command {
+	opts := exploreOptions{}
+	cmd := &cobra.Command{
+		Use:           "explore [tests.jsonnet | dir | *.t.sql ...]",
+		Short:         "Explore interleavings of tests",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return cmd.Help()
+			}
+			if opts.Seed == 0 {
+				opts.Seed = time.Now().UnixNano()
+			}
+			log.Printf("explore with seed %d", opts.Seed)
+			r := rand.New(rand.NewSource(opts.Seed))
+			ctx := context.Background()
+			errCnt := 0
+			for _, path := range args {
+				log.Printf("[%s] load tests", path)
+				tests, err := loadTests(path, opts.Filter)
+				if err != nil {
+					return err
+				}
+				for _, t := range tests {
+					n, err := exploreOne(ctx, c, path, t, r, opts)
+					if err != nil {
+						log.Printf("[%s#%s] failed:  %+v", path, t.Name, err)
+						errCnt += 1
+					} else if n > 0 {
+						log.Printf("[%s#%s] %d schedules violated", path, t.Name, n)
+						errCnt += 1
+					} else {
+						log.Printf("[%s#%s] passed", path, t.Name)
+					}
+				}
+			}
+			if errCnt > 0 {
+				plural := ""
+				if errCnt > 1 {
+					plural = "s"
+				}
+				return fmt.Errorf("%d test%s failed", errCnt, plural)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVarP(&opts.Filter, "filter", "f", "", "filter tests by a jsonnet expr, eg. std.startsWith(test.name, 'foo')")
+	cmd.Flags().Int64Var(&opts.Seed, "seed", 0, "seed for sampling schedules, a random seed is used if it's 0")
+	cmd.Flags().IntVarP(&opts.MaxCount, "max-count", "m", 100, "max number of schedules to explore for each test")
+	cmd.Flags().BoolVar(&opts.Random, "random", false, "sample schedules randomly instead of enumerating them")
+	cmd.Flags().BoolVar(&opts.Isolate, "isolate", true, "run each schedule in a database created for it, tests are required to reset states by fixtures if it's disabled")
+
+	return cmd
+}
+
+// exploreOne runs schedules of a test and returns the number of schedules that violate expectations. Tests
+// with a jsonnet expect function are asserted by the function, others are compared with the original schedule.
+// Schedules start from the same state, either by running in databases created for them or by fixtures of the test.
+func exploreOne(ctx context.Context, c *CommonOptions, path string, t core.Test, r *rand.Rand, opts exploreOptions) (int, error) {
+	w, err := newTestWorker(ctx, c, 0, false)
+	if err != nil {
+		return 0, err
+	}
+	if err = w.validate(t); err != nil {
+		log.Printf("[%s#%s] skipped: %v", path, t.Name, err)
+		return 0, nil
+	}
+	isolated := opts.Isolate || t.Isolated
+	if !isolated && len(t.Setup) == 0 && len(t.Teardown) == 0 {
+		return 0, errors.New("schedules share states of the database, declare setup or teardown to reset them, or use --isolate")
+	}
+
+	sessions, seqs := stmtflow.SplitSessions(t.Test)
+	origin := stmtflow.ScheduleOf(t.Test)
+	ref, err := w.runSchedule(ctx, t, t.Test, isolated)
+	if err != nil {
+		return 0, errors.Wrap(err, "run original schedule")
+	}
+
+	var (
+		scheds []stmtflow.Schedule
+		seen   = map[string]bool{origin.String(): true}
+	)
+	if opts.Random {
+		for i := 0; i < 10*opts.MaxCount && len(scheds) < opts.MaxCount; i++ {
+			sched := stmtflow.SampleSchedule(seqs, r)
+			if !seen[sched.String()] {
+				seen[sched.String()] = true
+				scheds = append(scheds, sched)
+			}
+		}
+	} else {
+		stmtflow.EnumSchedules(seqs, func(sched stmtflow.Schedule) bool {
+			if !seen[sched.String()] {
+				scheds = append(scheds, sched)
+			}
+			return len(scheds) < opts.MaxCount
+		})
+	}
+
+	violated := 0
+	for _, sched := range scheds {
+		stmts := stmtflow.Merge(seqs, sched)
+		actual, err := w.runSchedule(ctx, t, stmts, isolated)
+		if err != nil {
+			return violated, errors.Wrap(err, "run schedule "+scheduleName(sessions, sched))
+		}
+		var msg string
+		if t.AssertMethod == "function" {
+			if err = t.Assert(actual); err != nil {
+				msg = err.Error()
+			}
+		} else {
+			msg = diffReturns(ref, actual, t.Compare)
+		}
+		if len(msg) == 0 {
+			continue
+		}
+		violated += 1
+		log.Printf("[%s#%s] schedule %s: %s", path, t.Name, scheduleName(sessions, sched), msg)
+		fmt.Printf("# %s#%s, schedule %s\n", path, t.Name, scheduleName(sessions, sched))
+		if err = core.DumpSQL(os.Stdout, stmts); err != nil {
+			return violated, err
+		}
+	}
+	return violated, nil
+}
+
+// runSchedule runs statements of a test in a schedule, fixtures of the test are run around them. The schedule
+// runs in a database created for it if it's isolated.
+func (w *testWorker) runSchedule(ctx context.Context, t core.Test, stmts []stmtflow.Stmt, isolated bool) (h stmtflow.History, err error) {
+	dsn, database := w.dsn, w.database
+	if isolated {
+		if database, dsn, err = w.createDatabase(ctx); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if e := w.exec(context.Background(), "drop database if exists "+stmtflow.QuoteIdent(database)); e != nil {
+				log.Printf("drop database %s: %v", database, e)
+			}
+		}()
+	}
+	db, err := w.c.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	dsns, err := w.endpointDSNs(t.Endpoints, database)
+	if err != nil {
+		return nil, err
+	}
+	opts := w.c.EvalOptions()
+	if opts.Endpoints, err = w.c.openEndpoints(dsns); err != nil {
+		return nil, err
+	}
+	defer closeEndpoints(opts.Endpoints)
+	opts.Controller = w.c.Controller(w.c.EndpointDSNs(t.Endpoints))
+	var logins map[string]*sql.DB
+	if opts.Sessions, logins, err = w.c.openSessions(t, dsn, dsns); err != nil {
+		return nil, err
+	}
+	defer closeEndpoints(logins)
+
+	defer func() {
+		tctx, cancel := context.WithTimeout(context.Background(), teardownTimeout)
+		defer cancel()
+		if e := runFixture(tctx, db, t.Teardown, opts); e != nil && err == nil {
+			err = errors.Wrap(e, "run teardown")
+		}
+	}()
+	ctx = w.c.WithTimeout(ctx)
+	if err = runFixture(ctx, db, t.Setup, opts); err != nil {
+		return nil, errors.Wrap(err, "run setup")
+	}
+	opts.Callback = h.Collect
+	err = stmtflow.Run(ctx, db, stmts, opts)
+	return h, err
+}
+
+// diffReturns compares results of each session and returns the first difference.
+func diffReturns(expect stmtflow.History, actual stmtflow.History, opts stmtflow.CompareOptions) string {
+	exp, act := returnsBySession(expect), returnsBySession(actual)
+	sessions := make([]string, 0, len(exp))
+	for s := range exp {
+		sessions = append(sessions, s)
+	}
+	sort.Strings(sessions)
+	for _, s := range sessions {
+		if len(exp[s]) != len(act[s]) {
+			return fmt.Sprintf("expect %d returns of %s, got %d", len(exp[s]), s, len(act[s]))
+		}
+		for i := range exp[s] {
+			if ok, msg := exp[s][i].Match(act[s][i], opts); !ok {
+				return msg
+			}
+		}
+	}
+	return ""
+}
+
+func returnsBySession(h stmtflow.History) map[string]stmtflow.History {
+	m := map[string]stmtflow.History{}
+	for _, e := range h {
+		if e.Kind == stmtflow.EventReturn {
+			m[e.Session] = append(m[e.Session], e)
+		}
+	}
+	return m
+}
+
+func scheduleName(sessions []string, sched stmtflow.Schedule) string {
+	names := make([]string, len(sched))
+	for i, k := range sched {
+		names[i] = sessions[k]
+	}
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,66 @@
+package command
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zyguan/tidb-test-util/cmd/stmtflow/core"
+)
+
+// scheduleDatabases returns databases in which each statement is executed.
+func scheduleDatabases(srv *fakeServer, stmt string) []string {
+	var dbs []string
+	for _, l := range srv.logs() {
+		if strings.HasSuffix(l, stmt) {
+			dbs = append(dbs, strings.SplitN(l, ": ", 2)[0])
+		}
+	}
+	return dbs
+}
+
+func twoSessionTest() testCase {
+	tc := testCaseOf("t0", "/* s1 */ insert into t values (1);", "/* s2 */ insert into t values (2);")
+	tc.Test.Test[1].Sess = "s2"
+	return tc
+}
+
+func TestExploreIsolatedSchedules(t *testing.T) {
+	c, srv := fakeOptions()
+	tc := twoSessionTest()
+	n, err := exploreOne(context.Background(), c, "t.json", tc.Test, rand.New(rand.NewSource(1)), exploreOptions{MaxCount: 10, Isolate: true})
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	// the original schedule and the reversed one run in their own databases, which are dropped afterwards
+	dbs := scheduleDatabases(srv, "insert into t values (1);")
+	require.Len(t, dbs, 2)
+	require.NotEqual(t, dbs[0], dbs[1])
+	require.Equal(t, dbs, scheduleDatabases(srv, "insert into t values (2);"))
+	for _, db := range dbs {
+		require.True(t, strings.HasPrefix(db, reservedDBPrefix), db)
+		require.False(t, srv.hasDB(db), db)
+	}
+}
+
+func TestExploreSharedSchedules(t *testing.T) {
+	c, srv := fakeOptions()
+	tc := twoSessionTest()
+	opts := exploreOptions{MaxCount: 10}
+	_, err := exploreOne(context.Background(), c, "t.json", tc.Test, rand.New(rand.NewSource(1)), opts)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "--isolate")
+	require.Empty(t, srv.logs())
+
+	// fixtures reset states of the shared database
+	tc.Test.Setup = core.Fixture{{Sess: "s1", SQL: "create table t (v int)"}}
+	tc.Test.Teardown = core.Fixture{{Sess: "s1", SQL: "drop table if exists t"}}
+	n, err := exploreOne(context.Background(), c, "t.json", tc.Test, rand.New(rand.NewSource(1)), opts)
+	require.NoError(t, err)
+	require.Zero(t, n)
+	require.Equal(t, []string{"test", "test"}, scheduleDatabases(srv, "insert into t values (1);"))
+	require.Len(t, scheduleDatabases(srv, "create table t (v int)"), 2)
+	require.Len(t, scheduleDatabases(srv, "drop table if exists t"), 2)
+}
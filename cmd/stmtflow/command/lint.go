@@ -0,0 +1,87 @@
+package command
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/zyguan/tidb-test-util/cmd/stmtflow/core"
+)
+
+func Lint() *cobra.Command {
+	return &cobra.Command{
+		Use:           "lint [tests.jsonnet | dir | *.t.sql ...]",
+		Short:         "Check test files for problems",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return cmd.Help()
+			}
+			cnt := 0
+			for _, path := range args {
+				var problems []error
+				if isManifest(path) {
+					if _, err := core.Load(path, ""); err != nil {
+						problems = append(problems, errors.Wrap(err, path))
+					}
+				} else {
+					files, err := findTestFiles(path)
+					if err != nil {
+						return err
+					}
+					for _, f := range files {
+						problems = append(problems, lintSQL(f)...)
+					}
+				}
+				for _, p := range problems {
+					fmt.Fprintln(cmd.OutOrStdout(), p.Error())
+				}
+				cnt += len(problems)
+			}
+			if cnt > 0 {
+				plural := ""
+				if cnt > 1 {
+					plural = "s"
+				}
+				return fmt.Errorf("%d problem%s found", cnt, plural)
+			}
+			log.Printf("no problem found")
+			return nil
+		},
+	}
+}
+
+// lintSQL strictly parses a test file and validates annotations of its statements.
+func lintSQL(path string) []error {
+	f, err := os.Open(path)
+	if err != nil {
+		return []error{errors.WithStack(err)}
+	}
+	defer f.Close()
+	stmts, err := core.ParseStrictSQL(path, f)
+	problems, ok := err.(core.ParseErrors)
+	if err != nil && !ok {
+		return []error{err}
+	}
+	for _, s := range stmts {
+		if s.Compare == nil {
+			continue
+		}
+		if err := s.Compare.Validate(); err != nil {
+			problems = append(problems, &core.ParseError{Pos: *s.Pos, Msg: err.Error()})
+		}
+	}
+	sort.SliceStable(problems, func(i, j int) bool {
+		p1, p2 := problems[i].Pos, problems[j].Pos
+		return p1.Line < p2.Line || p1.Line == p2.Line && p1.Col < p2.Col
+	})
+	errs := make([]error, len(problems))
+	for i, p := range problems {
+		errs[i] = p
+	}
+	return errs
+}
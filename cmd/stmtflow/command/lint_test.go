@@ -0,0 +1,53 @@
+package command
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, path string, content string) string {
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestLintSQL(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, filepath.Join(dir, "a.t.sql"), "/* s1: mask=( */ select 1;\nselect 2;\n/* s1: nope */ select 3;\n")
+	errs := lintSQL(path)
+	require.Len(t, errs, 3)
+	// problems are sorted by positions, invalid masks are found by validation
+	require.Contains(t, errs[0].Error(), path+":1:1: invalid mask")
+	require.Contains(t, errs[1].Error(), path+":2:1: missing session header")
+	require.Contains(t, errs[2].Error(), path+":3:1: annotation `nope`")
+
+	require.Empty(t, lintSQL(writeFile(t, filepath.Join(dir, "b.t.sql"), "/* s1: wait */ select 1;\n")))
+	require.Len(t, lintSQL(filepath.Join(dir, "none.t.sql")), 1)
+}
+
+func TestLintCommand(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "x", "a.t.sql"), "/* s1 */ select 1;\n")
+	writeFile(t, filepath.Join(dir, "y", "b.t.sql"), "select 1;\n/* s1: nope */ select 2;\n")
+
+	out := new(bytes.Buffer)
+	cmd := Lint()
+	cmd.SetOut(out)
+	cmd.SetArgs([]string{dir})
+	captureLogs(t)
+	err := cmd.Execute()
+	require.EqualError(t, err, "2 problems found")
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	require.True(t, strings.HasPrefix(lines[0], filepath.Join(dir, "y", "b.t.sql")+":1:1: "))
+
+	cmd = Lint()
+	cmd.SetOut(out)
+	cmd.SetArgs([]string{filepath.Join(dir, "x")})
+	require.NoError(t, cmd.Execute())
+}
@@ -4,8 +4,14 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 
+	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/zyguan/tidb-test-util/cmd/stmtflow/core"
 	"github.com/zyguan/tidb-test-util/pkg/stmtflow"
@@ -14,7 +20,9 @@ import (
 func Play(c *CommonOptions) *cobra.Command {
 	var opts struct {
 		stmtflow.TextDumpOptions
-		Write bool
+		Write     bool
+		Record    string
+		EventsOut string
 	}
 	cmd := &cobra.Command{
 		Use:           "play [test.sql ...]",
@@ -26,18 +34,44 @@ func Play(c *CommonOptions) *cobra.Command {
 				return cmd.Help()
 			}
 			ctx := context.Background()
+			var rec *core.Recording
+			if len(opts.Record) > 0 {
+				var err error
+				if rec, err = newRecording(c, opts.TextDumpOptions); err != nil {
+					return err
+				}
+			}
+			sink, err := openEventSink(opts.EventsOut)
+			if err != nil {
+				return err
+			}
+			if sink != nil {
+				defer sink.Close()
+			}
 			for _, path := range args {
 				fmt.Println("# " + path)
 				var (
 					in       io.ReadCloser
 					result   stmtflow.History
+					sessions stmtflow.Sessions
 					done     func()
 					evalOpts = c.EvalOptions()
 				)
+				evalOpts.Sink, evalOpts.Source = sink, path
+				// sessions are shown but not written to text results, which are compared as they are
+				evalOpts.OnSession = func(s string, info stmtflow.SessionInfo) {
+					sessions.Collect(s, info)
+					fmt.Printf("# %s: %s\n", s, info)
+				}
 				db, err := c.OpenDB()
 				if err != nil {
 					return err
 				}
+				evalOpts.Endpoints, err = c.openEndpoints(c.EndpointDSNs(nil))
+				if err != nil {
+					return err
+				}
+				evalOpts.Controller = c.Controller(c.EndpointDSNs(nil))
 				in, err = os.Open(path)
 				if err != nil {
 					return err
@@ -54,31 +88,80 @@ func Play(c *CommonOptions) *cobra.Command {
 					textWriter := stmtflow.TextDumper(io.MultiWriter(os.Stdout, textOut), opts.TextDumpOptions)
 					evalOpts.Callback = stmtflow.ComposeHandler(result.Collect, textWriter)
 					done = func() {
-						result.DumpJson(jsonOut, stmtflow.JsonDumpOptions{})
+						result.DumpJson(jsonOut, stmtflow.JsonDumpOptions{Sessions: sessions})
 						jsonOut.Close()
 						textOut.Close()
 						in.Close()
 						db.Close()
+						closeEndpoints(evalOpts.Endpoints)
 					}
 				} else {
-					evalOpts.Callback = stmtflow.TextDumper(os.Stdout, opts.TextDumpOptions)
+					evalOpts.Callback = stmtflow.ComposeHandler(result.Collect, stmtflow.TextDumper(os.Stdout, opts.TextDumpOptions))
 					done = func() {
 						in.Close()
 						db.Close()
+						closeEndpoints(evalOpts.Endpoints)
 					}
 				}
 
-				if err = stmtflow.Run(c.WithTimeout(ctx), db, core.ParseSQL(in), evalOpts); err != nil {
+				stmts := core.ParseNamedSQL(path, in)
+				// the partial history is written even if it's interrupted
+				err = stmtflow.Run(c.WithTimeout(ctx), db, stmts, evalOpts)
+				done()
+				if rec != nil {
+					base, _ := splitTestExt(path)
+					rec.Runs = append(rec.Runs, core.RecordedRun{Name: filepath.Base(base), Path: path, Test: stmts, Sessions: sessions, History: result})
+				}
+				if err != nil {
+					// runs recorded so far (including the interrupted one) are kept
+					if rec != nil {
+						if e := rec.Dump(opts.Record); e != nil {
+							log.Printf("dump recording: %v", e)
+						}
+					}
 					return err
 				}
-
-				done()
+			}
+			if rec != nil {
+				if err = rec.Dump(opts.Record); err != nil {
+					return err
+				}
+			}
+			if sink != nil {
+				return errors.Wrap(sink.Close(), "write events")
 			}
 			return nil
 		},
 	}
 	cmd.Flags().BoolVarP(&opts.Write, "write", "w", false, "write to expected result files")
+	cmd.Flags().StringVar(&opts.EventsOut, "events-out", "", "stream events to a file as json lines while playing")
+	cmd.Flags().StringVar(&opts.Record, "record", "", "record histories with server info to a file for replaying tests by `test --replay`")
 	cmd.Flags().BoolVarP(&opts.Verbose, "verbose", "v", true, "verbose output")
 	cmd.Flags().BoolVar(&opts.WithLat, "with-lat", false, "record latency of each statement")
 	return cmd
 }
+
+// newRecording creates a recording with info of the server and options in use.
+func newRecording(c *CommonOptions, opts stmtflow.TextDumpOptions) (*core.Recording, error) {
+	db, err := c.OpenDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rec := &core.Recording{RecordedAt: time.Now()}
+	if err = db.QueryRow("select version()").Scan(&rec.Version); err != nil {
+		return nil, errors.Wrap(err, "query for version")
+	}
+	if cfg, err := mysql.ParseDSN(c.DSN); err == nil {
+		rec.Host = cfg.Addr
+	}
+	rec.Options = map[string]string{
+		"timeout":       c.Timeout.String(),
+		"ping-time":     c.PingTime.String(),
+		"block-time":    c.BlockTime.String(),
+		"observe-locks": strconv.FormatBool(c.ObserveLocks),
+		"verbose":       strconv.FormatBool(opts.Verbose),
+		"with-lat":      strconv.FormatBool(opts.WithLat),
+	}
+	return rec, nil
+}
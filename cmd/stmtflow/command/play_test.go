@@ -0,0 +1,74 @@
+package command
+
+import (
+	"context"
+	stderrors "errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zyguan/tidb-test-util/cmd/stmtflow/core"
+	"github.com/zyguan/tidb-test-util/pkg/stmtflow"
+)
+
+func TestPlayRecordsInterruptedRuns(t *testing.T) {
+	c, _ := fakeOptions("test")
+	c.Timeout = 200 * time.Millisecond
+	captureLogs(t)
+	dir := t.TempDir()
+	a := writeFile(t, filepath.Join(dir, "a.t.sql"), "/* s1 */ select 1;\n")
+	b := writeFile(t, filepath.Join(dir, "b.t.sql"), "/* s1 */ select 2;\n/* s1 */ hang;\n")
+	never := writeFile(t, filepath.Join(dir, "c.t.sql"), "/* s1 */ select 3;\n")
+	recPath := filepath.Join(dir, "rec.json")
+
+	stdout := os.Stdout
+	os.Stdout, _ = os.Open(os.DevNull)
+	defer func() { os.Stdout = stdout }()
+	cmd := Play(c)
+	cmd.SetArgs([]string{"--record", recPath, a, b, never})
+	require.Error(t, cmd.Execute())
+	os.Stdout = stdout
+
+	rec, err := core.LoadRecording(recPath)
+	require.NoError(t, err)
+	require.Equal(t, "5.7.25-TiDB-v5.4.0", rec.Version)
+	require.Len(t, rec.Runs, 2)
+	require.Equal(t, "a", rec.Runs[0].Name)
+	require.Equal(t, "root@%", rec.Runs[0].Sessions["s1"].User)
+	require.True(t, endsWithTimeout(rec.Runs[1].History))
+
+	// the interrupted run is replayed as a timeout
+	outcomes := replayTests(rec, []testCase{
+		{Path: a, Test: testCaseOf("a", "/* s1 */ select 1;").Test},
+		{Path: b, Test: testCaseOf("b", "/* s1 */ select 2;", "/* s1 */ hang;").Test},
+		{Path: never, Test: testCaseOf("c", "/* s1 */ select 3;").Test},
+	}, testOptions{EvalOptions: c.EvalOptions()})
+	require.Equal(t, testPassed, outcomes[0].Status)
+	require.Equal(t, rec.Runs[0].Sessions, outcomes[0].Sessions)
+	require.Equal(t, testTimedOut, outcomes[1].Status)
+	require.True(t, stderrors.Is(outcomes[1].Err, context.DeadlineExceeded))
+	require.Equal(t, testSkipped, outcomes[2].Status)
+}
+
+func TestReplayOne(t *testing.T) {
+	rec := &core.Recording{Version: "5.7.25-TiDB-v5.4.0", Runs: []core.RecordedRun{
+		{Name: "t0", History: stmtflow.History{stmtflow.NewResumeEvent("s1")}},
+	}}
+	tc := testCaseOf("t0", "select 1")
+
+	o := newTestOutcome()
+	asserted, err := replayOne(rec, tc.Test, o, testOptions{})
+	require.True(t, asserted)
+	require.NoError(t, err)
+	require.Equal(t, 1, o.Repeat)
+	require.Len(t, o.History, 1)
+
+	tc.Test.VersionConstraint = ">= 6.0"
+	o = newTestOutcome()
+	asserted, err = replayOne(rec, tc.Test, o, testOptions{})
+	require.False(t, asserted)
+	require.Error(t, err)
+	require.Equal(t, testSkipped, o.Status)
+}
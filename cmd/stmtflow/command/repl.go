@@ -0,0 +1,424 @@
+package command
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/zyguan/tidb-test-util/cmd/stmtflow/core"
+	"github.com/zyguan/tidb-test-util/pkg/stmtflow"
+)
+
+const replHelp = `Statements end with ';' and are sent to the current session, unless they start with a header like /* s2 */.
+Control steps like /* ctl: failpoint enable <name> <term> */ are run immediately.
+  \use <session>    switch to another session
+  \wait [session]   wait for running statements of a session, or all sessions
+  \save <path>      save the transcript as <path>.t.sql, <path>.r.sql and <path>.r.json
+  \help             show this message
+  \quit             exit`
+
+func Repl(c *CommonOptions) *cobra.Command {
+	var opts struct {
+		stmtflow.TextDumpOptions
+		Session string
+	}
+	cmd := &cobra.Command{
+		Use:           "repl",
+		Short:         "Run statements in sessions interactively",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			db, err := c.OpenDB()
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			evalOpts := c.EvalOptions()
+			if evalOpts.Endpoints, err = c.openEndpoints(c.EndpointDSNs(nil)); err != nil {
+				return err
+			}
+			defer closeEndpoints(evalOpts.Endpoints)
+			evalOpts.Controller = c.Controller(c.EndpointDSNs(nil))
+
+			// blockers are shown interactively, but they are left out of saved outputs
+			opts.WithBlockers = c.ObserveLocks
+			ctx, cancel := context.WithCancel(context.Background())
+			r := newRepl(ctx, db, evalOpts, opts.Session, cmd.OutOrStdout(), opts.TextDumpOptions)
+			defer func() {
+				cancel()
+				r.pool.Close()
+			}()
+			return r.loop(cmd.InOrStdin())
+		},
+	}
+	cmd.Flags().StringVarP(&opts.Session, "session", "s", "s1", "the initial session")
+	cmd.Flags().BoolVarP(&opts.Verbose, "verbose", "v", true, "verbose output")
+	cmd.Flags().BoolVar(&opts.WithLat, "with-lat", false, "record latency of each statement")
+	return cmd
+}
+
+type repl struct {
+	ctx  context.Context
+	db   *sql.DB
+	opts stmtflow.EvalOptions
+	pool *stmtflow.Pool
+	sess string
+	out  io.Writer
+	dump func(e stmtflow.Event)
+
+	lock      sync.Mutex
+	endpoints map[string]string
+	running   map[string]chan struct{}
+	vars      map[string]string
+	stmts     []stmtflow.Stmt
+	history   stmtflow.History
+}
+
+func newRepl(ctx context.Context, db *sql.DB, opts stmtflow.EvalOptions, sess string, out io.Writer, dumpOpts stmtflow.TextDumpOptions) *repl {
+	return &repl{
+		ctx:       ctx,
+		db:        db,
+		opts:      opts,
+		pool:      stmtflow.NewPool(),
+		sess:      sess,
+		out:       out,
+		dump:      stmtflow.TextDumper(out, dumpOpts),
+		endpoints: map[string]string{},
+		running:   map[string]chan struct{}{},
+		vars:      map[string]string{},
+	}
+}
+
+func (r *repl) loop(in io.Reader) error {
+	var (
+		buf     strings.Builder
+		scanner = bufio.NewScanner(in)
+	)
+	r.prompt(false)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if buf.Len() == 0 && strings.HasPrefix(strings.TrimSpace(line), "\\") {
+			quit, err := r.command(strings.Fields(strings.TrimSpace(line)))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "error: "+err.Error())
+			}
+			if quit {
+				return nil
+			}
+			r.prompt(false)
+			continue
+		}
+		if buf.Len() > 0 {
+			buf.WriteString("\n")
+		}
+		buf.WriteString(line)
+		text := strings.TrimSpace(buf.String())
+		if len(text) > 0 && !strings.HasSuffix(text, ";") && !isCtlStep(text) {
+			r.prompt(true)
+			continue
+		}
+		buf.Reset()
+		if len(text) > 0 {
+			// every statement without a header is sent to the current session
+			stmts, err := core.ParseSessionSQL(text, r.sess)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "warning: "+strings.ReplaceAll(err.Error(), "\n", "\nwarning: "))
+			}
+			for _, stmt := range stmts {
+				if stmt, err = savedForm(stmt); err != nil {
+					fmt.Fprintln(os.Stderr, "error: "+err.Error())
+					break
+				}
+				if err := r.submit(stmt); err != nil {
+					fmt.Fprintln(os.Stderr, "error: "+err.Error())
+					break
+				}
+			}
+		}
+		r.prompt(false)
+	}
+	return scanner.Err()
+}
+
+// savedForm returns the statement as it's loaded from a test file saved by \save, so that the recorded history
+// matches statements of the saved test file.
+func savedForm(stmt stmtflow.Stmt) (stmtflow.Stmt, error) {
+	buf := new(bytes.Buffer)
+	if err := core.DumpSQL(buf, []stmtflow.Stmt{stmt}); err != nil {
+		return stmt, err
+	}
+	stmts, err := core.ParseStrictSQL("", buf)
+	if err != nil {
+		return stmt, err
+	} else if len(stmts) != 1 {
+		return stmt, errors.Errorf("expect 1 statement, got %d", len(stmts))
+	}
+	// positions in the input are meaningless
+	stmts[0].Pos = nil
+	return stmts[0], nil
+}
+
+func isCtlStep(text string) bool {
+	return strings.HasPrefix(text, "/* "+stmtflow.CtlSession) && strings.HasSuffix(text, "*/")
+}
+
+func (r *repl) prompt(continued bool) {
+	if continued {
+		fmt.Fprintf(r.out, "%*s> ", len(r.sess), "-")
+	} else {
+		fmt.Fprintf(r.out, "%s> ", r.sess)
+	}
+}
+
+func (r *repl) command(args []string) (bool, error) {
+	switch args[0] {
+	case "\\q", "\\quit":
+		return true, nil
+	case "\\h", "\\?", "\\help":
+		fmt.Fprintln(r.out, replHelp)
+	case "\\use":
+		if len(args) != 2 {
+			return false, errors.New("usage: \\use <session>")
+		}
+		r.sess = args[1]
+	case "\\wait":
+		if len(args) > 2 {
+			return false, errors.New("usage: \\wait [session]")
+		}
+		return false, r.wait(args[1:]...)
+	case "\\save":
+		if len(args) != 2 {
+			return false, errors.New("usage: \\save <path>")
+		}
+		paths, err := r.save(args[1])
+		if err != nil {
+			return false, err
+		}
+		fmt.Fprintln(r.out, "saved to "+strings.Join(paths, ", "))
+	default:
+		return false, errors.New("unknown command: " + args[0] + ", try \\help")
+	}
+	return false, nil
+}
+
+func (r *repl) emit(e stmtflow.Event) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.history.Collect(e)
+	r.dump(e)
+}
+
+// connect prepares a connection for a session if it's not connected yet.
+func (r *repl) connect(s string, endpoint string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if ep, ok := r.endpoints[s]; ok {
+		if len(endpoint) > 0 && endpoint != ep {
+			return errors.New("session " + s + " is bound to " + ep)
+		}
+		return nil
+	}
+	src := r.db
+	if len(endpoint) > 0 {
+		if src = r.opts.Endpoints[endpoint]; src == nil {
+			return errors.New("unknown endpoint: " + endpoint)
+		}
+	}
+	c, err := src.Conn(r.ctx)
+	if err != nil {
+		return errors.Wrap(err, "connect for "+s)
+	}
+	if r.opts.NeedsConnID() {
+		var id int64
+		if err = c.QueryRowContext(r.ctx, "select connection_id()").Scan(&id); err != nil {
+			c.Close()
+			return errors.Wrap(err, "query connection id for "+s)
+		}
+		r.pool.SetConnID(s, id)
+	}
+	if err = r.pool.Put(s, c); err != nil {
+		c.Close()
+		return err
+	}
+	r.endpoints[s] = endpoint
+	return nil
+}
+
+// submit sends a statement, the statement is polled in background if it's blocked.
+func (r *repl) submit(stmt stmtflow.Stmt) error {
+	s := stmt.Session()
+	if stmt.Flags&stmtflow.S_WAIT > 0 {
+		if err := r.wait(); err != nil {
+			return err
+		}
+	}
+	if stmt.Flags&stmtflow.S_CTL > 0 {
+		return r.control(stmt)
+	}
+	if err := r.connect(s, stmt.Endpoint); err != nil {
+		return err
+	}
+	c, err := r.pool.Borrow(s)
+	if err == stmtflow.ErrConnBorrowed {
+		return errors.New(s + " is still running, try \\wait " + s)
+	} else if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	exec, err := r.substitute(stmt)
+	r.lock.Unlock()
+	if err != nil {
+		c.Return()
+		return err
+	}
+	if d := stmt.Sleep; d > 0 {
+		select {
+		case <-time.After(d):
+		case <-r.ctx.Done():
+			c.Return()
+			return r.ctx.Err()
+		}
+	}
+	blockTime := r.opts.BlockTime
+	if d := stmt.Timeout; d > 0 {
+		blockTime = d
+	}
+	inv, run := stmtflow.Invoke{Stmt: stmt}, stmt
+	if exec != stmt.SQL {
+		inv.Exec, run.SQL = exec, exec
+	}
+	r.lock.Lock()
+	r.stmts = append(r.stmts, stmt)
+	r.lock.Unlock()
+	r.emit(stmtflow.NewInvokeEvent(s, inv))
+	st, err := run.Poll(r.ctx, c, blockTime)
+	if err == nil {
+		r.returned(stmt, st.Result())
+		return nil
+	} else if err != stmtflow.ErrPollTimeout {
+		return err
+	}
+	var blockedBy []string
+	if r.opts.Observer != nil {
+		blockedBy, _ = r.opts.Observer.BlockedBy(r.ctx, r.db, r.pool, s)
+	}
+	r.emit(stmtflow.NewBlockEvent(s, blockedBy...))
+	done := make(chan struct{})
+	r.lock.Lock()
+	r.running[s] = done
+	r.lock.Unlock()
+	go func() {
+		defer func() {
+			r.lock.Lock()
+			delete(r.running, s)
+			r.lock.Unlock()
+			close(done)
+		}()
+		st, err := st.Poll(r.ctx, nil, 0)
+		if err != nil {
+			return
+		}
+		r.emit(stmtflow.NewResumeEvent(s))
+		r.returned(stmt, st.Result())
+	}()
+	return nil
+}
+
+// substitute replaces variable references of a statement once variables are declared, like evaluating the saved
+// statements does, r.lock must be held.
+func (r *repl) substitute(stmt stmtflow.Stmt) (string, error) {
+	if len(stmt.Let) == 0 && !stmtflow.DeclaresVars(r.stmts) {
+		return stmt.SQL, nil
+	}
+	return stmtflow.Substitute(stmt.SQL, r.vars)
+}
+
+func (r *repl) control(stmt stmtflow.Stmt) error {
+	r.lock.Lock()
+	exec, err := r.substitute(stmt)
+	if err == nil {
+		r.stmts = append(r.stmts, stmt)
+	}
+	r.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	run := stmt
+	run.SQL = exec
+	ctl := run.RunControl(r.ctx, r.opts.Controller)
+	if ctl.Stmt = stmt; exec != stmt.SQL {
+		ctl.Exec = exec
+	}
+	r.emit(stmtflow.NewControlEvent(stmt.Session(), ctl))
+	return nil
+}
+
+func (r *repl) returned(stmt stmtflow.Stmt, ret stmtflow.Return) {
+	ret.Stmt = stmt
+	r.lock.Lock()
+	for k, v := range ret.Vars {
+		r.vars[k] = v
+	}
+	r.lock.Unlock()
+	r.emit(stmtflow.NewReturnEvent(stmt.Session(), ret))
+	r.pool.Return(stmt.Session())
+}
+
+// wait waits for running statements of the given sessions, or all sessions if none is given.
+func (r *repl) wait(sessions ...string) error {
+	var chs []chan struct{}
+	r.lock.Lock()
+	for s, ch := range r.running {
+		if len(sessions) == 0 || s == sessions[0] {
+			chs = append(chs, ch)
+		}
+	}
+	r.lock.Unlock()
+	for _, ch := range chs {
+		select {
+		case <-ch:
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		}
+	}
+	return nil
+}
+
+// save writes the transcript as a test file and its expected results.
+func (r *repl) save(path string) ([]string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.running) > 0 {
+		return nil, errors.New("some statements are still running, try \\wait")
+	}
+	if _, ext := splitTestExt(path); len(ext) == 0 {
+		path += stdTestExt
+	}
+	paths := []string{path, resultPathForText(path), resultPathForJson(path)}
+	writers := []func(w io.Writer) error{
+		func(w io.Writer) error { return core.DumpSQL(w, r.stmts) },
+		func(w io.Writer) error { return r.history.DumpText(w, stmtflow.TextDumpOptions{Verbose: true}) },
+		func(w io.Writer) error { return r.history.DumpJson(w, stmtflow.JsonDumpOptions{}) },
+	}
+	for i, p := range paths {
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return nil, err
+		}
+		err = writers[i](f)
+		f.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "write "+p)
+		}
+	}
+	return paths, nil
+}
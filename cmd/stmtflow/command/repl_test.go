@@ -0,0 +1,112 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zyguan/tidb-test-util/cmd/stmtflow/core"
+	"github.com/zyguan/tidb-test-util/pkg/stmtflow"
+)
+
+func newTestRepl(t *testing.T, ctx context.Context) (*repl, *fakeServer, *bytes.Buffer) {
+	c, srv := fakeOptions()
+	db, err := c.OpenDB()
+	require.NoError(t, err)
+	out := new(bytes.Buffer)
+	r := newRepl(ctx, db, c.EvalOptions(), "s1", out, stmtflow.TextDumpOptions{})
+	t.Cleanup(func() {
+		r.pool.Close()
+		db.Close()
+	})
+	return r, srv, out
+}
+
+func replSessions(r *repl) []string {
+	var ss []string
+	for _, s := range r.stmts {
+		ss = append(ss, s.Session()+": "+strings.TrimSpace(s.SQL))
+	}
+	return ss
+}
+
+func TestReplSessions(t *testing.T) {
+	r, srv, _ := newTestRepl(t, context.Background())
+	in := strings.Join([]string{
+		"insert into t values (1); insert into t values (2);",
+		"/* s2 */ insert into t values (3); insert into t values (4);",
+		"\\use s3",
+		"insert into t values (5);",
+		"  /* s1 */ insert into t values (6);",
+		"\\q",
+	}, "\n")
+	require.NoError(t, r.loop(strings.NewReader(in)))
+	require.Equal(t, []string{
+		"s1: /* s1 */ insert into t values (1);",
+		"s1: /* s1 */ insert into t values (2);",
+		"s2: /* s2 */ insert into t values (3);",
+		"s1: /* s1 */ insert into t values (4);",
+		"s3: /* s3 */ insert into t values (5);",
+		"s1: /* s1 */ insert into t values (6);",
+	}, replSessions(r))
+	require.Len(t, srv.logs(), 6)
+	require.Len(t, r.endpoints, 3)
+}
+
+func TestReplLiteralVarRef(t *testing.T) {
+	r, srv, out := newTestRepl(t, context.Background())
+	require.NoError(t, r.loop(strings.NewReader("insert into t values ('${x}');\n\\q\n")))
+	require.NotContains(t, out.String(), "undefined variable")
+	require.Equal(t, []string{"test: /* s1 */ insert into t values ('${x}');"}, srv.logs())
+}
+
+func TestReplSave(t *testing.T) {
+	r, _, out := newTestRepl(t, context.Background())
+	path := filepath.Join(t.TempDir(), "saved")
+	in := "insert into t values (1);\n/* s2 */ insert into t\n  values (2);\n\\save " + path + "\n"
+	require.NoError(t, r.loop(strings.NewReader(in)))
+	require.Contains(t, out.String(), "saved to "+path+".t.sql")
+	raw, err := os.ReadFile(path + ".t.sql")
+	require.NoError(t, err)
+	require.Equal(t, "/* s1 */ insert into t values (1);\n/* s2 */ insert into t\n  values (2);\n", string(raw))
+
+	// the saved test passes against its saved results
+	loaded, err := core.LoadSQL("saved", path+".t.sql", path+".r.json")
+	require.NoError(t, err)
+	expected, ok := loaded.ExpectedHistory()
+	require.True(t, ok)
+	require.NoError(t, loaded.Assert(expected))
+	require.NoError(t, loaded.Assert(r.history))
+	c, _ := fakeOptions()
+	captureLogs(t)
+	outcomes, err := runTests(context.Background(), c, []testCase{{Path: path + ".t.sql", Test: loaded}}, testOptions{EvalOptions: c.EvalOptions()})
+	require.NoError(t, err)
+	require.Equal(t, testPassed, outcomes[0].Status, "%+v", outcomes[0].Err)
+}
+
+func TestReplBlocked(t *testing.T) {
+	r, _, out := newTestRepl(t, context.Background())
+	require.NoError(t, r.loop(strings.NewReader("sleep 200;\n\\wait s1\n")))
+	require.Contains(t, out.String(), "s1 >> blocked")
+	require.Contains(t, out.String(), "s1 >> resumed")
+	require.Empty(t, r.running)
+}
+
+func TestReplSubmitCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r, srv, _ := newTestRepl(t, ctx)
+	stmt := stmtflow.Stmt{Sess: "s1", SQL: "insert into t values (1)", Sleep: time.Minute}
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	require.ErrorIs(t, r.submit(stmt), context.Canceled)
+	require.Less(t, time.Since(start), 10*time.Second)
+	require.Empty(t, srv.logs())
+	// the connection is returned
+	_, err := r.pool.Borrow("s1")
+	require.NoError(t, err)
+}
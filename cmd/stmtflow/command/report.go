@@ -0,0 +1,320 @@
+package command
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/zyguan/tidb-test-util/pkg/result"
+	"github.com/zyguan/tidb-test-util/pkg/stmtflow"
+)
+
+type reporter interface {
+	Report(cases []testCase, outcomes []*testOutcome) error
+}
+
+func newReporters(specs []string) ([]reporter, error) {
+	rs := make([]reporter, 0, len(specs))
+	for _, spec := range specs {
+		kind, arg := spec, ""
+		if k := strings.Index(spec, "="); k >= 0 {
+			kind, arg = spec[:k], spec[k+1:]
+		}
+		switch kind {
+		case "junit":
+			if len(arg) == 0 {
+				return nil, errors.New("junit report requires a path, eg. junit=report.xml")
+			}
+			rs = append(rs, junitReporter{arg})
+		case "json":
+			if len(arg) == 0 {
+				return nil, errors.New("json report requires a path, eg. json=report.json")
+			}
+			rs = append(rs, jsonReporter{arg})
+		case "result":
+			if len(arg) == 0 {
+				arg = "case"
+			}
+			if arg != "case" && arg != "file" {
+				return nil, errors.New("result report expects case or file, got " + arg)
+			}
+			rs = append(rs, resultReporter{perFile: arg == "file"})
+		default:
+			return nil, errors.New("unknown report kind: " + kind)
+		}
+	}
+	return rs, nil
+}
+
+type testReport struct {
+	Path      string            `json:"path"`
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Status    testStatus        `json:"status"`
+	StartedAt time.Time         `json:"startedAt"`
+	Duration  float64           `json:"duration"`
+	Repeat    int               `json:"repeat"`
+	Skipped   string            `json:"skipped,omitempty"`
+	Failure   string            `json:"failure,omitempty"`
+	Details   string            `json:"details,omitempty"`
+	Output    string            `json:"output,omitempty"`
+
+	Sessions stmtflow.Sessions `json:"sessions,omitempty"`
+}
+
+func newTestReport(tc testCase, o *testOutcome) testReport {
+	r := testReport{
+		Path:      tc.Path,
+		Name:      tc.Test.Name,
+		Labels:    tc.Test.Labels,
+		Status:    o.Status,
+		StartedAt: o.StartedAt,
+		Duration:  o.Duration.Seconds(),
+		Repeat:    o.Repeat,
+		Sessions:  o.Sessions,
+	}
+	switch o.Status {
+	case testSkipped:
+		r.Skipped = fmt.Sprintf("%v", o.Err)
+	case testFailed, testTimedOut:
+		r.Failure = fmt.Sprintf("%v", o.Err)
+		r.Details = fmt.Sprintf("%+v", o.Err)
+		if o.out.Len() > 0 {
+			r.Details += "\n\n" + o.out.String()
+		}
+	}
+	if len(o.History) > 0 {
+		buf := new(bytes.Buffer)
+		if err := o.History.DumpText(buf, stmtflow.TextDumpOptions{Verbose: true}); err == nil {
+			r.Output = buf.String()
+		}
+	}
+	return r
+}
+
+type jsonReporter struct{ path string }
+
+func (r jsonReporter) Report(cases []testCase, outcomes []*testOutcome) error {
+	reports := make([]testReport, len(cases))
+	for i := range cases {
+		reports[i] = newTestReport(cases[i], outcomes[i])
+	}
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrap(err, "create json report")
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return errors.Wrap(enc.Encode(reports), "write json report")
+}
+
+type junitReporter struct{ path string }
+
+type junitSuites struct {
+	XMLName  xml.Name     `xml:"testsuites"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Skipped  int          `xml:"skipped,attr"`
+	Time     float64      `xml:"time,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name      string      `xml:"name,attr"`
+	Tests     int         `xml:"tests,attr"`
+	Failures  int         `xml:"failures,attr"`
+	Skipped   int         `xml:"skipped,attr"`
+	Time      float64     `xml:"time,attr"`
+	Timestamp string      `xml:"timestamp,attr,omitempty"`
+	Cases     []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name       string          `xml:"name,attr"`
+	Classname  string          `xml:"classname,attr"`
+	Time       float64         `xml:"time,attr"`
+	Properties []junitProperty `xml:"properties>property,omitempty"`
+	Skipped    *junitMessage   `xml:"skipped,omitempty"`
+	Failure    *junitMessage   `xml:"failure,omitempty"`
+	SystemOut  string          `xml:"system-out,omitempty"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr,omitempty"`
+	Body    string `xml:",chardata"`
+}
+
+func (r junitReporter) Report(cases []testCase, outcomes []*testOutcome) error {
+	var (
+		root  junitSuites
+		index = map[string]int{}
+	)
+	for i := range cases {
+		tr := newTestReport(cases[i], outcomes[i])
+		k, ok := index[tr.Path]
+		if !ok {
+			k = len(root.Suites)
+			index[tr.Path] = k
+			root.Suites = append(root.Suites, junitSuite{Name: tr.Path, Timestamp: tr.StartedAt.Format(time.RFC3339)})
+		}
+		suite := &root.Suites[k]
+		tc := junitCase{Name: tr.Name, Classname: tr.Path, Time: tr.Duration, SystemOut: tr.Output}
+		tc.Properties = append(tc.Properties, junitProperty{"repeat", fmt.Sprint(tr.Repeat)})
+		for _, name := range sortedKeys(tr.Labels) {
+			tc.Properties = append(tc.Properties, junitProperty{"label." + name, tr.Labels[name]})
+		}
+		switch tr.Status {
+		case testSkipped:
+			tc.Skipped = &junitMessage{Message: tr.Skipped}
+			suite.Skipped += 1
+		case testFailed, testTimedOut:
+			tc.Failure = &junitMessage{Message: tr.Failure, Type: string(tr.Status), Body: tr.Details}
+			suite.Failures += 1
+		}
+		suite.Tests += 1
+		suite.Time += tr.Duration
+		suite.Cases = append(suite.Cases, tc)
+	}
+	for _, s := range root.Suites {
+		root.Tests += s.Tests
+		root.Failures += s.Failures
+		root.Skipped += s.Skipped
+		root.Time += s.Time
+	}
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrap(err, "create junit report")
+	}
+	defer f.Close()
+	if _, err = f.WriteString(xml.Header); err != nil {
+		return errors.Wrap(err, "write junit report")
+	}
+	enc := xml.NewEncoder(f)
+	enc.Indent("", "  ")
+	return errors.Wrap(enc.Encode(root), "write junit report")
+}
+
+type resultReporter struct{ perFile bool }
+
+func (r resultReporter) Report(cases []testCase, outcomes []*testOutcome) error {
+	var (
+		fstErr  error
+		results []*result.Result
+		index   = map[string]int{}
+		outputs []*strings.Builder
+	)
+	for i := range cases {
+		tr := newTestReport(cases[i], outcomes[i])
+		c, out := tr.conclusion(), tr.resultOutput()
+		if !r.perFile {
+			res := result.New(tr.Path+"#"+tr.Name, tr.Labels)
+			res.StartedAt = tr.StartedAt.Unix()
+			res.CompletedAt = tr.StartedAt.Add(outcomes[i].Duration).Unix()
+			if err := res.Report(c, out); err != nil && fstErr == nil {
+				fstErr = errors.Wrap(err, "report result of "+tr.Path+"#"+tr.Name)
+			}
+			continue
+		}
+		k, ok := index[tr.Path]
+		if !ok {
+			k = len(results)
+			index[tr.Path] = k
+			res := result.New(tr.Path, nil)
+			res.StartedAt = tr.StartedAt.Unix()
+			res.Conclusion = result.Skipped
+			results = append(results, res)
+			outputs = append(outputs, new(strings.Builder))
+		}
+		res := results[k]
+		if t := tr.StartedAt.Unix(); t < res.StartedAt {
+			res.StartedAt = t
+		}
+		for name, value := range tr.Labels {
+			res.Labels[name] = value
+		}
+		if t := tr.StartedAt.Add(outcomes[i].Duration).Unix(); t > res.CompletedAt {
+			res.CompletedAt = t
+		}
+		res.Conclusion = worseConclusion(res.Conclusion, c)
+		fmt.Fprintf(outputs[k], "[%s] %s\n", tr.Name, c)
+		if len(out) > 0 {
+			fmt.Fprintln(outputs[k], out)
+		}
+	}
+	for k, res := range results {
+		if err := res.Report(res.Conclusion, outputs[k].String()); err != nil && fstErr == nil {
+			fstErr = errors.Wrap(err, "report result of "+res.Name)
+		}
+	}
+	return fstErr
+}
+
+func (r testReport) conclusion() result.Conclusion {
+	switch r.Status {
+	case testPassed:
+		return result.Success
+	case testSkipped:
+		return result.Skipped
+	case testTimedOut:
+		return result.TimedOut
+	case testFailed:
+		return result.Failure
+	default:
+		return result.Unknown
+	}
+}
+
+func (r testReport) resultOutput() string {
+	switch r.Status {
+	case testSkipped:
+		return r.Skipped
+	case testFailed, testTimedOut:
+		return r.Details
+	default:
+		return ""
+	}
+}
+
+// worseConclusion picks the conclusion that matters more for an aggregated result.
+func worseConclusion(c1 result.Conclusion, c2 result.Conclusion) result.Conclusion {
+	rank := func(c result.Conclusion) int {
+		switch c {
+		case result.Skipped:
+			return 0
+		case result.Success:
+			return 1
+		case result.TimedOut:
+			return 2
+		case result.Failure:
+			return 3
+		default:
+			return -1
+		}
+	}
+	if rank(c2) > rank(c1) {
+		return c2
+	}
+	return c1
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,202 @@
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/zyguan/tidb-test-util/pkg/result"
+	"github.com/zyguan/tidb-test-util/pkg/stmtflow"
+)
+
+// reportedTests returns cases of two files and their outcomes: a/t0 passed, a/t1 failed, b/t2 skipped and b/t3 timed out.
+func reportedTests() ([]testCase, []*testOutcome) {
+	t0 := time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC)
+	cases := []testCase{testCaseOf("t0"), testCaseOf("t1"), testCaseOf("t2"), testCaseOf("t3")}
+	cases[0].Path, cases[1].Path, cases[2].Path, cases[3].Path = "a.json", "a.json", "b.json", "b.json"
+	cases[1].Test.Labels = map[string]string{"kind": "txn"}
+	var outcomes []*testOutcome
+	for i, x := range []struct {
+		status testStatus
+		err    error
+	}{
+		{testPassed, nil},
+		{testFailed, errors.New("result mismatch")},
+		{testSkipped, errors.New("version mismatch")},
+		{testTimedOut, errors.Wrap(context.DeadlineExceeded, "run test")},
+	} {
+		o := newTestOutcome()
+		o.Status, o.Err, o.Repeat = x.status, x.err, 1
+		o.StartedAt, o.Duration = t0.Add(time.Duration(i)*time.Second), 1500*time.Millisecond
+		if x.status != testSkipped {
+			o.History = stmtflow.History{stmtflow.NewResumeEvent("s1")}
+			o.Sessions = stmtflow.Sessions{"s1": {ConnID: int64(i), User: "root@%"}}
+		}
+		outcomes = append(outcomes, o)
+	}
+	outcomes[1].out.WriteString("--- expect\n+++ actual\n")
+	return cases, outcomes
+}
+
+func TestNewReporters(t *testing.T) {
+	rs, err := newReporters([]string{"junit=r.xml", "json=r.json", "result", "result=file"})
+	require.NoError(t, err)
+	require.Equal(t, []reporter{junitReporter{"r.xml"}, jsonReporter{"r.json"}, resultReporter{}, resultReporter{perFile: true}}, rs)
+	for _, spec := range []string{"junit", "json=", "result=suite", "html=r.html"} {
+		_, err = newReporters([]string{spec})
+		require.Error(t, err, spec)
+	}
+}
+
+func TestJsonReporter(t *testing.T) {
+	cases, outcomes := reportedTests()
+	path := filepath.Join(t.TempDir(), "report.json")
+	require.NoError(t, jsonReporter{path}.Report(cases, outcomes))
+	raw, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var reports []testReport
+	require.NoError(t, json.Unmarshal(raw, &reports))
+	require.Len(t, reports, 4)
+
+	r := reports[1]
+	require.Equal(t, "a.json", r.Path)
+	require.Equal(t, "t1", r.Name)
+	require.Equal(t, map[string]string{"kind": "txn"}, r.Labels)
+	require.Equal(t, testFailed, r.Status)
+	require.Equal(t, 1.5, r.Duration)
+	require.Equal(t, "result mismatch", r.Failure)
+	require.Contains(t, r.Details, "+++ actual")
+	require.Equal(t, "-- s1 >> resumed\n", r.Output)
+	require.Equal(t, "root@%", r.Sessions["s1"].User)
+	require.True(t, outcomes[1].StartedAt.Equal(r.StartedAt))
+
+	require.Equal(t, testPassed, reports[0].Status)
+	require.Empty(t, reports[0].Failure)
+	require.Equal(t, "version mismatch", reports[2].Skipped)
+	require.Equal(t, testTimedOut, reports[3].Status)
+	require.Contains(t, reports[3].Failure, "deadline exceeded")
+	require.Empty(t, reports[2].Output)
+}
+
+func TestJunitReporter(t *testing.T) {
+	cases, outcomes := reportedTests()
+	path := filepath.Join(t.TempDir(), "report.xml")
+	require.NoError(t, junitReporter{path}.Report(cases, outcomes))
+	raw, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Contains(t, string(raw), xml.Header)
+	var root junitSuites
+	require.NoError(t, xml.Unmarshal(raw, &root))
+	require.Equal(t, []int{4, 2, 1}, []int{root.Tests, root.Failures, root.Skipped})
+	require.Equal(t, 6.0, root.Time)
+
+	// tests are grouped into suites by files
+	require.Len(t, root.Suites, 2)
+	a, b := root.Suites[0], root.Suites[1]
+	require.Equal(t, "a.json", a.Name)
+	require.Equal(t, "2022-01-01T10:00:00Z", a.Timestamp)
+	require.Equal(t, []int{2, 1, 0}, []int{a.Tests, a.Failures, a.Skipped})
+	require.Equal(t, []int{2, 1, 1}, []int{b.Tests, b.Failures, b.Skipped})
+
+	t1 := a.Cases[1]
+	require.Equal(t, "t1", t1.Name)
+	require.Equal(t, "a.json", t1.Classname)
+	require.Equal(t, []junitProperty{{"repeat", "1"}, {"label.kind", "txn"}}, t1.Properties)
+	require.Equal(t, "result mismatch", t1.Failure.Message)
+	require.Contains(t, t1.Failure.Body, "+++ actual")
+	require.Nil(t, t1.Skipped)
+	require.Equal(t, "-- s1 >> resumed\n", t1.SystemOut)
+	require.Nil(t, a.Cases[0].Failure)
+	require.Equal(t, "version mismatch", b.Cases[0].Skipped.Message)
+	require.Equal(t, "failed", t1.Failure.Type)
+	require.Equal(t, "timed-out", b.Cases[1].Failure.Type)
+}
+
+func TestWorseConclusion(t *testing.T) {
+	for _, tt := range []struct {
+		c1, c2, worse result.Conclusion
+	}{
+		{result.Skipped, result.Success, result.Success},
+		{result.Success, result.Skipped, result.Success},
+		{result.Success, result.TimedOut, result.TimedOut},
+		{result.Failure, result.TimedOut, result.Failure},
+		{result.TimedOut, result.Failure, result.Failure},
+		{result.Skipped, result.Skipped, result.Skipped},
+		{result.Skipped, result.Unknown, result.Skipped},
+		{result.Unknown, result.Skipped, result.Skipped},
+	} {
+		require.Equal(t, tt.worse, worseConclusion(tt.c1, tt.c2), "%s vs %s", tt.c1, tt.c2)
+	}
+}
+
+// reportedResults collects results posted to a fake result store during the test.
+func reportedResults(t *testing.T) *[]result.Result {
+	var results []result.Result
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var res result.Result
+		if r.Method != http.MethodPost || r.URL.Path != "/results" || json.NewDecoder(r.Body).Decode(&res) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		results = append(results, res)
+		json.NewEncoder(w).Encode(res)
+	}))
+	result.TestResultEndpoint = srv.URL
+	t.Cleanup(func() {
+		result.TestResultEndpoint = ""
+		srv.Close()
+	})
+	return &results
+}
+
+func TestResultReporter(t *testing.T) {
+	cases, outcomes := reportedTests()
+	results := reportedResults(t)
+	require.NoError(t, resultReporter{}.Report(cases, outcomes))
+	require.Len(t, *results, 4)
+	var conclusions []result.Conclusion
+	for _, r := range *results {
+		conclusions = append(conclusions, r.Conclusion)
+	}
+	require.Equal(t, "a.json#t1", (*results)[1].Name)
+	require.Equal(t, "txn", (*results)[1].Labels["kind"])
+	require.Equal(t, []result.Conclusion{result.Success, result.Failure, result.Skipped, result.TimedOut}, conclusions)
+}
+
+func TestResultReporterPerFile(t *testing.T) {
+	cases, outcomes := reportedTests()
+	results := reportedResults(t)
+	require.NoError(t, resultReporter{perFile: true}.Report(cases, outcomes))
+	require.Len(t, *results, 2)
+	a, b := (*results)[0], (*results)[1]
+
+	require.Equal(t, "a.json", a.Name)
+	require.Equal(t, result.Failure, a.Conclusion)
+	require.Equal(t, "txn", a.Labels["kind"])
+	require.Equal(t, outcomes[0].StartedAt.Unix(), a.StartedAt)
+	require.Equal(t, outcomes[1].StartedAt.Add(outcomes[1].Duration).Unix(), a.CompletedAt)
+	require.Contains(t, a.Output, "[t0] success\n[t1] failure\nresult mismatch")
+	require.Contains(t, a.Output, "+++ actual")
+
+	// a timed out test is worse than a skipped one
+	require.Equal(t, "b.json", b.Name)
+	require.Equal(t, result.TimedOut, b.Conclusion)
+	require.NotContains(t, b.Labels, "kind")
+	require.Contains(t, b.Output, "[t2] skipped\nversion mismatch\n[t3] timed_out\n")
+}
+
+func TestResultReporterAllSkipped(t *testing.T) {
+	cases, outcomes := reportedTests()
+	results := reportedResults(t)
+	require.NoError(t, resultReporter{perFile: true}.Report(cases[2:3], outcomes[2:3]))
+	require.Len(t, *results, 1)
+	require.Equal(t, result.Skipped, (*results)[0].Conclusion)
+}
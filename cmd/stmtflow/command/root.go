@@ -3,28 +3,200 @@ package command
 import (
 	"context"
 	"database/sql"
+	"net"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"time"
 
+	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+	"github.com/zyguan/tidb-test-util/cmd/stmtflow/core"
 	"github.com/zyguan/tidb-test-util/pkg/stmtflow"
+)
 
-	_ "github.com/go-sql-driver/mysql"
+const (
+	defaultDSN        = "root:@tcp(127.0.0.1:4000)/test"
+	defaultStatusPort = "10080"
+	eventBufferSize   = 1024
 )
 
+var endpointName = regexp.MustCompile(`^[A-Za-z_][\w-]*$`)
+
 type CommonOptions struct {
 	DSN       string
+	Endpoints map[string]string
 	Timeout   time.Duration
 	PingTime  time.Duration
 	BlockTime time.Duration
+
+	// StatusAddrs are status addresses of servers by endpoint names, "" is for the default server.
+	StatusAddrs map[string]string
+
+	ObserveLocks bool
+	// KillStuck kills running statements of interrupted tests.
+	KillStuck bool
+	// AllowExec allows `exec` control steps to run shell commands.
+	AllowExec bool
+
+	// driver is the sql driver to use, default to mysql.
+	driver string
 }
 
 func (c *CommonOptions) OpenDB() (*sql.DB, error) {
-	return sql.Open("mysql", c.DSN)
+	return c.Open(c.DSN)
+}
+
+// Open opens a db of the dsn by the driver in use.
+func (c *CommonOptions) Open(dsn string) (*sql.DB, error) {
+	if len(c.driver) == 0 {
+		return sql.Open("mysql", dsn)
+	}
+	return sql.Open(c.driver, dsn)
+}
+
+// SetDSNs sets the default data source name and named endpoints by specs like `dsn` or `name=dsn`.
+func (c *CommonOptions) SetDSNs(specs []string) {
+	for _, spec := range specs {
+		if k := strings.Index(spec, "="); k > 0 && endpointName.MatchString(spec[:k]) {
+			if c.Endpoints == nil {
+				c.Endpoints = map[string]string{}
+			}
+			c.Endpoints[spec[:k]] = spec[k+1:]
+		} else {
+			c.DSN = spec
+		}
+	}
+}
+
+// EndpointDSNs merges endpoints declared by a test with those given by command line, the latter take precedence.
+func (c *CommonOptions) EndpointDSNs(declared map[string]string) map[string]string {
+	dsns := make(map[string]string, len(declared)+len(c.Endpoints))
+	for name, dsn := range declared {
+		dsns[name] = dsn
+	}
+	for name, dsn := range c.Endpoints {
+		dsns[name] = dsn
+	}
+	return dsns
+}
+
+// SetStatusAddrs sets status addresses by specs like `host:port` or `name=host:port`.
+func (c *CommonOptions) SetStatusAddrs(specs []string) {
+	c.StatusAddrs = make(map[string]string, len(specs))
+	for _, spec := range specs {
+		if k := strings.Index(spec, "="); k > 0 && endpointName.MatchString(spec[:k]) {
+			c.StatusAddrs[spec[:k]] = spec[k+1:]
+		} else {
+			c.StatusAddrs[""] = spec
+		}
+	}
+}
+
+// Controller returns a controller for control steps, status addresses not given by command line are derived from
+// hosts of the default dsn and endpoint dsns.
+func (c *CommonOptions) Controller(dsns map[string]string) stmtflow.Controller {
+	addrs := make(map[string]string, len(dsns)+1)
+	for name, dsn := range dsns {
+		addrs[name] = statusAddrOf(dsn)
+	}
+	addrs[""] = statusAddrOf(c.DSN)
+	for name, addr := range c.StatusAddrs {
+		addrs[name] = addr
+	}
+	return &stmtflow.DefaultController{StatusAddrs: addrs, AllowExec: c.AllowExec}
+}
+
+func statusAddrOf(dsn string) string {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil || cfg.Net != "tcp" {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(cfg.Addr)
+	if err != nil {
+		host = cfg.Addr
+	}
+	return net.JoinHostPort(host, defaultStatusPort)
+}
+
+func (c *CommonOptions) openEndpoints(dsns map[string]string) (map[string]*sql.DB, error) {
+	dbs := make(map[string]*sql.DB, len(dsns))
+	for name, dsn := range dsns {
+		db, err := c.Open(dsn)
+		if err != nil {
+			closeEndpoints(dbs)
+			return nil, errors.Wrap(err, "open endpoint "+name)
+		}
+		dbs[name] = db
+	}
+	return dbs, nil
+}
+
+// openSessions converts session settings of a test to eval options, dsn is the default dsn and dsns are of endpoints.
+// Sessions logging in as other users connect through dbs opened for them, which are returned to be closed.
+func (c *CommonOptions) openSessions(t core.Test, dsn string, dsns map[string]string) (map[string]stmtflow.SessionOptions, map[string]*sql.DB, error) {
+	if len(t.Sessions) == 0 {
+		return nil, nil, nil
+	}
+	opts := make(map[string]stmtflow.SessionOptions, len(t.Sessions))
+	logins := map[string]*sql.DB{}
+	for s, spec := range t.Sessions {
+		so, err := spec.Options()
+		if err != nil {
+			closeEndpoints(logins)
+			return nil, nil, errors.Wrap(err, "setup session "+s)
+		}
+		if len(spec.User) > 0 {
+			src := dsn
+			for _, stmt := range t.Test {
+				if stmt.Sess == s && len(stmt.Endpoint) > 0 {
+					src = dsns[stmt.Endpoint]
+					break
+				}
+			}
+			cfg, err := mysql.ParseDSN(src)
+			if err != nil {
+				closeEndpoints(logins)
+				return nil, nil, errors.Wrap(err, "parse dsn of session "+s)
+			}
+			cfg.User, cfg.Passwd = spec.User, spec.Password
+			if so.Source, err = c.Open(cfg.FormatDSN()); err != nil {
+				closeEndpoints(logins)
+				return nil, nil, errors.Wrap(err, "open session "+s)
+			}
+			logins[s] = so.Source
+		}
+		opts[s] = so
+	}
+	return opts, logins, nil
+}
+
+func closeEndpoints(dbs map[string]*sql.DB) {
+	for _, db := range dbs {
+		db.Close()
+	}
+}
+
+// openEventSink opens a buffered sink writing events as json lines to path, it returns nil if path is empty.
+func openEventSink(path string) (stmtflow.EventSink, error) {
+	if len(path) == 0 {
+		return nil, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return stmtflow.NewBufferedSink(stmtflow.NewJsonlSink(f), eventBufferSize), nil
 }
 
 func (c *CommonOptions) EvalOptions() stmtflow.EvalOptions {
-	return stmtflow.EvalOptions{PingTime: c.PingTime, BlockTime: c.BlockTime}
+	opts := stmtflow.EvalOptions{PingTime: c.PingTime, BlockTime: c.BlockTime, KillOnAbort: c.KillStuck}
+	if c.ObserveLocks {
+		opts.Observer = &stmtflow.LockWaitObserver{}
+	}
+	return opts
 }
 
 func (c *CommonOptions) WithTimeout(ctx context.Context) context.Context {
@@ -34,12 +206,29 @@ func (c *CommonOptions) WithTimeout(ctx context.Context) context.Context {
 	return ctx
 }
 
+func defaultImportCache() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "stmtflow", "imports")
+}
+
 func Root() *cobra.Command {
-	var opts CommonOptions
+	var (
+		opts     CommonOptions
+		dsns     []string
+		statuses []string
+		imports  core.ImportOptions
+	)
 	cmd := &cobra.Command{
 		Use:   "stmtflow",
 		Short: "stmtflow - an enhanced mysql-test.",
 		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			opts.DSN = defaultDSN
+			opts.SetDSNs(dsns)
+			opts.SetStatusAddrs(statuses)
+			core.SetImportOptions(imports)
 			if dsn := os.Getenv("STMTFLOW_DSN"); len(dsn) > 0 {
 				opts.DSN = dsn
 			}
@@ -48,12 +237,20 @@ func Root() *cobra.Command {
 			return cmd.Help()
 		},
 	}
-	cmd.PersistentFlags().StringVar(&opts.DSN, "dsn", "root:@tcp(127.0.0.1:4000)/test", "data source name")
+	cmd.PersistentFlags().StringArrayVar(&dsns, "dsn", []string{defaultDSN}, "data source name, or name=dsn for a named endpoint")
+	cmd.PersistentFlags().StringArrayVar(&statuses, "status-addr", nil, "status address of the server for control steps, or name=addr for a named endpoint")
 	cmd.PersistentFlags().DurationVar(&opts.Timeout, "timeout", 60*time.Second, "timeout for a single test")
 	cmd.PersistentFlags().DurationVar(&opts.PingTime, "ping-time", 200*time.Millisecond, "max wait time to ping a blocked statement")
 	cmd.PersistentFlags().DurationVar(&opts.BlockTime, "block-time", 9*time.Second, "max time to wait a newly submitted statement")
+	cmd.PersistentFlags().BoolVar(&opts.ObserveLocks, "observe-locks", false, "find out blockers of blocked statements via lock views")
+	cmd.PersistentFlags().BoolVar(&opts.KillStuck, "kill-stuck", true, "kill running statements of interrupted tests, connection ids are queried for it")
+	cmd.PersistentFlags().BoolVar(&opts.AllowExec, "allow-exec", false, "allow `exec` control steps of tests to run shell commands")
+	cmd.PersistentFlags().StringVar(&imports.CacheDir, "import-cache", defaultImportCache(), "directory to cache remote imports of manifests")
+	cmd.PersistentFlags().StringVar(&imports.LockFile, "import-lock", "", "lock file pinning sha256 of remote imports, it's created by pinning all imports if it doesn't exist")
+	cmd.PersistentFlags().BoolVar(&imports.UpdateLock, "update-lock", false, "pin new remote imports to the lock file, imports not pinned are rejected otherwise")
+	cmd.PersistentFlags().BoolVar(&imports.Offline, "offline", false, "resolve remote imports by the cache only")
 
-	cmd.AddCommand(AutoGen(), Play(&opts), Test(&opts))
+	cmd.AddCommand(AutoGen(), Play(&opts), Test(&opts), Explore(&opts), Repl(&opts), Lint())
 
 	return cmd
 }
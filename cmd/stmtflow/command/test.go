@@ -4,12 +4,19 @@ import (
 	"bytes"
 	"context"
 	"database/sql"
+	"encoding/json"
+	stderrors "errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Masterminds/semver/v3"
+	"github.com/go-sql-driver/mysql"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/zyguan/tidb-test-util/cmd/stmtflow/core"
@@ -18,16 +25,23 @@ import (
 
 type testOptions struct {
 	stmtflow.EvalOptions
-	Filter  string
-	DryRun  bool
-	Diff    bool
-	DiffCmd string
+	Filter     string
+	DryRun     bool
+	Diff       bool
+	DiffCmd    string
+	DiffFormat string
+	Parallel   int
+	Reports    []string
+	Update     bool
+	Isolate    bool
+	Replay     string
+	EventsOut  string
 }
 
 func Test(c *CommonOptions) *cobra.Command {
 	opts := testOptions{}
 	cmd := &cobra.Command{
-		Use:           "test [tests.jsonnet ...]",
+		Use:           "test [tests.jsonnet | dir | *.t.sql ...]",
 		Short:         "Run tests",
 		SilenceUsage:  true,
 		SilenceErrors: true,
@@ -36,57 +50,88 @@ func Test(c *CommonOptions) *cobra.Command {
 				return cmd.Help()
 			}
 			opts.EvalOptions = c.EvalOptions()
+			reporters, err := newReporters(opts.Reports)
+			if err != nil {
+				return err
+			}
+			switch opts.DiffFormat {
+			case "":
+				opts.DiffFormat = "text"
+				if fi, err := os.Stdout.Stat(); err == nil && fi.Mode()&os.ModeCharDevice > 0 {
+					opts.DiffFormat = "color"
+				}
+			case "color", "text", "json":
+			default:
+				return errors.New("unknown diff format: " + opts.DiffFormat)
+			}
 			ctx := context.Background()
-			errCnt, skippedCnt := 0, 0
+			var cases []testCase
 			for _, path := range args {
 				log.Printf("[%s] load tests", path)
-				tests, err := core.Load(path, opts.Filter)
+				tests, err := loadTests(path, opts.Filter)
 				if err != nil {
 					return err
 				}
-				// TODO: support concurrent execution
 				for _, t := range tests {
 					if opts.DryRun {
 						log.Printf("[%s#%s] type:%s labels:%s", path, t.Name, t.AssertMethod, t.Labels)
 						continue
 					}
-					repeat := 1
-					if repeat < t.Repeat {
-						repeat = t.Repeat
-					}
-					var (
-						db      *sql.DB
-						skipped bool
-					)
-					for i := 0; i < repeat; i++ {
-						db, err = c.OpenDB()
-						if err != nil {
-							return err
-						}
-						err = validateTiDBVersion(db, t)
-						if err != nil {
-							db.Close()
-							skipped = true
-							break
-						}
-						err = testOne(c.WithTimeout(ctx), db, t, opts)
-						db.Close()
-						if err != nil {
-							break
-						}
-					}
-					if err != nil {
-						if skipped {
-							log.Printf("[%s#%s] skipped: %v", path, t.Name, err)
-							skippedCnt += 1
-						} else {
-							log.Printf("[%s#%s] failed:  %+v", path, t.Name, err)
-							errCnt += 1
-						}
-					} else {
-						log.Printf("[%s#%s] passed", path, t.Name)
+					cases = append(cases, testCase{Path: path, Test: t})
+				}
+			}
+			if len(cases) == 0 {
+				return nil
+			}
+			var outcomes []*testOutcome
+			if len(opts.Replay) > 0 {
+				rec, err := core.LoadRecording(opts.Replay)
+				if err != nil {
+					return err
+				}
+				log.Printf("replay %s (%s, recorded at %s)", opts.Replay, rec.Version, rec.RecordedAt.Format(time.RFC3339))
+				outcomes = replayTests(rec, cases, opts)
+			} else {
+				if opts.EvalOptions.Sink, err = openEventSink(opts.EventsOut); err != nil {
+					return err
+				}
+				outcomes, err = runTests(ctx, c, cases, opts)
+				if opts.EvalOptions.Sink != nil {
+					if e := opts.EvalOptions.Sink.Close(); e != nil && err == nil {
+						err = errors.Wrap(e, "write events")
 					}
 				}
+				if err != nil {
+					return err
+				}
+			}
+			for _, r := range reporters {
+				if err = r.Report(cases, outcomes); err != nil {
+					return err
+				}
+			}
+			failedCnt, timedOutCnt, skippedCnt := 0, 0, 0
+			for _, o := range outcomes {
+				switch o.Status {
+				case testFailed:
+					failedCnt += 1
+				case testTimedOut:
+					timedOutCnt += 1
+				case testSkipped:
+					skippedCnt += 1
+				}
+			}
+			errCnt := failedCnt + timedOutCnt
+			log.Printf("%d passed, %d failed, %d timed out, %d skipped", len(outcomes)-errCnt-skippedCnt, failedCnt, timedOutCnt, skippedCnt)
+			if opts.Update {
+				var updated []string
+				for _, o := range outcomes {
+					updated = append(updated, o.Updated...)
+				}
+				log.Printf("%d expected result files rewritten", len(updated))
+				for _, path := range updated {
+					log.Printf("  %s", path)
+				}
 			}
 			if errCnt > 0 {
 				plural := ""
@@ -100,34 +145,495 @@ func Test(c *CommonOptions) *cobra.Command {
 	}
 	cmd.Flags().StringVarP(&opts.Filter, "filter", "f", "", "filter tests by a jsonnet expr, eg. std.startsWith(test.name, 'foo')")
 	cmd.Flags().BoolVarP(&opts.DryRun, "dry-run", "n", false, "just list tests to be run")
-	cmd.Flags().BoolVar(&opts.Diff, "diff", false, "diff text output if available")
-	cmd.Flags().StringVar(&opts.DiffCmd, "diff-cmd", "diff -u -N --color", "diff command to use")
+	cmd.Flags().BoolVar(&opts.Diff, "diff", false, "diff expected and actual outputs of failed tests")
+	cmd.Flags().StringVar(&opts.DiffCmd, "diff-cmd", "", "external diff command to use, eg. 'diff -u -N --color', the builtin diff is used if it's empty")
+	cmd.Flags().StringVar(&opts.DiffFormat, "diff-format", "", "format of the builtin diff: color, text or json, default to color on terminals")
+	cmd.Flags().StringArrayVar(&opts.Reports, "report", nil, "write test report, eg. junit=report.xml, json=report.json or result=case|file")
+	cmd.Flags().BoolVarP(&opts.Update, "update", "u", false, "rewrite expected result files of failed tests by actual outputs")
+	cmd.Flags().StringVar(&opts.Replay, "replay", "", "assert tests against histories recorded by `play --record` instead of running them")
+	cmd.Flags().StringVar(&opts.EventsOut, "events-out", "", "stream events of tests to a file as json lines, each tagged with its test")
+	cmd.Flags().BoolVar(&opts.Isolate, "isolate", false, "run each test in a database created for it, like tests declared as isolated")
+	cmd.Flags().IntVarP(&opts.Parallel, "parallel", "p", 1, "number of tests to run in parallel, each worker uses its own database if greater than 1")
 
 	return cmd
 }
 
-func testOne(ctx context.Context, db *sql.DB, test core.Test, opts testOptions) (err error) {
-	var actual stmtflow.History
+type testStatus string
+
+const (
+	testPassed   testStatus = "passed"
+	testFailed   testStatus = "failed"
+	testTimedOut testStatus = "timed-out"
+	testSkipped  testStatus = "skipped"
+)
+
+type testCase struct {
+	Path string
+	Test core.Test
+}
+
+func (tc testCase) String() string { return tc.Path + "#" + tc.Test.Name }
+
+// testOutcome buffers everything a test prints, so that outputs of concurrent tests can be flushed in order.
+type testOutcome struct {
+	Status    testStatus
+	Err       error
+	Repeat    int
+	History   stmtflow.History
+	Sessions  stmtflow.Sessions
+	StartedAt time.Time
+	Duration  time.Duration
+	Updated   []string
+
+	out  bytes.Buffer
+	logs bytes.Buffer
+	log  *log.Logger
+	done chan struct{}
+}
+
+func newTestOutcome() *testOutcome {
+	o := &testOutcome{done: make(chan struct{})}
+	o.log = log.New(&o.logs, log.Prefix(), log.Flags())
+	return o
+}
+
+func (o *testOutcome) flush() {
+	io.Copy(os.Stdout, &o.out)
+	io.Copy(log.Writer(), &o.logs)
+}
+
+func runTests(ctx context.Context, c *CommonOptions, cases []testCase, opts testOptions) ([]*testOutcome, error) {
+	n := opts.Parallel
+	if n > len(cases) {
+		n = len(cases)
+	}
+	if n < 1 {
+		n = 1
+	}
+	workers := make([]*testWorker, 0, n)
+	defer func() {
+		for _, w := range workers {
+			if err := w.Close(); err != nil {
+				log.Printf("[worker#%d] close: %v", w.id, err)
+			}
+		}
+	}()
+	for i := 0; i < n; i++ {
+		w, err := newTestWorker(ctx, c, i, n > 1)
+		if err != nil {
+			return nil, err
+		}
+		workers = append(workers, w)
+	}
+
+	outcomes := make([]*testOutcome, len(cases))
+	for i := range outcomes {
+		outcomes[i] = newTestOutcome()
+	}
+	jobs := make(chan int)
+	go func() {
+		for i := range cases {
+			jobs <- i
+		}
+		close(jobs)
+	}()
+	for _, w := range workers {
+		go func(w *testWorker) {
+			for i := range jobs {
+				w.run(ctx, cases[i], outcomes[i], opts)
+				close(outcomes[i].done)
+			}
+		}(w)
+	}
+	for _, o := range outcomes {
+		<-o.done
+		o.flush()
+	}
+	return outcomes, nil
+}
+
+// reservedDBPrefix prefixes names of databases created (and dropped) by workers, so that they never clash with
+// databases of users.
+const reservedDBPrefix = "_stmtflow_"
+
+type testWorker struct {
+	id       int
+	seq      int
+	dsn      string
+	database string
+	c        *CommonOptions
+}
+
+// newTestWorker creates a worker, an isolated database is prepared for the worker if required.
+func newTestWorker(ctx context.Context, c *CommonOptions, id int, isolated bool) (*testWorker, error) {
+	w := &testWorker{id: id, dsn: c.DSN, c: c}
+	if !isolated {
+		return w, nil
+	}
+	cfg, err := mysql.ParseDSN(c.DSN)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse dsn")
+	}
+	w.database = fmt.Sprintf("%sw%d_%s", reservedDBPrefix, id, cfg.DBName)
+	if err = w.exec(ctx, "drop database if exists "+stmtflow.QuoteIdent(w.database), "create database "+stmtflow.QuoteIdent(w.database)); err != nil {
+		return nil, errors.Wrapf(err, "prepare database for worker#%d", id)
+	}
+	cfg.DBName = w.database
+	w.dsn = cfg.FormatDSN()
+	return w, nil
+}
+
+// createDatabase creates a unique database for a test run.
+func (w *testWorker) createDatabase(ctx context.Context) (string, string, error) {
+	cfg, err := mysql.ParseDSN(w.dsn)
+	if err != nil {
+		return "", "", errors.Wrap(err, "parse dsn")
+	}
+	w.seq++
+	cfg.DBName = fmt.Sprintf("%st%d_%d_%s", reservedDBPrefix, w.id, w.seq, strconv.FormatInt(time.Now().UnixNano(), 36))
+	if err = w.exec(ctx, "create database "+stmtflow.QuoteIdent(cfg.DBName)); err != nil {
+		return "", "", errors.Wrap(err, "create database for test")
+	}
+	return cfg.DBName, cfg.FormatDSN(), nil
+}
+
+func (w *testWorker) exec(ctx context.Context, stmts ...string) error {
+	db, err := w.c.OpenDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	for _, stmt := range stmts {
+		if _, err = db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// endpointDSNs returns dsns of endpoints for a test, they connect to the given database if it's not empty, which
+// assumes endpoints are servers of the same cluster.
+func (w *testWorker) endpointDSNs(declared map[string]string, database string) (map[string]string, error) {
+	dsns := w.c.EndpointDSNs(declared)
+	if len(database) > 0 {
+		for name, dsn := range dsns {
+			cfg, err := mysql.ParseDSN(dsn)
+			if err != nil {
+				return nil, errors.Wrap(err, "parse dsn of endpoint "+name)
+			}
+			cfg.DBName = database
+			dsns[name] = cfg.FormatDSN()
+		}
+	}
+	return dsns, nil
+}
+
+func (w *testWorker) Close() error {
+	if len(w.database) == 0 {
+		return nil
+	}
+	return w.exec(context.Background(), "drop database if exists "+stmtflow.QuoteIdent(w.database))
+}
+
+func (w *testWorker) run(ctx context.Context, tc testCase, o *testOutcome, opts testOptions) {
+	t := tc.Test
+	repeat := 1
+	if repeat < t.Repeat {
+		repeat = t.Repeat
+	}
+	var (
+		err      error
+		asserted bool
+	)
+	o.StartedAt = time.Now()
+	defer func() { o.Duration = time.Since(o.StartedAt) }()
+	if err = w.validate(t); err != nil {
+		o.Status = testSkipped
+	}
+	for i := 0; i < repeat && err == nil; i++ {
+		dsn, database := w.dsn, w.database
+		if t.Isolated || opts.Isolate {
+			if database, dsn, err = w.createDatabase(ctx); err != nil {
+				break
+			}
+		}
+		o.Repeat += 1
+		opts.EvalOptions.OnSession = o.Sessions.Collect
+		opts.EvalOptions.Source = tc.String()
+		o.History, asserted, err = w.runOnce(ctx, t, dsn, database, opts, &o.out)
+		if database != w.database {
+			if e := w.exec(context.Background(), "drop database if exists "+stmtflow.QuoteIdent(database)); e != nil {
+				o.log.Printf("[%s] drop database %s: %v", tc, database, e)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	o.finish(tc, err, asserted, opts)
+}
+
+// finish sets the status of the outcome by the error, expected results are updated if it's required.
+func (o *testOutcome) finish(tc testCase, err error, asserted bool, opts testOptions) {
+	o.Err = err
+	if err != nil {
+		if o.Status == testSkipped {
+			o.log.Printf("[%s] skipped: %v", tc, err)
+		} else {
+			o.Status = testFailed
+			if stderrors.Is(err, context.DeadlineExceeded) {
+				o.Status = testTimedOut
+			}
+			o.log.Printf("[%s] %s:  %+v", tc, o.Status, err)
+			if opts.Update && asserted && !endsWithTimeout(o.History) {
+				var err error
+				o.Updated, err = updateExpected(tc, o.History, o.Sessions)
+				if err != nil {
+					o.log.Printf("[%s] cannot update: %v", tc, err)
+				} else {
+					o.log.Printf("[%s] updated: %s", tc, strings.Join(o.Updated, ", "))
+				}
+			}
+		}
+	} else {
+		o.Status = testPassed
+		o.log.Printf("[%s] passed", tc)
+	}
+}
+
+// endsWithTimeout reports whether a history is a partial one of an interrupted run.
+func endsWithTimeout(h stmtflow.History) bool {
+	return len(h) > 0 && h[len(h)-1].Kind == stmtflow.EventTimeout
+}
+
+// replayTests asserts tests against recorded histories, tests which are not recorded are skipped.
+func replayTests(rec *core.Recording, cases []testCase, opts testOptions) []*testOutcome {
+	outcomes := make([]*testOutcome, len(cases))
+	for i, tc := range cases {
+		o := newTestOutcome()
+		o.StartedAt = time.Now()
+		asserted, err := replayOne(rec, tc.Test, o, opts)
+		o.finish(tc, err, asserted, opts)
+		o.Duration = time.Since(o.StartedAt)
+		o.flush()
+		outcomes[i] = o
+	}
+	return outcomes
+}
+
+// replayOne asserts a test against its recorded history, the version constraint is checked by the recorded version.
+func replayOne(rec *core.Recording, t core.Test, o *testOutcome, opts testOptions) (bool, error) {
+	run, ok := rec.Lookup(t)
+	if !ok {
+		o.Status = testSkipped
+		return false, errors.New("no recorded run")
+	}
+	if err := validateVersion(rec.Version, t); err != nil {
+		o.Status = testSkipped
+		return false, err
+	}
+	o.Repeat, o.History, o.Sessions = 1, run.History, run.Sessions
+	var runErr error
+	if endsWithTimeout(run.History) {
+		runErr = errors.Wrap(context.DeadlineExceeded, "recorded run")
+	}
+	err := assertPartial(t, run.History, runErr)
+	if err != nil && opts.Diff {
+		_ = writeDiff(&o.out, t, run.History, opts)
+	}
+	return true, err
+}
+
+func (w *testWorker) validate(t core.Test) error {
+	db, err := w.c.Open(w.dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return validateTiDBVersion(db, t)
+}
+
+// runOnce runs a test once against the given dsn, database is the name of the database in use if it's isolated.
+func (w *testWorker) runOnce(ctx context.Context, t core.Test, dsn string, database string, opts testOptions, out io.Writer) (stmtflow.History, bool, error) {
+	db, err := w.c.Open(dsn)
+	if err != nil {
+		return nil, false, err
+	}
+	defer db.Close()
+	dsns, err := w.endpointDSNs(t.Endpoints, database)
+	if err != nil {
+		return nil, false, err
+	}
+	if opts.EvalOptions.Endpoints, err = w.c.openEndpoints(dsns); err != nil {
+		return nil, false, err
+	}
+	defer closeEndpoints(opts.EvalOptions.Endpoints)
+	var logins map[string]*sql.DB
+	if opts.EvalOptions.Sessions, logins, err = w.c.openSessions(t, dsn, dsns); err != nil {
+		return nil, false, err
+	}
+	defer closeEndpoints(logins)
+	opts.EvalOptions.Controller = w.c.Controller(w.c.EndpointDSNs(t.Endpoints))
+	return testOne(w.c.WithTimeout(ctx), db, t, opts, out)
+}
+
+// testOne runs a test and asserts its history, asserted reports whether err is returned by assertions. Fixtures of
+// the test are run before and after it, the teardown runs in its own context, so that it's not skipped on timeout.
+func testOne(ctx context.Context, db *sql.DB, test core.Test, opts testOptions, out io.Writer) (actual stmtflow.History, asserted bool, err error) {
+	defer func() {
+		tctx, cancel := context.WithTimeout(context.Background(), teardownTimeout)
+		defer cancel()
+		if e := runFixture(tctx, db, test.Teardown, opts.EvalOptions); e != nil && err == nil {
+			err, asserted = errors.Wrap(e, "run teardown"), false
+		}
+	}()
+	if err = runFixture(ctx, db, test.Setup, opts.EvalOptions); err != nil {
+		return actual, false, errors.Wrap(err, "run setup")
+	}
 	evalOpts := opts.EvalOptions
 	evalOpts.Callback = actual.Collect
-	err = stmtflow.Run(ctx, db, test.Test, evalOpts)
-	if err != nil {
-		return errors.Wrap(err, "run test")
+	if err = stmtflow.Run(ctx, db, test.Test, evalOpts); err != nil {
+		if ctx.Err() == nil {
+			return actual, false, errors.Wrap(err, "run test")
+		}
+		err = errors.Wrap(ctx.Err(), "run test")
+	}
+	// the partial history of a timed-out run ends with a timeout event, it's asserted like a complete one
+	err = assertPartial(test, actual, err)
+	if err != nil && opts.Diff {
+		_ = writeDiff(out, test, actual, opts)
 	}
-	err = test.Assert(actual)
-	if err == nil || !opts.Diff {
-		return
+	return actual, true, err
+}
+
+// assertPartial asserts a history which might be interrupted by runErr. An interrupted run passes only if the
+// expected results end with the timeout as well, otherwise it's reported as a timeout with the assertion message.
+func assertPartial(test core.Test, actual stmtflow.History, runErr error) error {
+	err := test.Assert(actual)
+	if runErr == nil {
+		return err
+	} else if err != nil {
+		return errors.Wrapf(runErr, "%v, interrupted", err)
+	} else if expectsTimeout(test) {
+		return nil
+	}
+	return runErr
+}
+
+// expectsTimeout reports whether expected results of a test end with a timeout event.
+func expectsTimeout(test core.Test) bool {
+	if exp, ok := test.ExpectedHistory(); ok {
+		return endsWithTimeout(exp)
+	}
+	exp, ok := test.ExpectedText()
+	return ok && strings.Contains("\n"+exp, "\n-- timeout")
+}
+
+const teardownTimeout = 30 * time.Second
+
+// runFixture runs statements of a fixture, it fails on the first unexpected error of them.
+func runFixture(ctx context.Context, db *sql.DB, stmts []stmtflow.Stmt, opts stmtflow.EvalOptions) error {
+	if len(stmts) == 0 {
+		return nil
+	}
+	var h stmtflow.History
+	opts.Callback, opts.OnSession, opts.Sink = h.Collect, nil, nil
+	if err := stmtflow.Run(ctx, db, stmts, opts); err != nil {
+		return err
+	}
+	for _, e := range h {
+		if e.Kind != stmtflow.EventReturn {
+			continue
+		}
+		if ret := e.Return(); ret.Err != nil {
+			if code := stmtflow.WrapError(ret.Err).(*stmtflow.Error).Code; !hasCode(ret.ExpectErrors, code) {
+				return errors.Wrap(ret.Err, ret.SQL)
+			}
+		}
+	}
+	return nil
+}
+
+func hasCode(codes []int, code int) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// writeDiff writes the difference between expected and actual outputs of a test, events are compared if the test
+// is asserted by an expected history, otherwise text outputs are compared.
+func writeDiff(out io.Writer, test core.Test, actual stmtflow.History, opts testOptions) error {
+	if exp, ok := test.ExpectedHistory(); ok && len(opts.DiffCmd) == 0 {
+		d := stmtflow.DiffHistory(exp, actual, test.Compare)
+		if opts.DiffFormat == "json" {
+			return json.NewEncoder(out).Encode(map[string]interface{}{"name": test.Name, "diff": d})
+		}
+		fmt.Fprintf(out, "--- %s (expected)\n+++ %s (actual)\n", test.Name, test.Name)
+		return d.DumpText(out, opts.DiffFormat == "color")
 	}
 	exp, ok := test.ExpectedText()
 	if !ok {
-		return
+		return nil
 	}
 	buf := new(bytes.Buffer)
-	if e := actual.DumpText(buf, stmtflow.TextDumpOptions{Verbose: true}); e != nil {
-		return
+	if err := actual.DumpText(buf, stmtflow.TextDumpOptions{Verbose: true}); err != nil {
+		return err
+	}
+	if len(opts.DiffCmd) > 0 {
+		return core.LocalDiff(out, test.Name, exp, buf.String(), strings.Fields(opts.DiffCmd))
+	}
+	if opts.DiffFormat == "json" {
+		text := new(strings.Builder)
+		if err := core.TextDiff(text, test.Name, exp, buf.String(), false); err != nil {
+			return err
+		}
+		return json.NewEncoder(out).Encode(map[string]interface{}{"name": test.Name, "text": text.String()})
 	}
-	_ = core.LocalDiff(os.Stdout, test.Name, exp, buf.String(), strings.Split(opts.DiffCmd, " "))
-	return
+	return core.TextDiff(out, test.Name, exp, buf.String(), opts.DiffFormat == "color")
+}
+
+// updateExpected rewrites expected result files of a test by the actual history, sessions are kept in .r.json files.
+func updateExpected(tc testCase, actual stmtflow.History, sessions stmtflow.Sessions) ([]string, error) {
+	t := tc.Test
+	if t.AssertMethod == "function" {
+		return nil, errors.New("expect is a function")
+	}
+	testPath := t.Path
+	if len(testPath) == 0 {
+		// tests generated by legacy manifests are named after their paths.
+		testPath = filepath.Join(filepath.Dir(tc.Path), filepath.Base(t.Name)+stdTestExt)
+	}
+	if fi, err := os.Stat(testPath); err != nil || fi.IsDir() {
+		return nil, errors.New("test file of " + t.Name + " is not found")
+	}
+	var paths []string
+	for _, resPath := range []string{resultPathForJson(testPath), resultPathForText(testPath)} {
+		if fi, err := os.Stat(resPath); err == nil && !fi.IsDir() {
+			paths = append(paths, resPath)
+		}
+	}
+	if len(paths) == 0 {
+		return nil, errors.New("expected result file of " + t.Name + " is not found")
+	}
+	for _, path := range paths {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasSuffix(path, stdJsonResExt) {
+			err = actual.DumpJson(f, stmtflow.JsonDumpOptions{Sessions: sessions})
+		} else {
+			err = actual.DumpText(f, stmtflow.TextDumpOptions{Verbose: true})
+		}
+		f.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "write "+path)
+		}
+	}
+	return paths, nil
 }
 
 func validateTiDBVersion(db *sql.DB, test core.Test) error {
@@ -139,6 +645,14 @@ func validateTiDBVersion(db *sql.DB, test core.Test) error {
 	if err != nil {
 		return errors.Wrap(err, "query for version")
 	}
+	return validateVersion(ver, test)
+}
+
+// validateVersion checks a version reported by the server against the version constraint of a test.
+func validateVersion(ver string, test core.Test) error {
+	if len(test.VersionConstraint) == 0 {
+		return nil
+	}
 	if idx := strings.Index(ver, "-TiDB-"); idx > 0 {
 		ver = ver[idx+6:]
 	}
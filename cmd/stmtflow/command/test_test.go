@@ -0,0 +1,244 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	stderrors "errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zyguan/tidb-test-util/cmd/stmtflow/core"
+	"github.com/zyguan/tidb-test-util/pkg/result"
+	"github.com/zyguan/tidb-test-util/pkg/stmtflow"
+)
+
+type passAssertion struct{}
+
+func (passAssertion) Assert(actual stmtflow.History) error { return nil }
+func (passAssertion) ExpectedText() (string, bool)         { return "", false }
+
+func testCaseOf(name string, sqls ...string) testCase {
+	t := core.Test{Name: name, Assertions: []core.Assertion{passAssertion{}}}
+	for _, sql := range sqls {
+		t.Test = append(t.Test, stmtflow.Stmt{Sess: "s1", SQL: sql})
+	}
+	return testCase{Path: "t.json", Test: t}
+}
+
+func captureLogs(t *testing.T) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	log.SetOutput(buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return buf
+}
+
+func TestRunTestsInOrder(t *testing.T) {
+	c, srv := fakeOptions("test")
+	logs := captureLogs(t)
+	// later tests finish earlier, but outputs are flushed in order
+	cases := []testCase{
+		testCaseOf("t0", "sleep 90"),
+		testCaseOf("t1", "sleep 60"),
+		testCaseOf("t2", "sleep 30"),
+		testCaseOf("t3", "select 1"),
+	}
+	outcomes, err := runTests(context.Background(), c, cases, testOptions{EvalOptions: c.EvalOptions(), Parallel: 3})
+	require.NoError(t, err)
+	require.Len(t, outcomes, len(cases))
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		lines = append(lines, line[strings.Index(line, "["):])
+	}
+	require.Equal(t, []string{"[t.json#t0] passed", "[t.json#t1] passed", "[t.json#t2] passed", "[t.json#t3] passed"}, lines)
+	for i, o := range outcomes {
+		require.Equal(t, testPassed, o.Status, i)
+	}
+
+	// each worker runs in its own database
+	dbs := map[string]bool{}
+	for _, l := range srv.logs() {
+		if strings.Contains(l, "sleep") || strings.Contains(l, "select") {
+			dbs[l[:strings.Index(l, ":")]] = true
+		}
+	}
+	require.Len(t, dbs, 3)
+	for i := 0; i < 3; i++ {
+		require.True(t, dbs["_stmtflow_w"+strconv.Itoa(i)+"_test"])
+	}
+}
+
+func TestWorkerDatabases(t *testing.T) {
+	c, srv := fakeOptions("test", "test_w0", "test_w1")
+	captureLogs(t)
+	cases := []testCase{testCaseOf("t0", "select 1"), testCaseOf("t1", "select 1"), testCaseOf("t2", "select 1")}
+	outcomes, err := runTests(context.Background(), c, cases, testOptions{EvalOptions: c.EvalOptions(), Parallel: 2, Isolate: true})
+	require.NoError(t, err)
+	for _, o := range outcomes {
+		require.Equal(t, testPassed, o.Status)
+	}
+	// databases of users are never touched, reserved ones are dropped after tests
+	require.True(t, srv.hasDB("test"))
+	require.True(t, srv.hasDB("test_w0"))
+	require.True(t, srv.hasDB("test_w1"))
+	created := 0
+	for _, l := range srv.logs() {
+		if strings.Contains(l, "create database") {
+			created++
+			require.Contains(t, l, "`"+reservedDBPrefix)
+		}
+		if strings.Contains(l, "drop database") {
+			require.Contains(t, l, "`"+reservedDBPrefix)
+		}
+	}
+	require.Equal(t, 2+len(cases), created)
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	for db := range srv.dbs {
+		require.False(t, strings.HasPrefix(db, reservedDBPrefix), db)
+	}
+}
+
+func TestTimedOutTest(t *testing.T) {
+	c, _ := fakeOptions("test")
+	c.Timeout = 200 * time.Millisecond
+	captureLogs(t)
+	dir := t.TempDir()
+	tc := testCaseOf("t0", "select 1", "hang")
+	tc.Path = filepath.Join(dir, "t0.t.sql")
+	outcomes, err := runTests(context.Background(), c, []testCase{tc}, testOptions{EvalOptions: c.EvalOptions(), Update: true})
+	require.NoError(t, err)
+	o := outcomes[0]
+	require.Equal(t, testTimedOut, o.Status)
+	require.True(t, stderrors.Is(o.Err, context.DeadlineExceeded))
+	require.Equal(t, result.TimedOut, testReport{Status: o.Status}.conclusion())
+	// the partial history is kept, but expected results are not updated by it
+	require.True(t, endsWithTimeout(o.History))
+	require.Empty(t, o.Updated)
+	o2 := newTestOutcome()
+	o2.History = o.History
+	o2.finish(tc, stderrors.New("result mismatch"), true, testOptions{Update: true})
+	require.Empty(t, o2.Updated)
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
+
+func TestAssertTimedOutTest(t *testing.T) {
+	c, _ := fakeOptions("test")
+	c.Timeout = 200 * time.Millisecond
+	captureLogs(t)
+	dir := t.TempDir()
+	testPath := writeFile(t, filepath.Join(dir, "t0.t.sql"), "/* s1 */ insert into t values (1);\n/* s1 */ hang;\n")
+	resPath := writeFile(t, filepath.Join(dir, "t0.r.json"), "[]\n")
+	run := func() *testOutcome {
+		loaded, err := core.LoadSQL("t0", testPath, resPath)
+		require.NoError(t, err)
+		outcomes, err := runTests(context.Background(), c, []testCase{{Path: testPath, Test: loaded}}, testOptions{EvalOptions: c.EvalOptions(), Update: true})
+		require.NoError(t, err)
+		return outcomes[0]
+	}
+
+	// the partial history is asserted, but it's never written back
+	o := run()
+	require.Equal(t, testTimedOut, o.Status)
+	require.True(t, stderrors.Is(o.Err, context.DeadlineExceeded))
+	require.Contains(t, o.Err.Error(), "interrupted")
+	require.True(t, endsWithTimeout(o.History))
+	require.Empty(t, o.Updated)
+	raw, err := os.ReadFile(resPath)
+	require.NoError(t, err)
+	require.Equal(t, "[]\n", string(raw))
+
+	// a timeout can be expected
+	_, err = updateExpected(testCase{Path: testPath, Test: core.Test{Name: "t0", Path: testPath}}, o.History, nil)
+	require.NoError(t, err)
+	o = run()
+	require.Equal(t, testPassed, o.Status, "%+v", o.Err)
+	require.True(t, endsWithTimeout(o.History))
+}
+
+func TestRunFixture(t *testing.T) {
+	c, srv := fakeOptions("test")
+	db, err := c.OpenDB()
+	require.NoError(t, err)
+	defer db.Close()
+	ctx := context.Background()
+
+	fixture := func(sqls ...string) []stmtflow.Stmt { return testCaseOf("", sqls...).Test.Test }
+	require.NoError(t, runFixture(ctx, db, nil, c.EvalOptions()))
+	require.NoError(t, runFixture(ctx, db, fixture("create table t", "insert into t"), c.EvalOptions()))
+	require.Equal(t, []string{"test: create table t", "test: insert into t"}, srv.logs())
+
+	err = runFixture(ctx, db, fixture("fail", "select 1"), c.EvalOptions())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "fail: ")
+
+	// expected errors are tolerated
+	stmts := fixture("fail", "select 2")
+	stmts[0].ExpectErrors = []int{1105}
+	require.NoError(t, runFixture(ctx, db, stmts, c.EvalOptions()))
+	require.Contains(t, srv.logs(), "test: select 2")
+}
+
+func TestIsolatedFixtures(t *testing.T) {
+	c, srv := fakeOptions("test")
+	captureLogs(t)
+	tc := testCaseOf("t0", "select 1")
+	tc.Test.Setup, tc.Test.Teardown = testCaseOf("", "create table t").Test.Test, testCaseOf("", "drop table t").Test.Test
+	broken := testCaseOf("t1", "select 1")
+	broken.Test.Setup, broken.Test.Teardown = testCaseOf("", "fail").Test.Test, testCaseOf("", "drop table t").Test.Test
+
+	outcomes, err := runTests(context.Background(), c, []testCase{tc, broken}, testOptions{EvalOptions: c.EvalOptions(), Isolate: true})
+	require.NoError(t, err)
+	require.Equal(t, testPassed, outcomes[0].Status)
+	require.Equal(t, testFailed, outcomes[1].Status)
+	require.Contains(t, outcomes[1].Err.Error(), "run setup")
+
+	// fixtures run around the test in the database of the run, the teardown runs even if the setup fails
+	var runs [][]string
+	dbs := map[string]int{}
+	for _, l := range srv.logs() {
+		db, sql := l[:strings.Index(l, ":")], l[strings.Index(l, ":")+2:]
+		if !strings.HasPrefix(db, reservedDBPrefix+"t") {
+			continue
+		}
+		k, ok := dbs[db]
+		if !ok {
+			k, dbs[db] = len(runs), len(runs)
+			runs = append(runs, nil)
+		}
+		runs[k] = append(runs[k], sql)
+	}
+	require.Equal(t, [][]string{{"create table t", "select 1", "drop table t"}, {"fail", "drop table t"}}, runs)
+}
+
+func TestUpdateExpectedWithSessions(t *testing.T) {
+	dir := t.TempDir()
+	testPath := writeFile(t, filepath.Join(dir, "t0.t.sql"), "/* s1 */ select 1;\n")
+	resPath := writeFile(t, filepath.Join(dir, "t0.r.json"), "[]\n")
+	h := stmtflow.History{stmtflow.NewResumeEvent("s1")}
+	sessions := stmtflow.Sessions{"s1": {ConnID: 3, User: "u1@%", Vars: map[string]string{"tidb_txn_mode": "pessimistic"}}}
+
+	tc := testCaseOf("t0")
+	tc.Test.Path, tc.Test.AssertMethod = testPath, "array"
+	updated, err := updateExpected(tc, h, sessions)
+	require.NoError(t, err)
+	require.Equal(t, []string{resPath}, updated)
+	raw, err := os.ReadFile(resPath)
+	require.NoError(t, err)
+	require.Contains(t, string(raw), `"tidb_txn_mode":"pessimistic"`)
+
+	// results with sessions are loaded as histories
+	loaded, err := core.LoadSQL("t0", testPath, resPath)
+	require.NoError(t, err)
+	expected, ok := loaded.ExpectedHistory()
+	require.True(t, ok)
+	require.Len(t, expected, 1)
+	require.NoError(t, loaded.Assert(h))
+}
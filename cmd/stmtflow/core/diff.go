@@ -1,6 +1,7 @@
 package core
 
 import (
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -36,3 +37,123 @@ func LocalDiff(w io.Writer, name string, txt1 string, txt2 string, diff []string
 	cmd.Stdout = w
 	return cmd.Run()
 }
+
+// TextDiff writes a unified diff of two texts without calling external tools, ANSI colors are used if color is set.
+func TextDiff(w io.Writer, name string, txt1 string, txt2 string, color bool) error {
+	paint := func(c string, s string) string {
+		if !color {
+			return s
+		}
+		return c + s + "\x1b[0m"
+	}
+	a, b := splitLines(txt1), splitLines(txt2)
+	ops := diffLines(a, b)
+	if _, err := fmt.Fprintln(w, paint("\x1b[1m", "--- "+name+" (expected)\n+++ "+name+" (actual)")); err != nil {
+		return err
+	}
+	const context = 3
+	for k := 0; k < len(ops); {
+		if ops[k].kind == ' ' {
+			k++
+			continue
+		}
+		// extend the hunk until there are more than 2*context unchanged lines
+		start, end := k-context, k+1
+		for end < len(ops) {
+			next := end
+			for next < len(ops) && ops[next].kind == ' ' {
+				next++
+			}
+			if next == len(ops) || next-end > 2*context {
+				break
+			}
+			end = next + 1
+		}
+		if start < 0 {
+			start = 0
+		}
+		if end += context; end > len(ops) {
+			end = len(ops)
+		}
+		n1, n2 := 0, 0
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				n1++
+			}
+			if op.kind != '-' {
+				n2++
+			}
+		}
+		s1, s2 := ops[start].i+1, ops[start].j+1
+		if n1 == 0 {
+			s1--
+		}
+		if n2 == 0 {
+			s2--
+		}
+		fmt.Fprintln(w, paint("\x1b[36m", fmt.Sprintf("@@ -%d,%d +%d,%d @@", s1, n1, s2, n2)))
+		for _, op := range ops[start:end] {
+			switch op.kind {
+			case '-':
+				fmt.Fprintln(w, paint("\x1b[31m", "-"+op.line))
+			case '+':
+				fmt.Fprintln(w, paint("\x1b[32m", "+"+op.line))
+			default:
+				fmt.Fprintln(w, " "+op.line)
+			}
+		}
+		k = end
+	}
+	return nil
+}
+
+type lineOp struct {
+	kind byte
+	line string
+	// i and j are positions of the line in both texts
+	i, j int
+}
+
+// diffLines computes a line diff by the longest common subsequence.
+func diffLines(a []string, b []string) []lineOp {
+	n, m := len(a), len(b)
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	ops := make([]lineOp, 0, n+m)
+	i, j := 0, 0
+	for i < n || j < m {
+		if i < n && j < m && a[i] == b[j] {
+			ops = append(ops, lineOp{' ', a[i], i, j})
+			i++
+			j++
+		} else if i < n && (j == m || lcs[i+1][j] >= lcs[i][j+1]) {
+			ops = append(ops, lineOp{'-', a[i], i, j})
+			i++
+		} else {
+			ops = append(ops, lineOp{'+', b[j], i, j})
+			j++
+		}
+	}
+	return ops
+}
+
+func splitLines(s string) []string {
+	s = strings.TrimRight(s, "\n")
+	if len(s) == 0 {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
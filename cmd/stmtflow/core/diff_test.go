@@ -0,0 +1,108 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// lcsLength computes the length of the longest common subsequence by brute force.
+func lcsLength(a []string, b []string) int {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	if a[0] == b[0] {
+		return 1 + lcsLength(a[1:], b[1:])
+	}
+	x, y := lcsLength(a[1:], b), lcsLength(a, b[1:])
+	if x > y {
+		return x
+	}
+	return y
+}
+
+func TestDiffLines(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	randLines := func() []string {
+		lines := make([]string, r.Intn(8))
+		for i := range lines {
+			lines[i] = string(rune('a' + r.Intn(3)))
+		}
+		return lines
+	}
+	for k := 0; k < 200; k++ {
+		a, b := randLines(), randLines()
+		ops := diffLines(a, b)
+		var (
+			a1, b1 []string
+			common int
+		)
+		for _, op := range ops {
+			if op.kind != '+' {
+				require.Equal(t, len(a1), op.i)
+				a1 = append(a1, op.line)
+			}
+			if op.kind != '-' {
+				require.Equal(t, len(b1), op.j)
+				b1 = append(b1, op.line)
+			}
+			if op.kind == ' ' {
+				common++
+			}
+		}
+		// ops rebuild both texts and keep the longest common subsequence
+		require.Equal(t, fmt.Sprint(a), fmt.Sprint(a1))
+		require.Equal(t, fmt.Sprint(b), fmt.Sprint(b1))
+		require.Equal(t, lcsLength(a, b), common, "%v vs %v", a, b)
+	}
+}
+
+func textDiff(t *testing.T, txt1 string, txt2 string) string {
+	buf := new(bytes.Buffer)
+	require.NoError(t, TextDiff(buf, "t0", txt1, txt2, false))
+	return strings.TrimPrefix(buf.String(), "--- t0 (expected)\n+++ t0 (actual)\n")
+}
+
+func TestTextDiff(t *testing.T) {
+	require.Equal(t, "@@ -1,3 +1,3 @@\n a\n-b\n+x\n c\n", textDiff(t, "a\nb\nc\n", "a\nx\nc\n"))
+	require.Equal(t, "@@ -1,2 +1,3 @@\n a\n b\n+c\n", textDiff(t, "a\nb", "a\nb\nc\n"))
+
+	var lines []string
+	for i := 1; i <= 20; i++ {
+		lines = append(lines, fmt.Sprintf("l%d", i))
+	}
+	txt1 := strings.Join(lines, "\n")
+	lines[1], lines[17] = "x", "y"
+	txt2 := strings.Join(lines, "\n")
+	// changes far apart are written in separated hunks with 3 lines of context
+	require.Equal(t, strings.Join([]string{
+		"@@ -1,5 +1,5 @@", " l1", "-l2", "+x", " l3", " l4", " l5",
+		"@@ -15,6 +15,6 @@", " l15", " l16", " l17", "-l18", "+y", " l19", " l20",
+	}, "\n")+"\n", textDiff(t, txt1, txt2))
+
+	// changes close to each other are merged into one hunk
+	lines[7] = "z"
+	out := textDiff(t, txt1, strings.Join(lines, "\n"))
+	require.Equal(t, 2, strings.Count(out, "@@ -"), out)
+	require.True(t, strings.HasPrefix(out, "@@ -1,11 +1,11 @@\n"), out)
+	require.Contains(t, out, "\n l7\n-l8\n+z\n l9\n")
+}
+
+func TestTextDiffEmpty(t *testing.T) {
+	require.Empty(t, textDiff(t, "", ""))
+	require.Empty(t, textDiff(t, "a\nb\n", "a\nb\n"))
+	require.Empty(t, textDiff(t, "a\n", "a"))
+	require.Equal(t, "@@ -0,0 +1,2 @@\n+a\n+b\n", textDiff(t, "", "a\nb\n"))
+	require.Equal(t, "@@ -1,2 +0,0 @@\n-a\n-b\n", textDiff(t, "a\nb\n", ""))
+}
+
+func TestTextDiffColor(t *testing.T) {
+	buf := new(bytes.Buffer)
+	require.NoError(t, TextDiff(buf, "t0", "a\n", "b\n", true))
+	require.Equal(t, "\x1b[1m--- t0 (expected)\n+++ t0 (actual)\x1b[0m\n"+
+		"\x1b[36m@@ -1,1 +1,1 @@\x1b[0m\n\x1b[31m-a\x1b[0m\n\x1b[32m+b\x1b[0m\n", buf.String())
+}
@@ -0,0 +1,242 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/zyguan/tidb-test-util/pkg/fs"
+
+	. "github.com/google/go-jsonnet"
+)
+
+const fileServerScheme = "fileserver"
+
+// ImportOptions controls how remote imports (http://, https:// and fileserver://) of manifests are resolved.
+type ImportOptions struct {
+	// CacheDir keeps contents of remote imports on disk, nothing is cached on disk if it's empty.
+	CacheDir string
+	// LockFile pins sha256 of remote imports, contents not matching are rejected, so are imports not pinned unless
+	// UpdateLock is set. All imports are pinned if the lock file doesn't exist yet. Remote imports are not verified if
+	// it's empty.
+	LockFile string
+	// UpdateLock pins new imports to the lock file, it's ignored in offline mode.
+	UpdateLock bool
+	// Offline resolves remote imports by the cache only.
+	Offline bool
+	// FileServer resolves fileserver:// imports, fs.Default() is used if it's nil.
+	FileServer *fs.Client
+}
+
+// ImportLock is the content of a lock file, it maps urls of remote imports to their sha256 in hex.
+type ImportLock struct {
+	Imports map[string]string `json:"imports"`
+}
+
+var remoteImports = newRemoteImporter(ImportOptions{})
+
+// SetImportOptions applies options to remote imports of all manifests loaded afterwards.
+func SetImportOptions(opts ImportOptions) {
+	remoteImports.reset(opts)
+}
+
+func isRemoteScheme(scheme string) bool {
+	return scheme == "http" || scheme == "https" || scheme == fileServerScheme
+}
+
+// remoteImporter fetches and verifies remote imports, it's shared by vms (eg. of parallel assertions).
+type remoteImporter struct {
+	mu   sync.Mutex
+	opts ImportOptions
+	http *http.Client
+	lock *ImportLock
+	// locked reports whether the lock file existed when it's loaded, imports are pinned on first use otherwise.
+	locked bool
+	loaded map[string]Contents
+}
+
+func newRemoteImporter(opts ImportOptions) *remoteImporter {
+	t := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	return &remoteImporter{opts: opts, http: &http.Client{Transport: t}, loaded: map[string]Contents{}}
+}
+
+func (ri *remoteImporter) reset(opts ImportOptions) {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	ri.opts, ri.lock, ri.locked, ri.loaded = opts, nil, false, map[string]Contents{}
+}
+
+// Import resolves a remote import by the cache if its content matches the lock (or there is no lock in offline
+// mode), otherwise the content is fetched, verified and cached.
+func (ri *remoteImporter) Import(url string) (Contents, error) {
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	if c, ok := ri.loaded[url]; ok {
+		return c, nil
+	}
+	if err := ri.loadLock(); err != nil {
+		return Contents{}, err
+	}
+	want, pinned := ri.lock.Imports[url]
+	if ri.locked && !pinned && (!ri.opts.UpdateLock || ri.opts.Offline) {
+		return Contents{}, errors.Errorf("not pinned by %s, update the lock to pin it", ri.opts.LockFile)
+	}
+	data, cached, err := ri.readCache(url)
+	if err != nil {
+		return Contents{}, err
+	}
+	// unpinned contents are fetched again unless it's offline, since they may be stale
+	hit := cached && (pinned && sha256Of(data) == want || !pinned && ri.opts.Offline)
+	if !hit {
+		if ri.opts.Offline && cached {
+			return Contents{}, errors.New("cached content doesn't match the lock in offline mode")
+		} else if ri.opts.Offline {
+			return Contents{}, errors.New("not cached in offline mode")
+		}
+		if data, err = ri.fetch(url); err != nil {
+			return Contents{}, err
+		}
+		if got := sha256Of(data); pinned && got != want {
+			return Contents{}, errors.Errorf("sha256 mismatch: expect %s, got %s", want, got)
+		}
+		if err = ri.writeCache(url, data); err != nil {
+			return Contents{}, err
+		}
+	}
+	if !pinned {
+		if err = ri.pin(url, sha256Of(data)); err != nil {
+			return Contents{}, err
+		}
+	}
+	c := MakeContents(string(data))
+	ri.loaded[url] = c
+	return c, nil
+}
+
+func (ri *remoteImporter) fetch(url string) ([]byte, error) {
+	if strings.HasPrefix(url, fileServerScheme+"://") {
+		cli := ri.opts.FileServer
+		if cli == nil {
+			cli = fs.Default()
+		}
+		data, err := cli.ReadAll(strings.TrimPrefix(url, fileServerScheme+"://"))
+		return data, errors.Wrap(err, "import via fileserver")
+	}
+	resp, err := ri.http.Get(url)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("unexpected http status: " + resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	return data, errors.Wrap(err, "error reading content")
+}
+
+func (ri *remoteImporter) loadLock() error {
+	if ri.lock != nil {
+		return nil
+	}
+	lock := &ImportLock{Imports: map[string]string{}}
+	if len(ri.opts.LockFile) > 0 {
+		raw, err := ioutil.ReadFile(ri.opts.LockFile)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+		if err == nil {
+			ri.locked = true
+			if err = json.Unmarshal(raw, lock); err != nil {
+				return errors.Wrap(err, "decode "+ri.opts.LockFile)
+			}
+			if lock.Imports == nil {
+				lock.Imports = map[string]string{}
+			}
+		}
+	}
+	ri.lock = lock
+	return nil
+}
+
+// pin adds the hash of a new import to the lock, the lock file (if any) is rewritten at once.
+func (ri *remoteImporter) pin(url string, hash string) error {
+	ri.lock.Imports[url] = hash
+	if len(ri.opts.LockFile) == 0 {
+		return nil
+	}
+	raw, err := json.MarshalIndent(ri.lock, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(writeFileAtomic(ri.opts.LockFile, append(raw, '\n')))
+}
+
+func (ri *remoteImporter) cachePath(url string) string {
+	return filepath.Join(ri.opts.CacheDir, sha256Of([]byte(url)))
+}
+
+func (ri *remoteImporter) readCache(url string) ([]byte, bool, error) {
+	if len(ri.opts.CacheDir) == 0 {
+		return nil, false, nil
+	}
+	data, err := ioutil.ReadFile(ri.cachePath(url))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	return data, err == nil, errors.WithStack(err)
+}
+
+func (ri *remoteImporter) writeCache(url string, data []byte) error {
+	if len(ri.opts.CacheDir) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(ri.opts.CacheDir, 0755); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(writeFileAtomic(ri.cachePath(url), data))
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err = os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func sha256Of(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,148 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-jsonnet"
+	"github.com/stretchr/testify/require"
+	"github.com/zyguan/tidb-test-util/pkg/fs"
+)
+
+type fakeServer struct {
+	sync.Mutex
+	files map[string]string
+	hits  int
+}
+
+func (s *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	s.hits++
+	if c, ok := s.files[r.URL.Path]; ok {
+		w.Write([]byte(c))
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func (s *fakeServer) set(path string, content string) {
+	s.Lock()
+	defer s.Unlock()
+	s.files[path] = content
+}
+
+func importValue(url string) (string, error) {
+	js, err := initVM(jsonnet.MakeVM()).EvaluateAnonymousSnippet(":test:", `(import "`+url+`").x`)
+	return strings.TrimSpace(js), err
+}
+
+func TestRemoteImports(t *testing.T) {
+	srv := &fakeServer{files: map[string]string{"/lib.libsonnet": `{x: 1}`, "/new.libsonnet": `{x: 3}`}}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "stmtflow-imports")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer SetImportOptions(ImportOptions{})
+
+	url, newURL := ts.URL+"/lib.libsonnet", ts.URL+"/new.libsonnet"
+	opts := ImportOptions{CacheDir: filepath.Join(dir, "cache"), LockFile: filepath.Join(dir, "stmtflow.lock")}
+	// imports are pinned on first use if there is no lock file
+	SetImportOptions(opts)
+	x, err := importValue(url)
+	require.NoError(t, err)
+	require.Equal(t, "1", x)
+	var lock ImportLock
+	raw, err := ioutil.ReadFile(opts.LockFile)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(raw, &lock))
+	require.Equal(t, map[string]string{url: sha256Of([]byte(`{x: 1}`))}, lock.Imports)
+
+	// new imports are pinned by an existing lock only if it's asked
+	for _, o := range []ImportOptions{opts, {CacheDir: opts.CacheDir, LockFile: opts.LockFile, UpdateLock: true, Offline: true}} {
+		SetImportOptions(o)
+		_, err = importValue(newURL)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "not pinned")
+	}
+	update := opts
+	update.UpdateLock = true
+	SetImportOptions(update)
+	x, err = importValue(newURL)
+	require.NoError(t, err)
+	require.Equal(t, "3", x)
+	raw, err = ioutil.ReadFile(opts.LockFile)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(raw, &lock))
+	require.Equal(t, sha256Of([]byte(`{x: 1}`)), lock.Imports[url])
+	require.Equal(t, sha256Of([]byte(`{x: 3}`)), lock.Imports[newURL])
+
+	// the content changes under us
+	srv.set("/lib.libsonnet", `{x: 2}`)
+	SetImportOptions(opts)
+	x, err = importValue(url)
+	require.NoError(t, err, "pinned content should be served by the cache")
+	require.Equal(t, "1", x)
+	require.NoError(t, os.RemoveAll(opts.CacheDir))
+	SetImportOptions(opts)
+	_, err = importValue(url)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "sha256 mismatch")
+
+	// offline mode never fetches
+	srv.set("/lib.libsonnet", `{x: 1}`)
+	offline := opts
+	offline.Offline = true
+	SetImportOptions(offline)
+	_, err = importValue(url)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not cached in offline mode")
+	// imports are neither verified nor pinned without a lock
+	SetImportOptions(ImportOptions{})
+	x, err = importValue(url)
+	require.NoError(t, err)
+	require.Equal(t, "1", x)
+	SetImportOptions(opts)
+	_, err = importValue(url)
+	require.NoError(t, err)
+	srv.Lock()
+	hits := srv.hits
+	srv.Unlock()
+	SetImportOptions(offline)
+	x, err = importValue(url)
+	require.NoError(t, err)
+	require.Equal(t, "1", x)
+	srv.Lock()
+	require.Equal(t, hits, srv.hits)
+	srv.Unlock()
+}
+
+func TestFileServerImports(t *testing.T) {
+	srv := &fakeServer{files: map[string]string{"/download/qa/lib.libsonnet": `{x: "fs"}`}}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	defer SetImportOptions(ImportOptions{})
+
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(ts.URL, "http://"))
+	require.NoError(t, err)
+	cli := fs.Default()
+	cli.Host = host
+	cli.Port, err = strconv.Atoi(port)
+	require.NoError(t, err)
+	SetImportOptions(ImportOptions{FileServer: cli})
+	x, err := importValue("fileserver://qa/lib.libsonnet")
+	require.NoError(t, err)
+	require.Equal(t, `"fs"`, x)
+	_, err = importValue("fileserver://qa/404.libsonnet")
+	require.Error(t, err)
+}
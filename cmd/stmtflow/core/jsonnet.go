@@ -5,14 +5,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"net"
-	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/google/go-jsonnet/ast"
 	"github.com/pkg/errors"
+	"github.com/zyguan/tidb-test-util/pkg/stmtflow/checker"
 
 	. "github.com/google/go-jsonnet"
 	. "github.com/zyguan/tidb-test-util/pkg/stmtflow"
@@ -27,8 +29,19 @@ const srcLoad = `# load & filter tests
 local tests = import "__PATH__";
 local filter(test) = __FILTER__; # default to true
 local patch(name) = {name: name, assertMethod: std.type(super.expect)};
+# hidden fields setup, teardown and isolated of the file apply to all tests, visible ones would be taken as tests
+local visible = [f for f in ["setup", "teardown", "isolated"] if std.objectHas(tests, f)];
+assert visible == [] : "fields of the file must be hidden to apply to all tests, use %s:: instead" % [visible[0]];
+local listOf(x) = if std.isArray(x) then x else [x];
+local fileOf(field, default) = if std.objectHasAll(tests, field) then tests[field] else default;
+local testOf(test, field, default) = if std.objectHas(test, field) then test[field] else default;
+local fixtures(test) = {
+	setup: listOf(fileOf("setup", [])) + listOf(testOf(test, "setup", [])),
+	teardown: listOf(testOf(test, "teardown", [])) + listOf(fileOf("teardown", [])),
+	isolated: testOf(test, "isolated", fileOf("isolated", false)),
+};
 [
-	tests[name] + patch(name)
+	tests[name] + patch(name) + fixtures(tests[name])
 	for name in std.objectFields(tests)
 	if filter(tests[name] + patch(name))
 ]`
@@ -39,6 +52,31 @@ const srcLib = `# builtin lib
 	dumpText(history, verbose=true, withLat=false):: std.native("historyToText")(history, verbose, withLat),
 	textContains(str, sub):: std.length(std.findSubstr(sub, str)) > 0,
 	historyContains(history, sub):: self.textContains(self.dumpText(history), sub),
+	anomaliesOf(history):: std.native("checkIsolation")(history),
+	checkIsolation(history, allow=[]):: std.join("\n", [
+		a.type + ": " + a.message for a in self.anomaliesOf(history) if !std.member(allow, a.type)
+	]),
+	# return events of a session, or of all sessions if session is null
+	returnsOf(history, session=null):: [
+		e for e in history if e.kind == "Return" && (session == null || e.session == session)
+	],
+	# errors of failed statements, each is like {code, message, session, sql}
+	errorsOf(history, session=null):: [
+		e["error"] + {session: e.session, sql: e.stmt.q}
+		for e in self.returnsOf(history, session) if std.objectHas(e, "error")
+	],
+	# decoded rows of a return event, values are strings or null, it's null if the statement failed
+	rowsOf(event):: std.native("rowsOf")(event),
+	# whether the index-th (from 0) statement of a session got blocked
+	isBlocked(history, session, stmtIndex):: std.native("isBlocked")(history, session, stmtIndex),
+	# indexes of return (or control) events sorted by the time they returned
+	orderOf(events):: std.native("orderOf")(events),
+	# latency of a return (or control) event in milliseconds
+	latencyOf(event):: std.native("latencyOf")(event),
+	# compare rows as sets or multisets, return events are accepted in place of rows
+	local rows(x) = if std.isObject(x) then self.rowsOf(x) else x,
+	sameRowSet(xs, ys):: std.native("compareRows")(rows(xs), rows(ys), false),
+	sameRowMultiset(xs, ys):: std.native("compareRows")(rows(xs), rows(ys), true),
 }`
 
 func Load(path string, filter string) ([]Test, error) {
@@ -59,23 +97,12 @@ func Load(path string, filter string) ([]Test, error) {
 		return nil, errors.WithStack(err)
 	}
 	for i, t := range tests {
-		switch t.AssertMethod {
-		case "string":
-			var a matchText
-			if err = json.Unmarshal(t.Expect, &a.expect); err != nil {
-				return nil, errors.Wrap(err, "unmarshal "+t.AssertMethod+" `expect` of "+t.Name)
-			}
-			t.Assertions = append(t.Assertions, &a)
-		case "array":
-			var a matchHistory
-			if err = json.Unmarshal(t.Expect, &a.expect); err != nil {
-				return nil, errors.Wrap(err, "unmarshal "+t.AssertMethod+" `expect` of "+t.Name)
-			}
-			t.Assertions = append(t.Assertions, &a)
-		case "function":
-			t.Assertions = append(t.Assertions, &customAssertFn{path, t.Name})
-		default:
-			return nil, errors.New("unexpected assert method: " + t.AssertMethod)
+		if len(t.Path) > 0 && !filepath.IsAbs(t.Path) {
+			t.Path = filepath.Join(filepath.Dir(path), t.Path)
+		}
+		resolvePositions(&t)
+		if err = setupAssertions(&t, path); err != nil {
+			return nil, err
 		}
 		tests[i] = t
 	}
@@ -83,6 +110,156 @@ func Load(path string, filter string) ([]Test, error) {
 	return tests, nil
 }
 
+// resolvePositions locates statements of a test in its test file, since positions are lost when statements are
+// passed through jsonnet (eg. by parseSQL). Statements are matched in order, unmatched ones are left as they are.
+func resolvePositions(t *Test) {
+	if len(t.Path) == 0 {
+		return
+	}
+	f, err := os.Open(t.Path)
+	if err != nil {
+		return
+	}
+	stmts, _ := ParseStrictSQL(t.Path, f)
+	f.Close()
+	k := 0
+	for i := range t.Test {
+		for j := k; j < len(stmts); j++ {
+			if stmts[j].Equal(t.Test[i]) {
+				t.Test[i].Pos, k = stmts[j].Pos, j+1
+				break
+			}
+		}
+	}
+}
+
+const srcFilter = `# filter tests
+local tests = std.extVar("tests");
+local filter(test) = __FILTER__; # default to true
+[i for i in std.range(0, std.length(tests) - 1) if filter(tests[i])]`
+
+// LoadSQL loads a test from a test file and its expected result file (.r.json or .r.sql).
+func LoadSQL(name string, testPath string, resPath string) (Test, error) {
+	t := Test{Name: name, Path: testPath}
+	f, err := os.Open(testPath)
+	if err != nil {
+		return t, errors.WithStack(err)
+	}
+	t.Test, err = ParseStrictSQL(testPath, f)
+	f.Close()
+	if err != nil {
+		return t, err
+	}
+	raw, err := ioutil.ReadFile(resPath)
+	if err != nil {
+		return t, errors.WithStack(err)
+	}
+	if strings.HasSuffix(resPath, ".json") {
+		t.AssertMethod, t.Expect = "array", raw
+	} else {
+		t.AssertMethod = "string"
+		if t.Expect, err = json.Marshal(string(raw)); err != nil {
+			return t, errors.WithStack(err)
+		}
+	}
+	return t, setupAssertions(&t, testPath)
+}
+
+// FilterTests filters tests by a jsonnet expr like what Load does, name, path and labels of tests are available.
+func FilterTests(tests []Test, filter string) ([]Test, error) {
+	if len(filter) == 0 || len(tests) == 0 {
+		return tests, nil
+	}
+	type testInfo struct {
+		Name         string            `json:"name"`
+		Path         string            `json:"path"`
+		Labels       map[string]string `json:"labels"`
+		AssertMethod string            `json:"assertMethod"`
+	}
+	infos := make([]testInfo, len(tests))
+	for i, t := range tests {
+		infos[i] = testInfo{t.Name, t.Path, t.Labels, t.AssertMethod}
+		if infos[i].Labels == nil {
+			// tests loaded from sql files have no labels, filters can still access them as an object
+			infos[i].Labels = map[string]string{}
+		}
+	}
+	raw, err := json.Marshal(infos)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	vm := initVM(MakeVM())
+	vm.ExtCode("tests", string(raw))
+	js, err := vm.EvaluateAnonymousSnippet(":filter:", strings.Replace(srcFilter, "__FILTER__", filter, 1))
+	if err != nil {
+		return nil, errors.Wrap(err, "filter tests")
+	}
+	var idxs []int
+	if err = json.Unmarshal([]byte(js), &idxs); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	filtered := make([]Test, len(idxs))
+	for i, k := range idxs {
+		filtered[i] = tests[k]
+	}
+	return filtered, nil
+}
+
+func setupAssertions(t *Test, path string) error {
+	if len(t.Capture) > 0 {
+		flags, err := captureFlags(t.Capture)
+		if err != nil {
+			return errors.Wrap(err, "validate `capture` of "+t.Name)
+		}
+		for i := range t.Test {
+			t.Test[i].Flags |= flags
+		}
+	}
+	for name, spec := range t.Sessions {
+		if _, err := spec.Options(); err != nil {
+			return errors.Wrap(err, "validate `sessions."+name+"` of "+t.Name)
+		}
+	}
+	if err := t.Compare.Validate(); err != nil {
+		return errors.Wrap(err, "validate `compare` of "+t.Name)
+	}
+	normalize := !t.Compare.IsZero()
+	for _, stmt := range t.Test {
+		if stmt.Compare != nil {
+			if err := stmt.Compare.Validate(); err != nil {
+				return errors.Wrap(err, "validate annotations of "+t.Name)
+			}
+		}
+		normalize = normalize || stmt.Compare != nil || stmt.Flags&S_UNORDERED > 0
+	}
+	for _, stmt := range t.Test {
+		if len(stmt.ExpectErrors) > 0 {
+			t.Assertions = append(t.Assertions, &matchErrors{})
+			break
+		}
+	}
+	switch t.AssertMethod {
+	case "string":
+		a := matchText{opts: t.Compare, normalize: normalize}
+		if err := json.Unmarshal(t.Expect, &a.expect); err != nil {
+			return errors.Wrap(err, "unmarshal "+t.AssertMethod+" `expect` of "+t.Name)
+		}
+		t.Assertions = append(t.Assertions, &a)
+	case "array", "object":
+		// an object is a history with metadata, see HistoryFile
+		var f HistoryFile
+		if err := json.Unmarshal(t.Expect, &f); err != nil {
+			return errors.Wrap(err, "unmarshal "+t.AssertMethod+" `expect` of "+t.Name)
+		}
+		t.Assertions = append(t.Assertions, &matchHistory{expect: f.History, opts: t.Compare})
+	case "function":
+		t.Assertions = append(t.Assertions, &customAssertFn{path, t.Name})
+	default:
+		return errors.New("unexpected assert method: " + t.AssertMethod)
+	}
+	return nil
+}
+
 var nativeFuncs = map[string]*NativeFunction{
 	"parseSQL": {
 		Name:   "parseSQL",
@@ -94,6 +271,36 @@ var nativeFuncs = map[string]*NativeFunction{
 		Params: ast.Identifiers{"history", "verbose", "withLat"},
 		Func:   nativeHistoryToText,
 	},
+	"checkIsolation": {
+		Name:   "checkIsolation",
+		Params: ast.Identifiers{"history"},
+		Func:   nativeCheckIsolation,
+	},
+	"rowsOf": {
+		Name:   "rowsOf",
+		Params: ast.Identifiers{"event"},
+		Func:   nativeRowsOf,
+	},
+	"isBlocked": {
+		Name:   "isBlocked",
+		Params: ast.Identifiers{"history", "session", "stmtIndex"},
+		Func:   nativeIsBlocked,
+	},
+	"orderOf": {
+		Name:   "orderOf",
+		Params: ast.Identifiers{"events"},
+		Func:   nativeOrderOf,
+	},
+	"latencyOf": {
+		Name:   "latencyOf",
+		Params: ast.Identifiers{"event"},
+		Func:   nativeLatencyOf,
+	},
+	"compareRows": {
+		Name:   "compareRows",
+		Params: ast.Identifiers{"xs", "ys", "multiset"},
+		Func:   nativeCompareRows,
+	},
 }
 
 func initVM(vm *VM) *VM {
@@ -107,7 +314,10 @@ func initVM(vm *VM) *VM {
 func nativeParseSQL(args []interface{}) (ret interface{}, err error) {
 	defer catchPanic(&err)
 	buf := bytes.NewBuffer([]byte(args[0].(string)))
-	stmts := ParseSQL(buf)
+	stmts, err := ParseStrictSQL("parseSQL", buf)
+	if err != nil {
+		return nil, err
+	}
 	buf.Reset()
 	if err = json.NewEncoder(buf).Encode(stmts); err != nil {
 		return nil, errors.WithStack(err)
@@ -137,6 +347,186 @@ func nativeHistoryToText(args []interface{}) (ret interface{}, err error) {
 	return
 }
 
+func nativeCheckIsolation(args []interface{}) (ret interface{}, err error) {
+	defer catchPanic(&err)
+	var h History
+	buf := new(bytes.Buffer)
+	if err = json.NewEncoder(buf).Encode(args[0]); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err = json.NewDecoder(buf).Decode(&h); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	res := checker.Check(h)
+	buf.Reset()
+	if err = json.NewEncoder(buf).Encode(append([]checker.Anomaly{}, res.Anomalies...)); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err = json.NewDecoder(buf).Decode(&ret); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return
+}
+
+func nativeRowsOf(args []interface{}) (ret interface{}, err error) {
+	defer catchPanic(&err)
+	var e Event
+	if err = convertValue(args[0], &e); err != nil {
+		return nil, err
+	}
+	if e.Kind != EventReturn {
+		return nil, errors.New("rowsOf: expect a return event, got " + e.Kind)
+	}
+	r := e.Return()
+	if r.Err != nil {
+		return nil, nil
+	}
+	rows := []interface{}{}
+	if r.Res.IsExecResult() {
+		return rows, nil
+	}
+	for i := 0; i < r.Res.NRows(); i++ {
+		row := make([]interface{}, r.Res.NCols())
+		for j := range row {
+			if x, ok := r.Res.RawValue(i, j); ok && x != nil {
+				row[j] = string(x)
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func nativeIsBlocked(args []interface{}) (ret interface{}, err error) {
+	defer catchPanic(&err)
+	var h History
+	if err = convertValue(args[0], &h); err != nil {
+		return nil, err
+	}
+	s, k := args[1].(string), int(args[2].(float64))
+	invoked := -1
+	for _, e := range h {
+		if e.Session != s {
+			continue
+		}
+		switch e.Kind {
+		case EventInvoke:
+			invoked++
+		case EventBlock:
+			if invoked == k {
+				return true, nil
+			}
+		}
+		if invoked > k {
+			break
+		}
+	}
+	if invoked < k {
+		return nil, fmt.Errorf("isBlocked: session %s has only %d statement(s)", s, invoked+1)
+	}
+	return false, nil
+}
+
+func nativeOrderOf(args []interface{}) (ret interface{}, err error) {
+	defer catchPanic(&err)
+	var events []Event
+	if err = convertValue(args[0], &events); err != nil {
+		return nil, err
+	}
+	ts := make([]time.Time, len(events))
+	for i := range events {
+		if ts[i], err = returnedAt(events[i]); err != nil {
+			return nil, errors.Wrap(err, "orderOf")
+		}
+	}
+	idxs := make([]int, len(events))
+	for i := range idxs {
+		idxs[i] = i
+	}
+	sort.SliceStable(idxs, func(i, j int) bool { return ts[idxs[i]].Before(ts[idxs[j]]) })
+	order := make([]interface{}, len(idxs))
+	for i, k := range idxs {
+		order[i] = float64(k)
+	}
+	return order, nil
+}
+
+func nativeLatencyOf(args []interface{}) (ret interface{}, err error) {
+	defer catchPanic(&err)
+	var e Event
+	if err = convertValue(args[0], &e); err != nil {
+		return nil, err
+	}
+	var t [2]time.Time
+	switch e.Kind {
+	case EventReturn:
+		t = e.Return().T
+	case EventControl:
+		t = e.Control().T
+	default:
+		return nil, errors.New("latencyOf: expect a return or control event, got " + e.Kind)
+	}
+	return float64(t[1].Sub(t[0])) / float64(time.Millisecond), nil
+}
+
+// returnedAt returns the time a return or control event returned.
+func returnedAt(e Event) (time.Time, error) {
+	switch e.Kind {
+	case EventReturn:
+		return e.Return().T[1], nil
+	case EventControl:
+		return e.Control().T[1], nil
+	default:
+		return time.Time{}, errors.New("expect a return or control event, got " + e.Kind)
+	}
+}
+
+func nativeCompareRows(args []interface{}) (ret interface{}, err error) {
+	defer catchPanic(&err)
+	count := func(x interface{}) (map[string]int, error) {
+		rows, ok := x.([]interface{})
+		if !ok && x != nil {
+			return nil, errors.New("compareRows: expect an array of rows")
+		}
+		cnt := make(map[string]int, len(rows))
+		for _, row := range rows {
+			key, err := json.Marshal(row)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			cnt[string(key)]++
+		}
+		return cnt, nil
+	}
+	xs, err := count(args[0])
+	if err != nil {
+		return nil, err
+	}
+	ys, err := count(args[1])
+	if err != nil {
+		return nil, err
+	}
+	multiset := args[2].(bool)
+	if len(xs) != len(ys) {
+		return false, nil
+	}
+	for k, n := range xs {
+		if m, ok := ys[k]; !ok || multiset && m != n {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// convertValue converts a jsonnet value to v via json.
+func convertValue(x interface{}, v interface{}) error {
+	raw, err := json.Marshal(x)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(json.Unmarshal(raw, v))
+}
+
 func catchPanic(err *error) {
 	if x := recover(); x != nil {
 		if e, ok := x.(error); ok {
@@ -148,29 +538,12 @@ func catchPanic(err *error) {
 }
 
 func newImporter() *enhancedImporter {
-	t := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-	}
-
-	return &enhancedImporter{
-		fi:    &FileImporter{},
-		http:  &http.Client{Transport: t},
-		cache: map[string]Contents{},
-	}
+	return &enhancedImporter{fi: &FileImporter{}, remote: remoteImports}
 }
 
 type enhancedImporter struct {
-	fi    *FileImporter
-	http  *http.Client
-	cache map[string]Contents
+	fi     *FileImporter
+	remote *remoteImporter
 }
 
 func (ei *enhancedImporter) Import(from string, path string) (Contents, string, error) {
@@ -178,16 +551,12 @@ func (ei *enhancedImporter) Import(from string, path string) (Contents, string,
 	if err != nil {
 		return Contents{}, "", errors.New("import path `" + path + "` is not valid")
 	}
-	if pathURL.Scheme == "http" || pathURL.Scheme == "https" {
+	if isRemoteScheme(pathURL.Scheme) {
 		foundAt := pathURL.String()
-		if c, ok := ei.cache[foundAt]; ok {
-			return c, foundAt, nil
-		}
-		c, err := ei.importViaHttp(foundAt)
+		c, err := ei.remote.Import(foundAt)
 		if err != nil {
-			return Contents{}, "", errors.Wrap(err, "import via http")
+			return Contents{}, "", errors.Wrap(err, "import "+foundAt)
 		}
-		ei.cache[foundAt] = c
 		return c, foundAt, nil
 	}
 	c, p, err := ei.fi.Import(from, path)
@@ -196,20 +565,3 @@ func (ei *enhancedImporter) Import(from string, path string) (Contents, string,
 	}
 	return c, p, err
 }
-
-func (ei *enhancedImporter) importViaHttp(url string) (Contents, error) {
-	resp, err := ei.http.Get(url)
-	if err != nil {
-		return Contents{}, errors.WithStack(err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return Contents{}, errors.New("unexpected http status: " + resp.Status)
-	}
-
-	bs, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return Contents{}, errors.Wrap(err, "error reading content")
-	}
-	return MakeContents(string(bs)), nil
-}
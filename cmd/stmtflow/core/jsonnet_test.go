@@ -0,0 +1,178 @@
+package core
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-jsonnet"
+	"github.com/stretchr/testify/require"
+	"github.com/zyguan/sqlz"
+	"github.com/zyguan/tidb-test-util/pkg/stmtflow/stmtflowtest"
+
+	. "github.com/zyguan/tidb-test-util/pkg/stmtflow"
+)
+
+// testHistory is like: s1 reads, s2 gets blocked by s1 and then fails after s1 commits, s2 reads at last.
+func testHistory() History {
+	t0 := time.Unix(1000, 0)
+	at := func(from, to int) [2]time.Time {
+		return [2]time.Time{t0.Add(time.Duration(from) * time.Millisecond), t0.Add(time.Duration(to) * time.Millisecond)}
+	}
+	stmt := func(s, sql string) Stmt { return Stmt{Sess: s, SQL: sql} }
+	ret := func(s Stmt, rs *sqlz.ResultSet, err error, t [2]time.Time) Event {
+		return NewReturnEvent(s.Sess, Return{Stmt: s, Res: rs, Err: err, T: t})
+	}
+	s1q, s1c := stmt("s1", "select a, b from t"), stmt("s1", "commit")
+	s2u, s2q := stmt("s2", "update t set b = 'x'"), stmt("s2", "select a from t")
+	return History{
+		NewInvokeEvent("s1", Invoke{Stmt: s1q}),
+		ret(s1q, stmtflowtest.NewRows([]string{"a", "b"}, []string{"1", "x"}, []string{"2", "y"}), nil, at(0, 10)),
+		NewInvokeEvent("s2", Invoke{Stmt: s2u}),
+		NewBlockEvent("s2"),
+		NewInvokeEvent("s1", Invoke{Stmt: s1c}),
+		ret(s1c, sqlz.NewFromResult(driver.RowsAffected(0)), nil, at(20, 25)),
+		NewResumeEvent("s2"),
+		ret(s2u, nil, &Error{Code: 1213, Message: "Deadlock found"}, at(15, 30)),
+		NewInvokeEvent("s2", Invoke{Stmt: s2q}),
+		ret(s2q, stmtflowtest.NewRows([]string{"a"}, []string{"2"}, []string{"1"}, []string{"1"}), nil, at(31, 35)),
+	}
+}
+
+func evalLib(t *testing.T, h History, expr string) (string, error) {
+	raw, err := json.Marshal(h)
+	require.NoError(t, err)
+	vm := initVM(jsonnet.MakeVM())
+	vm.ExtCode("history", string(raw))
+	return vm.EvaluateAnonymousSnippet(":test:", `local sf = import "stmtflow"; local h = std.extVar("history"); `+expr)
+}
+
+func TestLibHelpers(t *testing.T) {
+	h := testHistory()
+	for _, tt := range []struct {
+		expr   string
+		expect string
+	}{
+		{`std.length(sf.returnsOf(h))`, `4`},
+		{`[e.stmt.q for e in sf.returnsOf(h, "s1")]`, `["select a, b from t", "commit"]`},
+		{`sf.errorsOf(h)`, `[{"code": 1213, "message": "Deadlock found", "session": "s2", "sql": "update t set b = 'x'"}]`},
+		{`sf.errorsOf(h, "s1")`, `[]`},
+		{`sf.rowsOf(sf.returnsOf(h, "s1")[0])`, `[["1", "x"], ["2", "y"]]`},
+		{`sf.rowsOf(sf.returnsOf(h, "s1")[1])`, `[]`},
+		{`sf.rowsOf(sf.returnsOf(h, "s2")[0])`, `null`},
+		{`[sf.isBlocked(h, "s1", 0), sf.isBlocked(h, "s2", 0), sf.isBlocked(h, "s2", 1)]`, `[false, true, false]`},
+		{`sf.orderOf(sf.returnsOf(h))`, `[0, 1, 2, 3]`},
+		{`sf.orderOf([sf.returnsOf(h, "s2")[0], sf.returnsOf(h, "s1")[1]])`, `[1, 0]`},
+		{`[sf.latencyOf(e) for e in sf.returnsOf(h)]`, `[10, 5, 15, 4]`},
+		{`local r = sf.returnsOf(h, "s2")[1]; [sf.sameRowSet(r, [["1"], ["2"]]), sf.sameRowMultiset(r, [["1"], ["2"]])]`, `[true, false]`},
+		{`local r = sf.returnsOf(h, "s2")[1]; [sf.sameRowSet(r, [["1"]]), sf.sameRowMultiset(r, [["1"], ["1"], ["2"]])]`, `[false, true]`},
+		{`sf.sameRowSet([], [])`, `true`},
+	} {
+		js, err := evalLib(t, h, tt.expr)
+		require.NoError(t, err, tt.expr)
+		require.JSONEq(t, tt.expect, js, tt.expr)
+	}
+}
+
+func TestLibHelperErrors(t *testing.T) {
+	h := testHistory()
+	for _, expr := range []string{
+		`sf.rowsOf(h[0])`,
+		`sf.latencyOf(h[3])`,
+		`sf.orderOf(h)`,
+		`sf.isBlocked(h, "s1", 2)`,
+		`sf.sameRowSet(1, [])`,
+	} {
+		_, err := evalLib(t, h, expr)
+		require.Error(t, err, expr)
+	}
+}
+
+func TestLibParseSQL(t *testing.T) {
+	out, err := evalLib(t, nil, `[s.q for s in sf.parseSQL("/* s1 */ select 1;\n/* s2 */ select 2;")]`)
+	require.NoError(t, err)
+	require.JSONEq(t, `["/* s1 */ select 1;", "/* s2 */ select 2;"]`, out)
+
+	_, err = evalLib(t, nil, `sf.parseSQL("/* s1 */ select 1;\nselect 2;")`)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "parseSQL:2:1: missing session header")
+}
+
+func TestLoadSQL(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, content string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+		return path
+	}
+	testPath := write("t0.t.sql", "/* s1 */ select 1;\n/* s2 */ update t set v = 1;\n")
+	h := testHistory()
+	raw, err := json.Marshal(h)
+	require.NoError(t, err)
+	jsonPath, textPath := write("t0.r.json", string(raw)), write("t0.r.sql", "-- expected\n")
+
+	loaded, err := LoadSQL("t0", testPath, jsonPath)
+	require.NoError(t, err)
+	require.Equal(t, "t0", loaded.Name)
+	require.Equal(t, testPath, loaded.Path)
+	require.Equal(t, []string{"/* s1 */ select 1;", "/* s2 */ update t set v = 1;"}, sqlsOf(loaded.Test))
+	require.Equal(t, testPath, loaded.Test[1].Pos.File)
+	require.Equal(t, "array", loaded.AssertMethod)
+	expected, ok := loaded.ExpectedHistory()
+	require.True(t, ok)
+	require.Len(t, expected, len(h))
+	require.NoError(t, loaded.Assert(h))
+
+	loaded, err = LoadSQL("t0", testPath, textPath)
+	require.NoError(t, err)
+	require.Equal(t, "string", loaded.AssertMethod)
+	text, ok := loaded.ExpectedText()
+	require.True(t, ok)
+	require.Equal(t, "-- expected\n", text)
+
+	_, err = LoadSQL("t0", testPath, filepath.Join(dir, "missing.r.json"))
+	require.Error(t, err)
+	_, err = LoadSQL("t1", write("t1.t.sql", "select 1;\n"), jsonPath)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "t1.t.sql:1:1: missing session header")
+}
+
+func TestFilterTests(t *testing.T) {
+	tests := []Test{
+		{Name: "a/t0", Path: "a/t0.t.sql", Labels: map[string]string{"kind": "txn"}, AssertMethod: "array"},
+		{Name: "a/t1", Path: "a/t1.t.sql", AssertMethod: "string"},
+		{Name: "b/t0", Path: "b/t0.t.sql", Labels: map[string]string{"kind": "ddl"}, AssertMethod: "array"},
+	}
+	names := func(tests []Test) []string {
+		ns := []string{}
+		for _, t := range tests {
+			ns = append(ns, t.Name)
+		}
+		return ns
+	}
+	for _, tt := range []struct {
+		filter string
+		names  []string
+	}{
+		{"", []string{"a/t0", "a/t1", "b/t0"}},
+		{"true", []string{"a/t0", "a/t1", "b/t0"}},
+		{`std.startsWith(test.name, "a/")`, []string{"a/t0", "a/t1"}},
+		{`std.endsWith(test.path, "t0.t.sql")`, []string{"a/t0", "b/t0"}},
+		{`std.objectHas(test.labels, "kind") && test.labels.kind == "ddl"`, []string{"b/t0"}},
+		{`test.assertMethod == "string"`, []string{"a/t1"}},
+		{"false", []string{}},
+	} {
+		filtered, err := FilterTests(tests, tt.filter)
+		require.NoError(t, err, tt.filter)
+		require.Equal(t, tt.names, names(filtered), tt.filter)
+	}
+
+	_, err := FilterTests(tests, "test.nosuchfield")
+	require.Error(t, err)
+	filtered, err := FilterTests(nil, "false")
+	require.NoError(t, err)
+	require.Empty(t, filtered)
+}
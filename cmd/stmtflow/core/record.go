@@ -0,0 +1,88 @@
+package core
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+
+	. "github.com/zyguan/tidb-test-util/pkg/stmtflow"
+)
+
+// Recording keeps histories of played tests together with the environment they were played in, so that assertions
+// of tests can be developed and checked against them without a database.
+type Recording struct {
+	// Version is the output of `select version()` of the server.
+	Version string `json:"version"`
+	// Host is the address of the server, credentials in the dsn are not recorded.
+	Host       string            `json:"host"`
+	Options    map[string]string `json:"options,omitempty"`
+	RecordedAt time.Time         `json:"recordedAt"`
+	Runs       []RecordedRun     `json:"runs"`
+}
+
+// RecordedRun is the history of a played test, statements are recorded for looking up tests with other names.
+// Sessions describe connections of the run, a history of an interrupted run ends with a timeout event.
+type RecordedRun struct {
+	Name     string   `json:"name"`
+	Path     string   `json:"path,omitempty"`
+	Test     []Stmt   `json:"test"`
+	Sessions Sessions `json:"sessions,omitempty"`
+	History  History  `json:"history"`
+}
+
+func LoadRecording(path string) (*Recording, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+	var r Recording
+	if err = json.NewDecoder(f).Decode(&r); err != nil {
+		return nil, errors.Wrap(err, "decode recording "+path)
+	}
+	return &r, nil
+}
+
+func (r *Recording) Dump(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(r); err != nil {
+		f.Close()
+		return errors.Wrap(err, "encode recording "+path)
+	}
+	return errors.WithStack(f.Close())
+}
+
+// Lookup finds the recorded run of a test by its name, or by its statements if no run has the name.
+func (r *Recording) Lookup(t Test) (*RecordedRun, bool) {
+	for i := range r.Runs {
+		if r.Runs[i].Name == t.Name {
+			return &r.Runs[i], true
+		}
+	}
+	for i := range r.Runs {
+		if sameStmts(r.Runs[i].Test, t.Test) {
+			return &r.Runs[i], true
+		}
+	}
+	return nil, false
+}
+
+// sameStmts compares statements by sessions and sql texts, flags may differ since tests can add some (eg. capture).
+func sameStmts(ss1 []Stmt, ss2 []Stmt) bool {
+	if len(ss1) != len(ss2) || len(ss1) == 0 {
+		return false
+	}
+	for i := range ss1 {
+		if ss1[i].Sess != ss2[i].Sess || ss1[i].Endpoint != ss2[i].Endpoint || ss1[i].SQL != ss2[i].SQL {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,53 @@
+package core
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	. "github.com/zyguan/tidb-test-util/pkg/stmtflow"
+)
+
+func TestRecording(t *testing.T) {
+	stmts := func(sqls ...string) []Stmt {
+		ss := make([]Stmt, len(sqls))
+		for i, sql := range sqls {
+			ss[i] = Stmt{Sess: "s1", SQL: sql}
+		}
+		return ss
+	}
+	rec := &Recording{
+		Version:    "5.7.25-TiDB-v5.4.0",
+		Host:       "127.0.0.1:4000",
+		RecordedAt: time.Now().Truncate(time.Second),
+		Runs: []RecordedRun{
+			{Name: "a", Test: stmts("select 1"), Sessions: Sessions{"s1": {ConnID: 1, User: "root@%"}}, History: History{NewResumeEvent("s1")}},
+			{Name: "b", Test: stmts("select 2", "select 3"), History: History{NewBlockEvent("s1")}},
+		},
+	}
+	path := filepath.Join(t.TempDir(), "rec.json")
+	require.NoError(t, rec.Dump(path))
+	loaded, err := LoadRecording(path)
+	require.NoError(t, err)
+	require.Equal(t, rec.Version, loaded.Version)
+	require.True(t, rec.RecordedAt.Equal(loaded.RecordedAt))
+	require.Equal(t, rec.Runs[0].Sessions, loaded.Runs[0].Sessions)
+
+	// runs are looked up by names first, and then by statements
+	run, ok := loaded.Lookup(Test{Name: "b", Test: stmts("select 1")})
+	require.True(t, ok)
+	require.Equal(t, "b", run.Name)
+	run, ok = loaded.Lookup(Test{Name: "renamed", Test: []Stmt{{Sess: "s1", SQL: "select 1", Flags: S_WARNINGS}}})
+	require.True(t, ok)
+	require.Equal(t, "a", run.Name)
+	require.Equal(t, EventResume, run.History[0].Kind)
+	_, ok = loaded.Lookup(Test{Name: "c", Test: stmts("select 2")})
+	require.False(t, ok)
+	_, ok = loaded.Lookup(Test{Name: "d"})
+	require.False(t, ok)
+
+	_, err = LoadRecording(filepath.Join(t.TempDir(), "none.json"))
+	require.Error(t, err)
+}
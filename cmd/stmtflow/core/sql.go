@@ -1,61 +1,415 @@
 package core
 
 import (
+	"fmt"
 	"io"
 	"io/ioutil"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/antlr/antlr4/runtime/Go/antlr"
+	"github.com/pkg/errors"
 	"github.com/zyguan/tidb-test-util/cmd/stmtflow/stmt"
 
 	. "github.com/zyguan/tidb-test-util/pkg/stmtflow"
 )
 
+// ParseError is a problem found at a position of a sql text.
+type ParseError struct {
+	Pos Pos
+	Msg string
+}
+
+func (e *ParseError) Error() string { return e.Pos.String() + ": " + e.Msg }
+
+// ParseErrors are problems found by a strict parse, in the order they appear.
+type ParseErrors []*ParseError
+
+func (es ParseErrors) Error() string {
+	msgs := make([]string, len(es))
+	for i, e := range es {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
 func ParseSQL(r io.Reader) []Stmt {
+	return ParseNamedSQL("", r)
+}
+
+// ParseNamedSQL is like ParseSQL, but positions of statements are recorded with the given file name.
+func ParseNamedSQL(name string, r io.Reader) []Stmt {
+	stmts, _ := ParseStrictSQL(name, r)
+	return stmts
+}
+
+// ParseStrictSQL is like ParseNamedSQL, but problems like missing session headers and unknown annotations are
+// returned as ParseErrors instead of being ignored. Statements are returned even if there are problems.
+func ParseStrictSQL(name string, r io.Reader) ([]Stmt, error) {
 	raw, err := ioutil.ReadAll(r)
 	if err != nil {
-		return nil
+		return nil, errors.Wrap(err, "read "+name)
+	}
+	p := newSplitter(name, string(raw), "")
+	stmts := p.split()
+	if len(p.errs) > 0 {
+		return stmts, p.errs
+	}
+	return stmts, nil
+}
+
+// ParseFixture strictly parses statements of a fixture, statements without a header are sent by the given session.
+func ParseFixture(sql string, sess string) ([]Stmt, error) {
+	return ParseSessionSQL(sql, sess)
+}
+
+// ParseSessionSQL is like ParseStrictSQL, but statements without a header are sent by the given session.
+func ParseSessionSQL(sql string, sess string) ([]Stmt, error) {
+	p := newSplitter("", sql, sess)
+	stmts := p.split()
+	if len(p.errs) > 0 {
+		return stmts, p.errs
+	}
+	return stmts, nil
+}
+
+// DumpSQL writes statements in the format of a test file. Stored routines are written after `DELIMITER //`, so that
+// semicolons in their bodies are kept as they are by mysql clients.
+func DumpSQL(w io.Writer, stmts []Stmt) error {
+	delim := defaultDelimiter
+	for _, s := range stmts {
+		sql := s.SQL
+		if s.Flags&S_CTL > 0 {
+			sql = s.CtlText()
+		} else {
+			if !strings.HasPrefix(sql, "/*") {
+				sess := s.Sess
+				if len(s.Endpoint) > 0 {
+					sess += "@" + s.Endpoint
+				}
+				sql = fmt.Sprintf("/* %s */ %s", sess, sql)
+			}
+			d := defaultDelimiter
+			if isRoutineSQL(sql) {
+				d = routineDelimiter
+			}
+			if d != delim {
+				if _, err := fmt.Fprintln(w, "DELIMITER "+d); err != nil {
+					return err
+				}
+				delim = d
+			}
+			if d != defaultDelimiter {
+				sql = withDelimiter(sql, d)
+			} else if !terminated(sql) {
+				sql += ";"
+			}
+		}
+		if _, err := fmt.Fprintln(w, sql); err != nil {
+			return err
+		}
+	}
+	if delim != defaultDelimiter {
+		if _, err := fmt.Fprintln(w, "DELIMITER "+defaultDelimiter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isRoutineSQL reports whether sql creates a stored routine, see isRoutine.
+func isRoutineSQL(sql string) bool {
+	var words []string
+	p := newSplitter("", sql, "")
+	for len(words) < 8 && p.peek(0).GetTokenType() != antlr.TokenEOF {
+		w, n := p.word(0)
+		if n == 0 {
+			p.next()
+			continue
+		}
+		words = append(words, strings.ToUpper(w))
+		for ; n > 0; n-- {
+			p.next()
+		}
+	}
+	return isRoutine(words)
+}
+
+// withDelimiter terminates sql by delim instead of the trailing semicolon (if any).
+func withDelimiter(sql string, delim string) string {
+	var (
+		tokens []antlr.Token
+		last   = -1
+	)
+	lexer := stmt.NewStmt(antlr.NewInputStream(sql))
+	for token := lexer.NextToken(); token.GetTokenType() != antlr.TokenEOF; token = lexer.NextToken() {
+		if !hasTypeOf(token, stmt.StmtSPACE, stmt.StmtNEWLINE, stmt.StmtLINE_COMMENT) {
+			last = len(tokens)
+		}
+		tokens = append(tokens, token)
+	}
+	if last < 0 || tokens[last].GetTokenType() != stmt.StmtSEMI {
+		return strings.TrimRight(sql, " \t\r\n") + " " + delim
+	}
+	buf := new(strings.Builder)
+	for i, t := range tokens {
+		if i == last {
+			buf.WriteString(" " + delim)
+		} else {
+			buf.WriteString(t.GetText())
+		}
 	}
-	return split(string(raw))
+	return buf.String()
 }
 
-func split(text string) []Stmt {
+// terminated reports whether the last token of sql (ignoring whitespaces and line comments) is a semicolon.
+func terminated(sql string) bool {
+	last := -1
+	lexer := stmt.NewStmt(antlr.NewInputStream(sql))
+	for token := lexer.NextToken(); token.GetTokenType() != antlr.TokenEOF; token = lexer.NextToken() {
+		if !hasTypeOf(token, stmt.StmtSPACE, stmt.StmtNEWLINE, stmt.StmtLINE_COMMENT) {
+			last = token.GetTokenType()
+		}
+	}
+	return last == stmt.StmtSEMI
+}
+
+const (
+	defaultDelimiter = ";"
+	routineDelimiter = "//"
+)
+
+// splitter splits a sql text into statements. A statement ends with the delimiter, which is `;` by default and can
+// be changed by `DELIMITER xx` like mysql-test. Semicolons in BEGIN ... END blocks of stored routines are not
+// treated as delimiters either. Both are tracked here instead of by the Stmt lexer: the delimiter changes while
+// splitting and blocks nest, which lexer rules cannot express, see stmt/Stmt.g4.
+type splitter struct {
+	lexer *stmt.Stmt
+	ahead []antlr.Token
+	file  string
+	sess  string
+	delim string
+	errs  ParseErrors
+}
+
+func newSplitter(file string, text string, sess string) *splitter {
+	return &splitter{
+		lexer: stmt.NewStmt(antlr.NewInputStream(text)),
+		file:  file,
+		sess:  sess,
+		delim: defaultDelimiter,
+	}
+}
+
+func (p *splitter) peek(k int) antlr.Token {
+	for len(p.ahead) <= k {
+		p.ahead = append(p.ahead, p.lexer.NextToken())
+	}
+	return p.ahead[k]
+}
+
+func (p *splitter) next() antlr.Token {
+	t := p.peek(0)
+	p.ahead = p.ahead[1:]
+	return t
+}
+
+func (p *splitter) split() []Stmt {
 	var (
 		stmts  []Stmt
 		tokens []antlr.Token
+		words  []string
+		last   string
+		depth  int
 	)
-	lexer := stmt.NewStmt(antlr.NewInputStream(text))
-	token := lexer.NextToken()
+	emit := func() {
+		if s, ok := p.toStmt(tokens); ok {
+			stmts = append(stmts, s)
+		}
+		tokens, words, last, depth = tokens[:0], nil, "", 0
+	}
 	for {
-		if typ := token.GetTokenType(); typ == antlr.TokenEOF {
-			if s, ok := toStmt(tokens); ok {
+		token := p.peek(0)
+		typ := token.GetTokenType()
+		if typ == antlr.TokenEOF {
+			emit()
+			return stmts
+		}
+		p.checkTerminated()
+		if isBlank(tokens) {
+			if s, ok := p.toCtlStmt(token); ok {
+				// a control step ends with its header
 				stmts = append(stmts, s)
+				tokens = tokens[:0]
+				p.next()
+				continue
+			}
+			if w, n := p.word(0); strings.EqualFold(w, "delimiter") && p.peek(n).GetTokenType() == stmt.StmtSPACE {
+				p.delimiter(n)
+				tokens = tokens[:0]
+				continue
+			}
+		}
+		if n := p.matchDelimiter(); n > 0 && (p.delim != defaultDelimiter || depth == 0) {
+			if p.delim == defaultDelimiter {
+				// the delimiter is kept for compatibility
+				tokens = append(tokens, p.peek(0))
+			}
+			for len(tokens) > 0 && p.delim != defaultDelimiter && tokens[len(tokens)-1].GetTokenType() == stmt.StmtSPACE {
+				tokens = tokens[:len(tokens)-1]
+			}
+			for ; n > 0; n-- {
+				p.next()
 			}
-			return stmts
-		} else if typ == stmt.StmtSEMI {
-			// append ;
-			tokens = append(tokens, token)
-			token = lexer.NextToken()
 			// append tailing whitespaces & first line comment
-			for hasTypeOf(token, stmt.StmtSPACE, stmt.StmtNEWLINE, stmt.StmtLINE_COMMENT) {
-				tokens = append(tokens, token)
-				token = lexer.NextToken()
-				if token.GetTokenType() != stmt.StmtSPACE {
+			for hasTypeOf(p.peek(0), stmt.StmtSPACE, stmt.StmtNEWLINE, stmt.StmtLINE_COMMENT) {
+				t := p.next()
+				tokens = append(tokens, t)
+				if t.GetTokenType() != stmt.StmtSPACE {
 					break
 				}
 			}
-			if s, ok := toStmt(tokens); ok {
-				stmts = append(stmts, s)
+			emit()
+			continue
+		}
+		w, n := p.word(0)
+		if n == 0 {
+			if t := p.next(); !hasTypeOf(t, stmt.StmtSPACE, stmt.StmtNEWLINE) {
+				last = ""
 			}
-			tokens = tokens[:0]
-		} else {
 			tokens = append(tokens, token)
-			token = lexer.NextToken()
+			continue
+		}
+		for ; n > 0; n-- {
+			tokens = append(tokens, p.next())
+		}
+		if len(words) < 8 {
+			words = append(words, strings.ToUpper(w))
+		}
+		prev := last
+		if last = strings.ToUpper(w); !isRoutine(words) {
+			continue
+		}
+		switch last {
+		case "BEGIN", "CASE":
+			// the CASE of END CASE closes a block rather than opens one
+			if prev != "END" {
+				depth++
+			}
+		case "END":
+			k := 0
+			for hasTypeOf(p.peek(k), stmt.StmtSPACE, stmt.StmtNEWLINE) {
+				k++
+			}
+			// END IF, END LOOP, ... close blocks whose beginnings are not counted
+			if next, _ := p.word(k); depth > 0 && !hasWord(next, "IF", "LOOP", "WHILE", "REPEAT") {
+				depth--
+			}
+		}
+	}
+}
+
+// word returns the word starting at the k-th token ahead and the number of its tokens.
+func (p *splitter) word(k int) (string, int) {
+	buf := new(strings.Builder)
+	for n := 0; ; n++ {
+		t := p.peek(k + n)
+		if t.GetTokenType() != stmt.StmtANY || !isWordChar(t.GetText()) {
+			return buf.String(), n
+		}
+		buf.WriteString(t.GetText())
+	}
+}
+
+// delimiter changes the delimiter by a directive like `DELIMITER //`, n is the size of the keyword.
+func (p *splitter) delimiter(n int) {
+	for ; n > 0; n-- {
+		p.next()
+	}
+	buf := new(strings.Builder)
+	for !hasTypeOf(p.peek(0), stmt.StmtNEWLINE, antlr.TokenEOF) {
+		buf.WriteString(p.next().GetText())
+	}
+	if d := strings.TrimSpace(buf.String()); len(d) > 0 {
+		p.delim = d
+	}
+}
+
+// matchDelimiter returns the number of tokens of the delimiter ahead, or 0 if it's not matched.
+func (p *splitter) matchDelimiter() int {
+	acc := ""
+	for n := 0; ; n++ {
+		t := p.peek(n)
+		if !hasTypeOf(t, stmt.StmtANY, stmt.StmtSEMI) {
+			return 0
+		}
+		acc += t.GetText()
+		if acc == p.delim || t.GetTokenType() == stmt.StmtSEMI && strings.TrimRight(acc, " \t") == p.delim {
+			return n + 1
+		}
+		if !strings.HasPrefix(p.delim, acc) {
+			return 0
+		}
+	}
+}
+
+func (p *splitter) pos(t antlr.Token) *Pos {
+	return &Pos{File: p.file, Line: t.GetLine(), Col: t.GetColumn() + 1}
+}
+
+// errorf records a problem at pos, only the first problem of a position is kept.
+func (p *splitter) errorf(pos *Pos, format string, args ...interface{}) {
+	for _, e := range p.errs {
+		if e.Pos == *pos {
+			return
+		}
+	}
+	p.errs = append(p.errs, &ParseError{Pos: *pos, Msg: fmt.Sprintf(format, args...)})
+}
+
+// checkTerminated reports quotes and comment openings which are left as single characters by the lexer, that is,
+// the strings or comments they start are not terminated.
+func (p *splitter) checkTerminated() {
+	t := p.peek(0)
+	if t.GetTokenType() != stmt.StmtANY {
+		return
+	}
+	switch t.GetText() {
+	case "'", "\"", "`":
+		p.errorf(p.pos(t), "unterminated string")
+	case "/":
+		if next := p.peek(1); next.GetTokenType() == stmt.StmtANY && next.GetText() == "*" {
+			p.errorf(p.pos(t), "unterminated comment")
 		}
 	}
 }
 
-func toStmt(tokens []antlr.Token) (Stmt, bool) {
+// toCtlStmt makes a control step from a header like `/* ctl: failpoint enable ... */` which starts a statement.
+func (p *splitter) toCtlStmt(token antlr.Token) (Stmt, bool) {
+	if token.GetTokenType() != stmt.StmtBLOCK_COMMENT {
+		return Stmt{}, false
+	}
+	cmd := strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(token.GetText(), "/*"), "*/"))
+	k := strings.Index(cmd, ":")
+	if k < 0 {
+		return Stmt{}, false
+	}
+	s := Stmt{Sess: strings.TrimSpace(cmd[:k]), SQL: strings.TrimSpace(cmd[k+1:]), Flags: S_CTL, Pos: p.pos(token)}
+	if k := strings.Index(s.Sess, "@"); k >= 0 {
+		s.Sess, s.Endpoint = strings.TrimSpace(s.Sess[:k]), strings.TrimSpace(s.Sess[k+1:])
+	}
+	if s.Sess != CtlSession {
+		return Stmt{}, false
+	}
+	if len(s.SQL) == 0 {
+		p.errorf(s.Pos, "empty control command")
+	}
+	return s, true
+}
+
+// toStmt makes a statement from tokens, it's dropped (and reported) if there is no header and p.sess is empty.
+func (p *splitter) toStmt(tokens []antlr.Token) (Stmt, bool) {
 	if len(tokens) == 0 {
 		return Stmt{}, false
 	}
@@ -64,10 +418,20 @@ func toStmt(tokens []antlr.Token) (Stmt, bool) {
 	for i < len(tokens) && hasTypeOf(tokens[i], stmt.StmtSPACE, stmt.StmtNEWLINE, stmt.StmtLINE_COMMENT) {
 		i++
 	}
-	if i == len(tokens) || tokens[i].GetTokenType() != stmt.StmtBLOCK_COMMENT {
+	if i == len(tokens) {
 		return Stmt{}, false
 	}
-	cmd := strings.TrimSpace(strings.Trim(tokens[i].GetText(), "/*"))
+	cmd, headless := p.sess, tokens[i].GetTokenType() != stmt.StmtBLOCK_COMMENT
+	if !headless {
+		cmd = strings.TrimSpace(strings.Trim(tokens[i].GetText(), "/*"))
+	} else if tokens[i].GetTokenType() == stmt.StmtSEMI {
+		// a stray delimiter
+		return Stmt{}, false
+	} else if len(p.sess) == 0 {
+		p.errorf(p.pos(tokens[i]), "missing session header, statements should start with one like `/* s1 */`")
+		return Stmt{}, false
+	}
+	pos := p.pos(tokens[i])
 	buf := new(strings.Builder)
 	prefixSize, prefixMode := 0, true
 	for i < len(tokens) {
@@ -81,30 +445,236 @@ func toStmt(tokens []antlr.Token) (Stmt, bool) {
 		buf.WriteString(tokens[i].GetText())
 		i++
 	}
-	s := Stmt{SQL: strings.TrimRight(buf.String(), "\r\n")}
+	s := Stmt{SQL: strings.TrimRight(buf.String(), "\r\n"), Pos: pos}
+	if prefixSize > len(s.SQL) {
+		prefixSize = len(s.SQL)
+	}
 	if isQuery(s.SQL[prefixSize:]) {
 		s.Flags |= S_QUERY
 	}
+	if err := parseHeader(&s, cmd); err != nil {
+		p.errorf(pos, "%s", err.Error())
+	}
+	if len(strings.Trim(s.SQL[prefixSize:], "; \t\r\n")) == 0 {
+		p.errorf(pos, "empty statement of session %s", s.Sess)
+	}
+	return s, true
+}
+
+func isBlank(tokens []antlr.Token) bool {
+	for _, t := range tokens {
+		if !hasTypeOf(t, stmt.StmtSPACE, stmt.StmtNEWLINE, stmt.StmtLINE_COMMENT) {
+			return false
+		}
+	}
+	return true
+}
+
+func isWordChar(s string) bool {
+	if len(s) != 1 {
+		return false
+	}
+	c := s[0]
+	return c == '_' || c == '$' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// isRoutine reports whether leading words are of statements which create stored routines.
+func isRoutine(words []string) bool {
+	if len(words) < 2 || words[0] != "CREATE" {
+		return false
+	}
+	// the first kind of object decides, eg. `create table event ...` is not a routine
+	for _, w := range words[1:] {
+		if hasWord(w, "PROCEDURE", "FUNCTION", "TRIGGER", "EVENT") {
+			return true
+		}
+		if hasWord(w, "TABLE", "INDEX", "VIEW", "DATABASE", "SCHEMA", "USER", "ROLE", "SEQUENCE", "BINDING") {
+			return false
+		}
+	}
+	return false
+}
+
+func hasWord(w string, words ...string) bool {
+	for _, x := range words {
+		if strings.EqualFold(w, x) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHeader parses the header comment of a statement like `s1: wait, error=1213`. Annotations are parsed as many
+// as possible, the first problem (eg. an unknown keyword) is returned.
+func parseHeader(s *Stmt, cmd string) error {
+	var first error
+	report := func(err error) {
+		if err != nil && first == nil {
+			first = err
+		}
+	}
 	if k := strings.Index(cmd, ":"); k >= 0 {
 		s.Sess = cmd[:k]
-		for _, m := range strings.Split(cmd[k+1:], ",") {
+		for _, m := range splitAnnotations(cmd[k+1:]) {
 			m = strings.TrimSpace(m)
 			if len(m) == 0 {
 				continue
 			}
-			switch strings.ToLower(m) {
+			if strings.HasPrefix(strings.ToLower(m), "let ") {
+				x := Capture{Name: strings.TrimSpace(m[4:])}
+				if k := strings.Index(x.Name, "="); k >= 0 {
+					x.Name, x.Expr = strings.TrimSpace(x.Name[:k]), strings.TrimSpace(x.Name[k+1:])
+				}
+				if len(x.Name) == 0 {
+					report(errors.New("missing variable name: " + m))
+				}
+				s.Let = append(s.Let, x)
+				continue
+			}
+			key, val := strings.ToLower(m), ""
+			if k := strings.Index(m, "="); k >= 0 {
+				key, val = strings.ToLower(strings.TrimSpace(m[:k])), strings.TrimSpace(m[k+1:])
+			}
+			var err error
+			switch key {
 			case "wait":
 				s.Flags |= S_WAIT
 			case "query":
 				s.Flags |= S_QUERY
 			case "unordered":
 				s.Flags |= S_UNORDERED
+			case "error":
+				s.ExpectErrors, err = parseCodes(val)
+			case "timeout":
+				s.Timeout, err = time.ParseDuration(val)
+			case "sleep":
+				s.Sleep, err = time.ParseDuration(val)
+			case "ignore":
+				c := compareOptionsOf(s)
+				c.IgnoreColumns = append(c.IgnoreColumns, strings.Split(val, "|")...)
+			case "mask":
+				c := compareOptionsOf(s)
+				c.Masks = append(c.Masks, val)
+			case "precision":
+				compareOptionsOf(s).Precision, err = strconv.Atoi(val)
+			case "rowcount":
+				compareOptionsOf(s).RowCount = true
+			case "capture":
+				var names []string
+				if len(val) > 0 {
+					names = strings.Split(val, "|")
+				}
+				var flags uint
+				flags, err = captureFlags(names)
+				s.Flags |= flags
+			case "retry":
+				if k := strings.Index(val, ":"); k >= 0 {
+					s.RetryOn, err = parseCodes(val[k+1:])
+					val = val[:k]
+				}
+				var e error
+				if s.Retry, e = strconv.Atoi(val); err == nil {
+					err = e
+				}
+			case "backoff":
+				s.RetryDelay, err = time.ParseDuration(val)
+			default:
+				err = errors.New("unknown annotation")
+			}
+			if err != nil {
+				report(errors.Wrapf(err, "annotation `%s`", m))
 			}
 		}
 	} else {
 		s.Sess = cmd
 	}
-	return s, true
+	if k := strings.Index(s.Sess, "@"); k >= 0 {
+		s.Sess, s.Endpoint = strings.TrimSpace(s.Sess[:k]), strings.TrimSpace(s.Sess[k+1:])
+		if len(s.Endpoint) == 0 {
+			report(errors.New("empty endpoint of session " + s.Sess))
+		}
+	}
+	s.Sess = strings.TrimSpace(s.Sess)
+	if len(s.Sess) == 0 {
+		report(errors.New("empty session"))
+	}
+	return first
+}
+
+// splitAnnotations splits annotations by commas which are neither quoted nor enclosed by brackets, so that
+// annotations like `let ts=json_extract(x, '$.a')` and `mask=\d{1,3}` are kept as a whole.
+func splitAnnotations(s string) []string {
+	var (
+		out   []string
+		depth int
+		quote byte
+		start int
+	)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '(' || c == '[' || c == '{':
+			depth++
+		case (c == ')' || c == ']' || c == '}') && depth > 0:
+			depth--
+		case c == ',' && depth == 0:
+			out = append(out, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(out, s[start:])
+}
+
+func compareOptionsOf(s *Stmt) *CompareOptions {
+	if s.Compare == nil {
+		s.Compare = &CompareOptions{}
+	}
+	return s.Compare
+}
+
+// captureFlags maps names of states to capture to statement flags, all states are captured if names is empty.
+func captureFlags(names []string) (uint, error) {
+	if len(names) == 0 {
+		return S_CAPTURE, nil
+	}
+	var flags uint
+	for _, name := range names {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "warnings":
+			flags |= S_WARNINGS
+		case "exec":
+			flags |= S_EXEC_INFO
+		case "txn":
+			flags |= S_TXN_STATE
+		default:
+			return flags, errors.New("unknown state to capture: " + name)
+		}
+	}
+	return flags, nil
+}
+
+// parseCodes parses error codes like `1213|8002`, invalid codes are skipped and the first of them is reported.
+func parseCodes(s string) ([]int, error) {
+	var (
+		codes []int
+		first error
+	)
+	for _, x := range strings.Split(s, "|") {
+		if code, err := strconv.Atoi(strings.TrimSpace(x)); err == nil {
+			codes = append(codes, code)
+		} else if first == nil {
+			first = errors.New("invalid error code: " + x)
+		}
+	}
+	return codes, first
 }
 
 func hasTypeOf(token antlr.Token, types ...int) bool {
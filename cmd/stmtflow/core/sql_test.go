@@ -0,0 +1,179 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	. "github.com/zyguan/tidb-test-util/pkg/stmtflow"
+)
+
+func TestParseHeader(t *testing.T) {
+	var s Stmt
+	require.NoError(t, parseHeader(&s, "s1@tikv: wait, error=1213|8002, timeout=1s, retry=3:9007, backoff=50ms, unordered"))
+	require.Equal(t, "s1", s.Sess)
+	require.Equal(t, "tikv", s.Endpoint)
+	require.Equal(t, S_WAIT|S_UNORDERED, s.Flags)
+	require.Equal(t, []int{1213, 8002}, s.ExpectErrors)
+	require.Equal(t, time.Second, s.Timeout)
+	require.Equal(t, 3, s.Retry)
+	require.Equal(t, []int{9007}, s.RetryOn)
+	require.Equal(t, 50*time.Millisecond, s.RetryDelay)
+
+	s = Stmt{}
+	require.Error(t, parseHeader(&s, "s1: wait, nope, error=x"))
+	require.Equal(t, S_WAIT, s.Flags)
+}
+
+func TestParseHeaderNestedCommas(t *testing.T) {
+	var s Stmt
+	require.NoError(t, parseHeader(&s, `s1: let ts=json_extract(@@tidb_last_txn_info, '$.start_ts'), let x = concat('a,b', "c,d"), wait`))
+	require.Equal(t, []Capture{
+		{Name: "ts", Expr: `json_extract(@@tidb_last_txn_info, '$.start_ts')`},
+		{Name: "x", Expr: `concat('a,b', "c,d")`},
+	}, s.Let)
+	require.Equal(t, S_WAIT, s.Flags)
+
+	s = Stmt{}
+	require.NoError(t, parseHeader(&s, `s1: mask=\d{1,3}, mask=[,;]x, ignore=a|b`))
+	require.Equal(t, &CompareOptions{Masks: []string{`\d{1,3}`, `[,;]x`}, IgnoreColumns: []string{"a", "b"}}, s.Compare)
+
+	for _, tt := range []struct {
+		in  string
+		out []string
+	}{
+		{"", []string{""}},
+		{"a, b,", []string{"a", " b", ""}},
+		{`f(a, (b, c)), d`, []string{`f(a, (b, c))`, " d"}},
+		{`'it\'s, ok', x`, []string{`'it\'s, ok'`, " x"}},
+		{"`a,b`, x", []string{"`a,b`", " x"}},
+		{`x), y`, []string{`x)`, " y"}},
+	} {
+		require.Equal(t, tt.out, splitAnnotations(tt.in), tt.in)
+	}
+}
+
+func TestNormalizeMaskedWarnings(t *testing.T) {
+	text := func(ts string) string {
+		return "/* s1: capture=warnings, mask=txnStartTS=\\d+ */ insert into t values (1);\n" +
+			"-- s1 >> 1 rows affected\n" +
+			"-- s1    Warning 9007: Write conflict, txnStartTS=" + ts + "\n"
+	}
+	require.Equal(t, normalizeText(text("42"), CompareOptions{}), normalizeText(text("43"), CompareOptions{}))
+	require.Contains(t, normalizeText(text("42"), CompareOptions{}), "Write conflict, <masked>")
+	require.NotEqual(t, normalizeText(text("42"), CompareOptions{}), normalizeText(text("42")+"-- s1    Note 1: x\n", CompareOptions{}))
+}
+
+func sqlsOf(stmts []Stmt) []string {
+	sqls := make([]string, len(stmts))
+	for i, s := range stmts {
+		sqls[i] = s.SQL
+	}
+	return sqls
+}
+
+func TestSplitDelimiter(t *testing.T) {
+	stmts, err := ParseStrictSQL("t.sql", strings.NewReader(`/* s1 */ select 1;
+DELIMITER //
+/* s1 */ create procedure p() begin select 1; select 2; end //
+/* s1 */ call p() //
+DELIMITER ;
+/* s1 */ select 3;
+`))
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"/* s1 */ select 1;",
+		"/* s1 */ create procedure p() begin select 1; select 2; end",
+		"/* s1 */ call p()",
+		"/* s1 */ select 3;",
+	}, sqlsOf(stmts))
+}
+
+func TestSplitRoutines(t *testing.T) {
+	stmts, err := ParseStrictSQL("t.sql", strings.NewReader(`/* s1 */ create procedure p(x int)
+begin
+  if x > 0 then
+    select 1;
+  end if;
+  select case x when 1 then 'a' else 'b' end;
+  case when x > 1 then select 2; else select 3; end case;
+end;
+/* s1 */ create definer=current_user trigger tr before insert on t for each row begin set new.a = 1; end;
+/* s1 */ create table event (a int);
+/* s1 */ begin;
+/* s1 */ select 1;
+`))
+	require.NoError(t, err)
+	sqls := sqlsOf(stmts)
+	require.Len(t, sqls, 5)
+	require.True(t, strings.HasPrefix(sqls[0], "/* s1 */ create procedure p(x int)"))
+	require.True(t, strings.HasSuffix(sqls[0], "end case;\nend;"))
+	require.Equal(t, "/* s1 */ create definer=current_user trigger tr before insert on t for each row begin set new.a = 1; end;", sqls[1])
+	require.Equal(t, []string{"/* s1 */ create table event (a int);", "/* s1 */ begin;", "/* s1 */ select 1;"}, sqls[2:])
+}
+
+func TestSplitPositions(t *testing.T) {
+	stmts, err := ParseStrictSQL("t.sql", strings.NewReader("/* s1 */ select 1; /* s2 */ select 2;\n\n  /* s1 */ select\n  3;\n/* ctl: sleep 1s */\n"))
+	require.NoError(t, err)
+	require.Len(t, stmts, 4)
+	for i, pos := range []Pos{
+		{File: "t.sql", Line: 1, Col: 1}, {File: "t.sql", Line: 1, Col: 20},
+		{File: "t.sql", Line: 3, Col: 3}, {File: "t.sql", Line: 5, Col: 1},
+	} {
+		require.Equal(t, pos, *stmts[i].Pos, i)
+	}
+
+	_, err = ParseStrictSQL("t.sql", strings.NewReader("/* s1 */ select 1;\nselect 2;\n/* s1: nope */ select 3;\n"))
+	var errs ParseErrors
+	require.True(t, errors.As(err, &errs))
+	require.Len(t, errs, 2)
+	require.Equal(t, 2, errs[0].Pos.Line)
+	require.Equal(t, Pos{File: "t.sql", Line: 3, Col: 1}, errs[1].Pos)
+}
+
+func TestDumpRoutines(t *testing.T) {
+	text := `/* s1 */ select 1;
+DELIMITER //
+/* s1 */ create procedure p() begin select 1; end //
+/* s1 */ create function f() returns int begin return 1; end //
+DELIMITER ;
+/* s1 */ call p();
+/* s1 */ create procedure q() begin select 2; end;
+`
+	stmts, err := ParseStrictSQL("t.sql", strings.NewReader(text))
+	require.NoError(t, err)
+	buf := new(bytes.Buffer)
+	require.NoError(t, DumpSQL(buf, stmts))
+	require.Equal(t, text[:strings.LastIndex(text, "/* s1 */ create")]+`DELIMITER //
+/* s1 */ create procedure q() begin select 2; end //
+DELIMITER ;
+`, buf.String())
+	again, err := ParseStrictSQL("t.sql", buf)
+	require.NoError(t, err)
+	require.Equal(t, sqlsOf(stmts)[:4], sqlsOf(again)[:4])
+	require.Equal(t, "/* s1 */ create procedure q() begin select 2; end", again[4].SQL)
+}
+
+func TestParseStrictSQL(t *testing.T) {
+	stmts, err := ParseStrictSQL("t.sql", strings.NewReader("/* s1 */ select 1;\n/* s1: mask=( */ select 2;\n/* s2 */ select 'x;\n"))
+	var errs ParseErrors
+	require.True(t, errors.As(err, &errs))
+	require.Equal(t, "t.sql:3:17: unterminated string", errs.Error())
+	// statements are returned anyway, invalid masks are left to lint
+	require.Len(t, stmts, 3)
+	require.Equal(t, []string{"("}, stmts[1].Compare.Masks)
+
+	_, err = ParseStrictSQL("t.sql", strings.NewReader("/* s1: wait, nope */ select 1;\n/* s1 */ ;\n"))
+	require.True(t, errors.As(err, &errs))
+	require.Len(t, errs, 2)
+	require.Contains(t, errs[0].Error(), "t.sql:1:1: annotation `nope`")
+	require.Equal(t, "t.sql:2:1: empty statement of session s1", errs[1].Error())
+
+	stmts, err = ParseStrictSQL("t.sql", strings.NewReader("-- nothing\n"))
+	require.NoError(t, err)
+	require.Empty(t, stmts)
+}
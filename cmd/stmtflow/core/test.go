@@ -4,6 +4,11 @@ import (
 	"bytes"
 	"encoding/json"
 	stderr "errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/Masterminds/semver/v3"
@@ -24,17 +29,107 @@ type Assertion interface {
 
 type Test struct {
 	Name   string            `json:"name"`
+	Path   string            `json:"path,omitempty"`
 	Test   []Stmt            `json:"test"`
 	Labels map[string]string `json:"labels"`
 	Expect json.RawMessage   `json:"expect"`
 	Repeat int               `json:"repeat"`
 
+	Endpoints map[string]string `json:"endpoints,omitempty"`
+	Compare   CompareOptions    `json:"compare"`
+	// Capture lists states (warnings, exec or txn) to capture after every statement.
+	Capture []string `json:"capture,omitempty"`
+
+	// Setup and Teardown run before and after the test, they are not asserted. Teardown runs even if the test fails.
+	Setup    Fixture `json:"setup,omitempty"`
+	Teardown Fixture `json:"teardown,omitempty"`
+	// Isolated runs the test in a database created for each run, which is dropped afterwards.
+	Isolated bool `json:"isolated,omitempty"`
+	// Sessions declares settings of sessions, they are applied when connections are opened instead of by statements.
+	Sessions map[string]SessionSpec `json:"sessions,omitempty"`
+
 	VersionConstraint string `json:"versionConstraint"`
 
 	AssertMethod string      `json:"assertMethod"`
 	Assertions   []Assertion `json:"-"`
 }
 
+// SessionSpec declares settings of a session like `{vars: {tidb_txn_mode: 'pessimistic'}, user: 'u1', db: 'test'}`.
+type SessionSpec struct {
+	// Vars are session variables, strings are quoted, numbers and booleans are used as they are, null means default.
+	Vars     map[string]interface{} `json:"vars,omitempty"`
+	User     string                 `json:"user,omitempty"`
+	Password string                 `json:"password,omitempty"`
+	DB       string                 `json:"db,omitempty"`
+}
+
+// Options converts the spec to options for evaluation, logging in as the user is left to callers who know dsns.
+func (s SessionSpec) Options() (SessionOptions, error) {
+	opts := SessionOptions{DB: s.DB}
+	if len(s.Vars) == 0 {
+		return opts, nil
+	}
+	opts.Vars = make(map[string]string, len(s.Vars))
+	for name, v := range s.Vars {
+		switch x := v.(type) {
+		case nil:
+			opts.Vars[name] = "default"
+		case string:
+			opts.Vars[name] = "'" + strings.NewReplacer(`\`, `\\`, `'`, `''`).Replace(x) + "'"
+		case float64:
+			opts.Vars[name] = strconv.FormatFloat(x, 'f', -1, 64)
+		case bool:
+			opts.Vars[name] = "0"
+			if x {
+				opts.Vars[name] = "1"
+			}
+		default:
+			return opts, errors.Errorf("unsupported value of %s: %v", name, v)
+		}
+	}
+	return opts, nil
+}
+
+// FixtureSession is the session of fixture statements without a header.
+const FixtureSession = "fixture"
+
+// Fixture is a list of statements, it can be given as a sql text, or a (nested) list of sql texts and parsed
+// statements.
+type Fixture []Stmt
+
+func (f *Fixture) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		stmts, err := ParseFixture(text, FixtureSession)
+		if err != nil {
+			return errors.Wrap(err, "parse fixture")
+		}
+		*f = stmts
+		return nil
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		return errors.Wrap(err, "unmarshal fixture")
+	}
+	*f = Fixture{}
+	for _, item := range items {
+		if bytes.HasPrefix(bytes.TrimSpace(item), []byte("[")) || json.Unmarshal(item, &text) == nil {
+			var sub Fixture
+			if err := sub.UnmarshalJSON(item); err != nil {
+				return err
+			}
+			*f = append(*f, sub...)
+			continue
+		}
+		var s Stmt
+		if err := json.Unmarshal(item, &s); err != nil {
+			return errors.Wrap(err, "unmarshal fixture")
+		}
+		*f = append(*f, s)
+	}
+	return nil
+}
+
 func (t *Test) Assert(actual History) error {
 	if len(t.Assertions) == 0 {
 		return errors.WithStack(ErrNotAsserted)
@@ -59,6 +154,16 @@ func (t *Test) ExpectedText() (string, bool) {
 	return "", false
 }
 
+// ExpectedHistory returns the expected history if the test is asserted by one.
+func (t *Test) ExpectedHistory() (History, bool) {
+	for _, a := range t.Assertions {
+		if x, ok := a.(interface{ ExpectedHistory() (History, bool) }); ok {
+			return x.ExpectedHistory()
+		}
+	}
+	return nil, false
+}
+
 func (t *Test) ValidateVersion(ver string) error {
 	if len(t.VersionConstraint) == 0 {
 		return nil
@@ -82,7 +187,9 @@ func (t *Test) ValidateVersion(ver string) error {
 }
 
 type matchText struct {
-	expect string
+	expect    string
+	opts      CompareOptions
+	normalize bool
 }
 
 func (a *matchText) Assert(actual History) error {
@@ -90,7 +197,11 @@ func (a *matchText) Assert(actual History) error {
 	if err := actual.DumpText(buf, TextDumpOptions{Verbose: true}); err != nil {
 		return errors.Wrap(err, "dump actual output")
 	}
-	if strings.TrimSpace(a.expect) != strings.TrimSpace(buf.String()) {
+	exp, act := a.expect, buf.String()
+	if a.normalize {
+		exp, act = normalizeText(exp, a.opts), normalizeText(act, a.opts)
+	}
+	if strings.TrimSpace(exp) != strings.TrimSpace(act) {
 		return errors.New("result mismatch")
 	}
 	return nil
@@ -100,8 +211,109 @@ func (a *matchText) ExpectedText() (string, bool) {
 	return a.expect, true
 }
 
+var (
+	tableHead   = regexp.MustCompile(`^-- (\S+) >> \+[-+]*$`)
+	warningLine = regexp.MustCompile(`^(-- (\S+)    (?:Note|Warning|Error) \d+: )(.*)$`)
+)
+
+// normalizeText rewrites result tables and warnings in a text output by comparison options, which are overridden by
+// annotations of statements.
+func normalizeText(text string, opts CompareOptions) string {
+	var (
+		out   = new(strings.Builder)
+		lines = strings.Split(text, "\n")
+		cur   = map[string]CompareOptions{}
+	)
+	for k := 0; k < len(lines); k++ {
+		line := lines[k]
+		if strings.HasPrefix(line, "/*") {
+			if end := strings.Index(line, "*/"); end > 0 {
+				var s Stmt
+				parseHeader(&s, strings.TrimSpace(line[2:end]))
+				c := opts.Merge(s.Compare)
+				c.Unordered = c.Unordered || s.Flags&S_UNORDERED > 0
+				cur[s.Sess] = c
+			}
+		}
+		if m := warningLine.FindStringSubmatch(line); m != nil {
+			c, ok := cur[m[2]]
+			if !ok {
+				c = opts
+			}
+			out.WriteString(m[1] + string(c.Mapper().Mask([]byte(m[3]))) + "\n")
+			continue
+		}
+		m := tableHead.FindStringSubmatch(line)
+		if m == nil {
+			out.WriteString(line + "\n")
+			continue
+		}
+		sess, prefix := m[1], "-- "+m[1]+"    "
+		c, ok := cur[sess]
+		if !ok {
+			c = opts
+		}
+		var rows [][]string
+		for k+1 < len(lines) && strings.HasPrefix(lines[k+1], prefix) {
+			rest := strings.TrimSpace(lines[k+1][len(prefix):])
+			if !strings.HasPrefix(rest, "|") && !strings.HasPrefix(rest, "+") {
+				break
+			}
+			if k++; strings.HasPrefix(rest, "|") {
+				cells := strings.Split(strings.Trim(rest, "|"), "|")
+				for j := range cells {
+					cells[j] = strings.TrimSpace(cells[j])
+				}
+				rows = append(rows, cells)
+			}
+		}
+		writeTable(out, sess, rows, c)
+	}
+	return out.String()
+}
+
+func writeTable(out io.Writer, sess string, rows [][]string, c CompareOptions) {
+	if len(rows) == 0 {
+		return
+	}
+	if c.RowCount {
+		fmt.Fprintf(out, "-- %s >> %d rows\n", sess, len(rows)-1)
+		return
+	}
+	var cols []int
+	m := c.Mapper()
+	for j, name := range rows[0] {
+		if !c.Ignored(name) {
+			cols = append(cols, j)
+		}
+	}
+	lines := make([]string, len(rows))
+	for i, row := range rows {
+		cells := make([]string, 0, len(cols))
+		for _, j := range cols {
+			v := ""
+			if j < len(row) {
+				v = row[j]
+			}
+			if i > 0 {
+				v = string(m.MapValue([]byte(v), ""))
+			}
+			cells = append(cells, v)
+		}
+		lines[i] = "| " + strings.Join(cells, " | ") + " |"
+	}
+	if c.Unordered {
+		sort.Strings(lines[1:])
+	}
+	fmt.Fprintf(out, "-- %s >> %s\n", sess, lines[0])
+	for _, line := range lines[1:] {
+		fmt.Fprintf(out, "-- %s    %s\n", sess, line)
+	}
+}
+
 type matchHistory struct {
 	expect History
+	opts   CompareOptions
 }
 
 func (a *matchHistory) Assert(actual History) error {
@@ -109,7 +321,7 @@ func (a *matchHistory) Assert(actual History) error {
 		return errors.Errorf("expect %d events, got %d", len(a.expect), len(actual))
 	}
 	for i := range a.expect {
-		if ok, msg := a.expect[i].EqualTo(actual[i], DefaultDigestOptions); !ok {
+		if ok, msg := a.expect[i].Match(actual[i], a.opts); !ok {
 			return errors.Errorf("event#%d mismatch: %s", i, msg)
 		}
 	}
@@ -124,6 +336,45 @@ func (a *matchHistory) ExpectedText() (string, bool) {
 	return buf.String(), true
 }
 
+func (a *matchHistory) ExpectedHistory() (History, bool) {
+	return a.expect, true
+}
+
+// matchErrors checks statements annotated with expected errors.
+type matchErrors struct{}
+
+func (a *matchErrors) Assert(actual History) error {
+	for i, e := range actual {
+		if e.Kind != EventReturn {
+			continue
+		}
+		ret := e.Return()
+		if len(ret.Stmt.ExpectErrors) == 0 {
+			continue
+		}
+		tag := fmt.Sprintf("event#%d %s(%s)", i, e.EventMeta, ret.Stmt.SQL)
+		if pos := ret.Stmt.Where(); len(pos) > 0 {
+			tag += " at " + pos
+		}
+		if ret.Err == nil {
+			return errors.Errorf("%s: expect error %v, got ok", tag, ret.Stmt.ExpectErrors)
+		}
+		err := WrapError(ret.Err).(*Error)
+		ok := false
+		for _, code := range ret.Stmt.ExpectErrors {
+			ok = ok || code == err.Code
+		}
+		if !ok {
+			return errors.Errorf("%s: expect error %v, got (%s)", tag, ret.Stmt.ExpectErrors, err.Error())
+		}
+	}
+	return nil
+}
+
+func (a *matchErrors) ExpectedText() (string, bool) {
+	return "", false
+}
+
 type customAssertFn struct {
 	path string
 	name string
@@ -0,0 +1,86 @@
+package core
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFixtureUnmarshalJSON(t *testing.T) {
+	var f Fixture
+	require.NoError(t, json.Unmarshal([]byte(`"create table t (a int);\n/* s1 */ insert into t values (1);"`), &f))
+	require.Len(t, f, 2)
+	require.Equal(t, FixtureSession, f[0].Sess)
+	require.Equal(t, "s1", f[1].Sess)
+
+	// lists are flattened, statements are taken as they are
+	require.NoError(t, json.Unmarshal([]byte(`["drop table if exists t;", [["create table t (a int);"]], {"s": "s2", "q": "select 1"}]`), &f))
+	require.Len(t, f, 3)
+	require.Equal(t, []string{FixtureSession, FixtureSession, "s2"}, []string{f[0].Sess, f[1].Sess, f[2].Sess})
+	require.Equal(t, "select 1", f[2].SQL)
+
+	require.NoError(t, json.Unmarshal([]byte(`[]`), &f))
+	require.Empty(t, f)
+	require.Error(t, json.Unmarshal([]byte(`"/* s1: nope */ select 1;"`), &f))
+	require.Error(t, json.Unmarshal([]byte(`["select 1;", 42]`), &f))
+	require.Error(t, json.Unmarshal([]byte(`{"s": "s1"}`), &f))
+}
+
+func writeManifest(t *testing.T, src string) string {
+	path := filepath.Join(t.TempDir(), "tests.jsonnet")
+	require.NoError(t, os.WriteFile(path, []byte(src), 0644))
+	return path
+}
+
+func TestLoadFixtures(t *testing.T) {
+	path := writeManifest(t, `{
+	setup:: "create table t (a int);",
+	teardown:: ["drop table t;"],
+	isolated:: true,
+	t1: {test: [{s: "s1", q: "select 1"}], expect: ""},
+	t2: {test: [{s: "s1", q: "select 2"}], expect: "", setup: "insert into t values (1);", teardown: "delete from t;", isolated: false},
+}`)
+	tests, err := Load(path, "")
+	require.NoError(t, err)
+	require.Len(t, tests, 2)
+
+	t1, t2 := tests[0], tests[1]
+	require.Equal(t, "t1", t1.Name)
+	require.Equal(t, []string{"create table t (a int);"}, sqlsOf(t1.Setup))
+	require.Equal(t, []string{"drop table t;"}, sqlsOf(t1.Teardown))
+	require.True(t, t1.Isolated)
+
+	// fixtures of the file wrap those of the test
+	require.Equal(t, []string{"create table t (a int);", "insert into t values (1);"}, sqlsOf(t2.Setup))
+	require.Equal(t, []string{"delete from t;", "drop table t;"}, sqlsOf(t2.Teardown))
+	require.False(t, t2.Isolated)
+
+	_, err = Load(writeManifest(t, `{setup: "create table t (a int);", t1: {test: [], expect: ""}}`), "")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "use setup:: instead")
+}
+
+func TestLoadPositions(t *testing.T) {
+	path := writeManifest(t, `local sf = import "stmtflow";
+{
+	t0: {path: "t0.t.sql", test: sf.parseSQL(importstr "t0.t.sql"), expect: ""},
+	t1: {test: sf.parseSQL("/* s1 */ select 1;"), expect: ""},
+}`)
+	sql := "/* s1 */ begin;\n\n/* s2 */ select 1;\n/* s1 */ commit;\n"
+	require.NoError(t, os.WriteFile(filepath.Join(filepath.Dir(path), "t0.t.sql"), []byte(sql), 0644))
+	tests, err := Load(path, "")
+	require.NoError(t, err)
+	require.Len(t, tests, 2)
+
+	// positions are resolved by the test file
+	var where []string
+	for _, s := range tests[0].Test {
+		where = append(where, s.Where())
+	}
+	testPath := filepath.Join(filepath.Dir(path), "t0.t.sql")
+	require.Equal(t, []string{testPath + ":1:1", testPath + ":3:1", testPath + ":4:1"}, where)
+	require.Nil(t, tests[1].Test[0].Pos)
+}
@@ -9,6 +9,8 @@ require (
 	github.com/google/go-jsonnet v0.17.0
 	github.com/pkg/errors v0.9.1
 	github.com/spf13/cobra v1.1.3
+	github.com/stretchr/testify v1.7.0
+	github.com/zyguan/sqlz v0.0.0-20211008183028-44ff42cf1df2
 	github.com/zyguan/tidb-test-util v0.0.0-00010101000000-000000000000
 )
 
@@ -1,5 +1,9 @@
 lexer grammar Stmt;
 
+// Delimiters are not tokens of this lexer. `DELIMITER xx` changes the delimiter while a file is split, and BEGIN ...
+// END blocks of stored routines nest, neither can be expressed by lexer rules. The splitter in core/sql.go tracks
+// both over the tokens below instead, so SEMI is only a candidate delimiter.
+
 SPACE:                               [ \t]+;
 NEWLINE:                             '\n' | '\r' | '\r\n';
 BLOCK_COMMENT:                       '/*' .*? '*/';
@@ -0,0 +1,85 @@
+package stmtflow
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Warning is a row of `SHOW WARNINGS`.
+type Warning struct {
+	Level   string `json:"level"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (w Warning) String() string { return fmt.Sprintf("%s %d: %s", w.Level, w.Code, w.Message) }
+
+// ExecInfo is the metadata of an exec result.
+type ExecInfo struct {
+	RowsAffected int64 `json:"rowsAffected"`
+	LastInsertId int64 `json:"lastInsertId"`
+}
+
+// TxnState tells whether the session is inside a transaction after a statement, StartTS is the start ts of the
+// transaction if it's active.
+type TxnState struct {
+	Active  bool   `json:"active"`
+	StartTS uint64 `json:"startTS,omitempty"`
+}
+
+// queryWarnings reads warnings of the last statement, it must be called before any other statement is sent.
+func queryWarnings(ctx context.Context, c *BorrowedConn) []Warning {
+	ws := []Warning{}
+	rows, err := c.QueryContext(ctx, "show warnings")
+	if err != nil {
+		return ws
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var w Warning
+		if err = rows.Scan(&w.Level, &w.Code, &w.Message); err != nil {
+			break
+		}
+		ws = append(ws, w)
+	}
+	return ws
+}
+
+// queryTxnState reads the transaction state of the session by @@tidb_current_ts, which is 0 outside transactions.
+func queryTxnState(ctx context.Context, c *BorrowedConn) *TxnState {
+	var ts sql.NullInt64
+	if err := c.QueryRowContext(ctx, "select @@tidb_current_ts").Scan(&ts); err != nil {
+		return nil
+	}
+	return &TxnState{Active: ts.Int64 > 0, StartTS: uint64(ts.Int64)}
+}
+
+// diffCaptured compares captured states of returns, only states the expected statement asks for are compared. Messages
+// of warnings are masked by c.
+func diffCaptured(r1 Return, r2 Return, c CompareOptions) string {
+	if r1.Flags&S_WARNINGS > 0 && !sameWarnings(r1.Warnings, r2.Warnings, c.Mapper()) {
+		return fmt.Sprintf("expect warnings %v, got %v", r1.Warnings, r2.Warnings)
+	}
+	if r1.Flags&S_EXEC_INFO > 0 && r1.Exec != nil && (r2.Exec == nil || *r1.Exec != *r2.Exec) {
+		return fmt.Sprintf("expect exec info %+v, got %+v", *r1.Exec, r2.Exec)
+	}
+	if r1.Flags&S_TXN_STATE > 0 && r1.Txn != nil && (r2.Txn == nil || r1.Txn.Active != r2.Txn.Active) {
+		return fmt.Sprintf("expect txn %+v, got %+v", *r1.Txn, r2.Txn)
+	}
+	return ""
+}
+
+func sameWarnings(ws1 []Warning, ws2 []Warning, m ValueMapper) bool {
+	if len(ws1) != len(ws2) {
+		return false
+	}
+	for i := range ws1 {
+		w1, w2 := ws1[i], ws2[i]
+		w1.Message, w2.Message = string(m.Mask([]byte(w1.Message))), string(m.Mask([]byte(w2.Message)))
+		if w1 != w2 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,90 @@
+package stmtflow
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zyguan/sqlz"
+	"github.com/zyguan/tidb-test-util/pkg/stmtflow/stmtflowtest"
+)
+
+func TestCapturedReturn(t *testing.T) {
+	stmt := Stmt{Sess: "s1", SQL: "insert into t values ('a')", Flags: S_CAPTURE}
+	expect := NewReturnEvent("s1", Return{
+		Stmt:     stmt,
+		Res:      sqlz.NewFromResult(driver.RowsAffected(1)),
+		Warnings: []Warning{{"Warning", 1366, "Incorrect integer value: 'a'"}},
+		Exec:     &ExecInfo{RowsAffected: 1},
+		Txn:      &TxnState{Active: true, StartTS: 42},
+	})
+
+	js, err := json.Marshal(expect)
+	require.NoError(t, err)
+	var ev Event
+	require.NoError(t, json.Unmarshal(js, &ev))
+	require.Equal(t, expect.Return().Warnings, ev.Return().Warnings)
+	require.Equal(t, expect.Return().Exec, ev.Return().Exec)
+	require.Equal(t, expect.Return().Txn, ev.Return().Txn)
+
+	buf := new(bytes.Buffer)
+	ev.DumpText(buf, TextDumpOptions{})
+	require.Equal(t, `-- s1 >> 1 rows affected
+-- s1    Warning 1366: Incorrect integer value: 'a'
+-- s1    rows affected 1, last insert id 0
+-- s1    in transaction
+`, buf.String())
+
+	actual := NewReturnEvent("s1", Return{
+		Stmt:     stmt,
+		Res:      sqlz.NewFromResult(driver.RowsAffected(1)),
+		Warnings: []Warning{{"Warning", 1366, "Incorrect integer value: 'a'"}},
+		Exec:     &ExecInfo{RowsAffected: 1},
+		Txn:      &TxnState{Active: true, StartTS: 43},
+	})
+	ok, msg := expect.EqualTo(actual)
+	require.True(t, ok, msg)
+
+	actual.ret.Warnings = []Warning{}
+	ok, msg = expect.EqualTo(actual)
+	require.False(t, ok)
+	require.Contains(t, msg, "expect warnings")
+	d := DiffHistory(History{expect}, History{actual}, CompareOptions{})
+	require.Equal(t, DiffCaptured, d.Events[0].Reason)
+
+	// nothing is compared if it's not asked
+	plain := newRet("s1", stmt.SQL, sqlz.NewFromResult(driver.RowsAffected(1)), nil)
+	ok, msg = plain.EqualTo(newRet("s1", stmt.SQL, sqlz.NewFromResult(driver.RowsAffected(1)), nil))
+	require.True(t, ok, msg)
+	js, err = json.Marshal(plain)
+	require.NoError(t, err)
+	require.NotContains(t, string(js), "warnings")
+}
+
+func TestCapturedEmptyWarnings(t *testing.T) {
+	e := NewReturnEvent("s1", Return{Stmt: Stmt{Sess: "s1", SQL: "select 1", Flags: S_QUERY | S_WARNINGS}, Res: stmtflowtest.NewRows([]string{"1"}, []string{"1"}), Warnings: []Warning{}})
+	js, err := json.Marshal(e)
+	require.NoError(t, err)
+	var ev Event
+	require.NoError(t, json.Unmarshal(js, &ev))
+	require.NotNil(t, ev.Return().Warnings)
+	ok, msg := e.EqualTo(ev)
+	require.True(t, ok, msg)
+}
+
+func TestMaskedWarnings(t *testing.T) {
+	warn := func(msg string) Event {
+		stmt := Stmt{Sess: "s1", SQL: "insert into t values (1)", Flags: S_WARNINGS, Compare: &CompareOptions{Masks: []string{`txnStartTS=\d+`}}}
+		return NewReturnEvent("s1", Return{Stmt: stmt, Res: sqlz.NewFromResult(driver.RowsAffected(1)), Warnings: []Warning{{"Warning", 9007, msg}}})
+	}
+	expect, actual := warn("write conflict, txnStartTS=42"), warn("write conflict, txnStartTS=43")
+	ok, msg := expect.Match(actual, CompareOptions{})
+	require.True(t, ok, msg)
+	require.True(t, DiffHistory(History{expect}, History{actual}, CompareOptions{}).Empty())
+
+	ok, msg = expect.Match(warn("write conflict, conflictTS=43"), CompareOptions{})
+	require.False(t, ok)
+	require.Contains(t, msg, "expect warnings")
+}
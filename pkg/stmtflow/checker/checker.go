@@ -0,0 +1,534 @@
+// Package checker finds isolation anomalies in stmtflow histories, in the spirit of Elle and Adya.
+//
+// Histories are expected to follow the list-append convention:
+//
+//   - Data are kept in tables like `create table t (k int primary key, v text)`, where v is a comma separated list
+//     of elements, each element is appended once.
+//   - `insert into t values (K, 'E')` and `update t set v = concat(v, ',E') where k = K` append E to K.
+//   - A query returning columns k and v reads lists of the returned keys, `select v from t where k = K` reads the
+//     list of K (an empty result means an empty list).
+//   - Transactions are delimited by `begin` (or `start transaction`) and `commit` or `rollback` in each session. A
+//     failed commit or a deadlock error aborts the transaction. Statements outside transactions are autocommit.
+//
+// The version order of each key is inferred from the longest list read, then a dependency graph of committed
+// transactions is built with ww, wr and rw edges, and cycles in the graph are classified as anomalies.
+package checker
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zyguan/tidb-test-util/pkg/stmtflow"
+)
+
+const (
+	G0           = "G0"
+	G1a          = "G1a"
+	G1b          = "G1b"
+	G1c          = "G1c"
+	GSingle      = "G-single"
+	G2           = "G2-item"
+	LostUpdate   = "lost-update"
+	WriteSkew    = "write-skew"
+	Incompatible = "incompatible-order"
+)
+
+type TxnStatus string
+
+const (
+	Committed TxnStatus = "committed"
+	Aborted   TxnStatus = "aborted"
+	Unknown   TxnStatus = "unknown"
+)
+
+type OpKind string
+
+const (
+	Read   OpKind = "r"
+	Append OpKind = "append"
+)
+
+type Op struct {
+	Kind  OpKind   `json:"kind"`
+	Key   int64    `json:"key"`
+	Elem  string   `json:"elem,omitempty"`
+	List  []string `json:"list,omitempty"`
+	Event int      `json:"event"`
+}
+
+func (op Op) String() string {
+	if op.Kind == Read {
+		return fmt.Sprintf("r(%d)=%v", op.Key, op.List)
+	}
+	return fmt.Sprintf("append(%d,%s)", op.Key, op.Elem)
+}
+
+type Txn struct {
+	ID      int       `json:"id"`
+	Session string    `json:"session"`
+	Status  TxnStatus `json:"status"`
+	Ops     []Op      `json:"ops"`
+}
+
+func (t Txn) String() string { return fmt.Sprintf("T%d(%s)", t.ID, t.Session) }
+
+type EdgeKind string
+
+const (
+	WW EdgeKind = "ww"
+	WR EdgeKind = "wr"
+	RW EdgeKind = "rw"
+)
+
+type Edge struct {
+	From int      `json:"from"`
+	To   int      `json:"to"`
+	Kind EdgeKind `json:"kind"`
+	Key  int64    `json:"key"`
+}
+
+type Anomaly struct {
+	Type    string `json:"type"`
+	Txns    []int  `json:"txns"`
+	Cycle   []Edge `json:"cycle,omitempty"`
+	Message string `json:"message"`
+}
+
+type Result struct {
+	Txns      []Txn     `json:"txns"`
+	Anomalies []Anomaly `json:"anomalies"`
+}
+
+// Of returns anomalies of the given types.
+func (r Result) Of(types ...string) []Anomaly {
+	var xs []Anomaly
+	for _, a := range r.Anomalies {
+		for _, t := range types {
+			if a.Type == t {
+				xs = append(xs, a)
+				break
+			}
+		}
+	}
+	return xs
+}
+
+// Check analyses a history following the list-append convention.
+func Check(h stmtflow.History) Result {
+	c := &checker{txns: Transactions(h)}
+	c.check()
+	return Result{Txns: c.txns, Anomalies: c.anomalies}
+}
+
+var (
+	insertPattern = regexp.MustCompile(`(?is)^insert\s+into\s+\S+\s*(?:\(\s*k\s*,\s*v\s*\)\s*)?values\s*\(\s*(-?\d+)\s*,\s*'([^',]*)'\s*\)$`)
+	updatePattern = regexp.MustCompile(`(?is)^update\s+\S+\s+set\s+v\s*=\s*concat\(\s*v\s*,\s*',([^',]*)'\s*\)\s+where\s+k\s*=\s*(-?\d+)$`)
+	keyPattern    = regexp.MustCompile(`(?is)\s+where\s+k\s*=\s*(-?\d+)`)
+)
+
+// Transactions extracts transactions from a history.
+func Transactions(h stmtflow.History) []Txn {
+	var (
+		txns []Txn
+		open = map[string]int{}
+	)
+	begin := func(sess string) int {
+		txns = append(txns, Txn{ID: len(txns) + 1, Session: sess, Status: Unknown})
+		return len(txns) - 1
+	}
+	for i, e := range h {
+		if e.Kind != stmtflow.EventReturn {
+			continue
+		}
+		ret := e.Return()
+		sql := normalize(ret.SQL)
+		lower := strings.ToLower(sql)
+		k, inTxn := open[e.Session]
+		switch {
+		case lower == "begin" || strings.HasPrefix(lower, "begin ") || strings.HasPrefix(lower, "start transaction"):
+			if ret.Err == nil {
+				if inTxn {
+					// an implicit commit
+					txns[k].Status = Committed
+				}
+				open[e.Session] = begin(e.Session)
+			}
+			continue
+		case lower == "commit" || lower == "rollback":
+			if inTxn {
+				txns[k].Status = Committed
+				if lower == "rollback" || ret.Err != nil {
+					txns[k].Status = Aborted
+				}
+				delete(open, e.Session)
+			}
+			continue
+		}
+		if ret.Err != nil {
+			if inTxn && stmtflow.WrapError(ret.Err).(*stmtflow.Error).Code == 1213 {
+				txns[k].Status = Aborted
+				delete(open, e.Session)
+			}
+			continue
+		}
+		ops := parseOps(sql, ret, i)
+		if len(ops) == 0 {
+			continue
+		}
+		if !inTxn {
+			k = begin(e.Session)
+			txns[k].Status = Committed
+		}
+		txns[k].Ops = append(txns[k].Ops, ops...)
+	}
+	return txns
+}
+
+func parseOps(sql string, ret stmtflow.Return, event int) []Op {
+	if m := insertPattern.FindStringSubmatch(sql); m != nil {
+		key, _ := strconv.ParseInt(m[1], 10, 64)
+		return []Op{{Kind: Append, Key: key, Elem: m[2], Event: event}}
+	}
+	if m := updatePattern.FindStringSubmatch(sql); m != nil {
+		key, _ := strconv.ParseInt(m[2], 10, 64)
+		return []Op{{Kind: Append, Key: key, Elem: m[1], Event: event}}
+	}
+	rs := ret.Res
+	if rs == nil || rs.IsExecResult() {
+		return nil
+	}
+	kc, vc := -1, -1
+	for j := 0; j < rs.NCols(); j++ {
+		switch strings.ToLower(rs.ColumnDef(j).Name) {
+		case "k":
+			kc = j
+		case "v":
+			vc = j
+		}
+	}
+	if vc < 0 {
+		return nil
+	}
+	if kc < 0 {
+		m := keyPattern.FindStringSubmatch(sql)
+		if m == nil || rs.NRows() > 1 {
+			return nil
+		}
+		key, _ := strconv.ParseInt(m[1], 10, 64)
+		op := Op{Kind: Read, Key: key, List: []string{}, Event: event}
+		if rs.NRows() == 1 {
+			v, _ := rs.RawValue(0, vc)
+			op.List = parseList(v)
+		}
+		return []Op{op}
+	}
+	ops := make([]Op, 0, rs.NRows())
+	for i := 0; i < rs.NRows(); i++ {
+		k, _ := rs.RawValue(i, kc)
+		v, _ := rs.RawValue(i, vc)
+		key, err := strconv.ParseInt(string(k), 10, 64)
+		if err != nil {
+			continue
+		}
+		ops = append(ops, Op{Kind: Read, Key: key, List: parseList(v), Event: event})
+	}
+	return ops
+}
+
+func parseList(v []byte) []string {
+	list := []string{}
+	for _, x := range strings.Split(string(v), ",") {
+		if x = strings.TrimSpace(x); len(x) > 0 {
+			list = append(list, x)
+		}
+	}
+	return list
+}
+
+// normalize strips leading comments and the tailing part since the first semicolon.
+func normalize(sql string) string {
+	for {
+		sql = strings.TrimSpace(sql)
+		if strings.HasPrefix(sql, "/*") {
+			if k := strings.Index(sql, "*/"); k >= 0 {
+				sql = sql[k+2:]
+				continue
+			}
+		} else if strings.HasPrefix(sql, "--") || strings.HasPrefix(sql, "#") {
+			if k := strings.Index(sql, "\n"); k >= 0 {
+				sql = sql[k+1:]
+				continue
+			}
+			return ""
+		}
+		break
+	}
+	if k := strings.Index(sql, ";"); k >= 0 {
+		sql = sql[:k]
+	}
+	return strings.TrimSpace(sql)
+}
+
+type writer struct {
+	txn  int
+	last bool
+}
+
+type checker struct {
+	txns      []Txn
+	anomalies []Anomaly
+	edges     []Edge
+	seen      map[string]bool
+}
+
+func (c *checker) check() {
+	c.seen = map[string]bool{}
+	writers := map[int64]map[string]writer{}
+	for i, t := range c.txns {
+		lastElem := map[int64]string{}
+		for _, op := range t.Ops {
+			if op.Kind == Append {
+				lastElem[op.Key] = op.Elem
+			}
+		}
+		for _, op := range t.Ops {
+			if op.Kind != Append {
+				continue
+			}
+			if writers[op.Key] == nil {
+				writers[op.Key] = map[string]writer{}
+			}
+			writers[op.Key][op.Elem] = writer{i, lastElem[op.Key] == op.Elem}
+		}
+	}
+
+	// infer version orders
+	orders := map[int64][]string{}
+	for _, t := range c.txns {
+		for _, op := range t.Ops {
+			if op.Kind == Read && len(op.List) > len(orders[op.Key]) {
+				orders[op.Key] = op.List
+			}
+		}
+	}
+	for i, t := range c.txns {
+		for _, op := range t.Ops {
+			if op.Kind == Read && !isPrefix(op.List, orders[op.Key]) {
+				c.report(Anomaly{Type: Incompatible, Txns: []int{t.ID},
+					Message: fmt.Sprintf("%s read %v of key %d, which is incompatible with %v", t, op.List, op.Key, orders[op.Key])})
+			}
+			if op.Kind != Read || t.Status != Committed {
+				continue
+			}
+			for j, elem := range op.List {
+				w, ok := writers[op.Key][elem]
+				if !ok || w.txn == i {
+					continue
+				}
+				if c.txns[w.txn].Status == Aborted {
+					c.report(Anomaly{Type: G1a, Txns: []int{c.txns[w.txn].ID, t.ID},
+						Message: fmt.Sprintf("%s read %s of key %d written by aborted %s", t, elem, op.Key, c.txns[w.txn])})
+				} else if j == len(op.List)-1 && !w.last {
+					c.report(Anomaly{Type: G1b, Txns: []int{c.txns[w.txn].ID, t.ID},
+						Message: fmt.Sprintf("%s read %s of key %d, an intermediate version of %s", t, elem, op.Key, c.txns[w.txn])})
+				}
+			}
+		}
+	}
+
+	// build dependency graph of committed transactions
+	keys := make([]int64, 0, len(orders))
+	for key := range orders {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	for _, key := range keys {
+		order := orders[key]
+		for j := 1; j < len(order); j++ {
+			w1, ok1 := writers[key][order[j-1]]
+			w2, ok2 := writers[key][order[j]]
+			if ok1 && ok2 {
+				c.addEdge(w1.txn, w2.txn, WW, key)
+			}
+		}
+	}
+	for i, t := range c.txns {
+		for _, op := range t.Ops {
+			if op.Kind != Read {
+				continue
+			}
+			order := orders[op.Key]
+			if n := len(op.List); n > 0 {
+				if w, ok := writers[op.Key][op.List[n-1]]; ok {
+					c.addEdge(w.txn, i, WR, op.Key)
+				}
+			}
+			if n := len(op.List); n < len(order) {
+				if w, ok := writers[op.Key][order[n]]; ok {
+					c.addEdge(i, w.txn, RW, op.Key)
+				}
+			}
+		}
+	}
+
+	c.checkLostUpdates()
+	c.checkCycles()
+}
+
+func (c *checker) addEdge(from int, to int, kind EdgeKind, key int64) {
+	if from == to || c.txns[from].Status != Committed || c.txns[to].Status != Committed {
+		return
+	}
+	c.edges = append(c.edges, Edge{from, to, kind, key})
+}
+
+func (c *checker) checkLostUpdates() {
+	type version struct {
+		key int64
+		n   int
+	}
+	updaters := map[version][]int{}
+	for i, t := range c.txns {
+		if t.Status != Committed {
+			continue
+		}
+		reads := map[int64]int{}
+		for _, op := range t.Ops {
+			if _, ok := reads[op.Key]; !ok && op.Kind == Read {
+				reads[op.Key] = len(op.List)
+			}
+			if n, ok := reads[op.Key]; ok && op.Kind == Append {
+				v := version{op.Key, n}
+				if l := updaters[v]; len(l) == 0 || l[len(l)-1] != i {
+					updaters[v] = append(updaters[v], i)
+				}
+			}
+		}
+	}
+	vs := make([]version, 0, len(updaters))
+	for v := range updaters {
+		vs = append(vs, v)
+	}
+	sort.Slice(vs, func(i, j int) bool { return vs[i].key < vs[j].key || vs[i].key == vs[j].key && vs[i].n < vs[j].n })
+	for _, v := range vs {
+		txns := updaters[v]
+		if len(txns) < 2 {
+			continue
+		}
+		a := Anomaly{Type: LostUpdate}
+		names := make([]string, len(txns))
+		for i, t := range txns {
+			a.Txns = append(a.Txns, c.txns[t].ID)
+			names[i] = c.txns[t].String()
+		}
+		a.Message = fmt.Sprintf("%s read the same version of key %d and then appended to it", strings.Join(names, ", "), v.key)
+		c.report(a)
+	}
+}
+
+func (c *checker) checkCycles() {
+	only := func(kinds ...EdgeKind) func(Edge) bool {
+		return func(e Edge) bool {
+			for _, k := range kinds {
+				if e.Kind == k {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	for _, e := range c.edges {
+		switch e.Kind {
+		case WW:
+			if path := c.path(e.To, e.From, only(WW)); path != nil {
+				c.reportCycle(G0, append([]Edge{e}, path...))
+			} else if path := c.path(e.To, e.From, only(WW, WR)); path != nil {
+				c.reportCycle(G1c, append([]Edge{e}, path...))
+			}
+		case WR:
+			if path := c.path(e.To, e.From, only(WW, WR)); path != nil {
+				c.reportCycle(G1c, append([]Edge{e}, path...))
+			}
+		case RW:
+			if path := c.path(e.To, e.From, only(WW, WR)); path != nil {
+				c.reportCycle(GSingle, append([]Edge{e}, path...))
+			} else if path := c.path(e.To, e.From, only(WW, WR, RW)); path != nil {
+				cycle := append([]Edge{e}, path...)
+				if len(cycle) == 2 && cycle[1].Kind == RW {
+					c.reportCycle(WriteSkew, cycle)
+				} else {
+					c.reportCycle(G2, cycle)
+				}
+			}
+		}
+	}
+}
+
+// path finds a shortest path from one transaction to another via edges accepted by the filter.
+func (c *checker) path(from int, to int, filter func(Edge) bool) []Edge {
+	prev := map[int]Edge{}
+	visited := map[int]bool{from: true}
+	queue := []int{from}
+	for len(queue) > 0 {
+		x := queue[0]
+		queue = queue[1:]
+		if x == to {
+			var path []Edge
+			for x != from {
+				e := prev[x]
+				path = append([]Edge{e}, path...)
+				x = e.From
+			}
+			return path
+		}
+		for _, e := range c.edges {
+			if e.From == x && !visited[e.To] && filter(e) {
+				visited[e.To] = true
+				prev[e.To] = e
+				queue = append(queue, e.To)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *checker) reportCycle(typ string, cycle []Edge) {
+	a := Anomaly{Type: typ, Cycle: cycle}
+	msg := new(strings.Builder)
+	msg.WriteString(c.txns[cycle[0].From].String())
+	for _, e := range cycle {
+		a.Txns = append(a.Txns, c.txns[e.From].ID)
+		fmt.Fprintf(msg, " -%s(%d)-> %s", e.Kind, e.Key, c.txns[e.To])
+	}
+	a.Message = msg.String()
+	for i := range a.Cycle {
+		a.Cycle[i].From, a.Cycle[i].To = c.txns[a.Cycle[i].From].ID, c.txns[a.Cycle[i].To].ID
+	}
+	c.report(a)
+}
+
+func (c *checker) report(a Anomaly) {
+	ids := append([]int{}, a.Txns...)
+	sort.Ints(ids)
+	k := a.Type + fmt.Sprint(ids)
+	if c.seen[k] {
+		return
+	}
+	c.seen[k] = true
+	c.anomalies = append(c.anomalies, a)
+}
+
+func isPrefix(xs []string, ys []string) bool {
+	if len(xs) > len(ys) {
+		return false
+	}
+	for i := range xs {
+		if xs[i] != ys[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,180 @@
+package checker
+
+import (
+	"database/sql/driver"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zyguan/sqlz"
+	"github.com/zyguan/tidb-test-util/pkg/stmtflow"
+)
+
+type historyBuilder struct{ h stmtflow.History }
+
+func (b *historyBuilder) exec(sess string, sql string) *historyBuilder {
+	stmt := stmtflow.Stmt{Sess: sess, SQL: "/* " + sess + " */ " + sql + ";"}
+	b.h = append(b.h, stmtflow.NewReturnEvent(sess, stmtflow.Return{Stmt: stmt, Res: sqlz.NewFromResult(driver.RowsAffected(1))}))
+	return b
+}
+
+func (b *historyBuilder) fail(sess string, sql string, code int) *historyBuilder {
+	stmt := stmtflow.Stmt{Sess: sess, SQL: "/* " + sess + " */ " + sql + ";"}
+	b.h = append(b.h, stmtflow.NewReturnEvent(sess, stmtflow.Return{Stmt: stmt, Err: &stmtflow.Error{Code: code, Message: "oops"}}))
+	return b
+}
+
+func (b *historyBuilder) read(sess string, kvs map[int]string) *historyBuilder {
+	stmt := stmtflow.Stmt{Sess: sess, SQL: "/* " + sess + " */ select k, v from t order by k;"}
+	rs := sqlz.New([]sqlz.ColumnDef{{Name: "k"}, {Name: "v"}})
+	keys := make([]int, 0, len(kvs))
+	for k := range kvs {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	for _, k := range keys {
+		row := rs.AllocateRow()
+		*row[0].(*[]byte) = []byte(strconv.Itoa(k))
+		*row[1].(*[]byte) = []byte(kvs[k])
+	}
+	b.h = append(b.h, stmtflow.NewReturnEvent(sess, stmtflow.Return{Stmt: stmt, Res: rs}))
+	return b
+}
+
+func types(r Result) []string {
+	var xs []string
+	for _, a := range r.Anomalies {
+		xs = append(xs, a.Type)
+	}
+	return xs
+}
+
+func TestTransactions(t *testing.T) {
+	b := new(historyBuilder).
+		exec("s1", "begin").
+		exec("s1", "insert into t values (1, 'a')").
+		exec("s2", "update t set v = concat(v, ',b') where k = 1").
+		exec("s1", "commit").
+		exec("s2", "start transaction").
+		read("s2", map[int]string{1: "a,b"}).
+		fail("s2", "update t set v = concat(v, ',c') where k = 1", 1213).
+		exec("s2", "commit").
+		exec("s1", "begin").
+		exec("s1", "update t set v = concat(v, ',d') where k = 2").
+		exec("s1", "rollback")
+	b.h = append(b.h, stmtflow.NewReturnEvent("s3", stmtflow.Return{
+		Stmt: stmtflow.Stmt{Sess: "s3", SQL: "select v from t where k = 9"},
+		Res:  sqlz.New([]sqlz.ColumnDef{{Name: "v"}}),
+	}))
+	txns := Transactions(b.h)
+	require.Len(t, txns, 5)
+	require.Equal(t, Txn{ID: 1, Session: "s1", Status: Committed, Ops: []Op{{Kind: Append, Key: 1, Elem: "a", Event: 1}}}, txns[0])
+	require.Equal(t, Txn{ID: 2, Session: "s2", Status: Committed, Ops: []Op{{Kind: Append, Key: 1, Elem: "b", Event: 2}}}, txns[1])
+	require.Equal(t, Txn{ID: 3, Session: "s2", Status: Aborted, Ops: []Op{{Kind: Read, Key: 1, List: []string{"a", "b"}, Event: 5}}}, txns[2])
+	require.Equal(t, Txn{ID: 4, Session: "s1", Status: Aborted, Ops: []Op{{Kind: Append, Key: 2, Elem: "d", Event: 9}}}, txns[3])
+	require.Equal(t, Txn{ID: 5, Session: "s3", Status: Committed, Ops: []Op{{Kind: Read, Key: 9, List: []string{}, Event: 11}}}, txns[4])
+}
+
+func TestSerializable(t *testing.T) {
+	b := new(historyBuilder).
+		exec("s1", "begin").
+		read("s1", map[int]string{}).
+		exec("s1", "insert into t values (1, 'a')").
+		exec("s1", "commit").
+		exec("s2", "begin").
+		read("s2", map[int]string{1: "a"}).
+		exec("s2", "update t set v = concat(v, ',b') where k = 1").
+		exec("s2", "insert into t values (2, 'x')").
+		exec("s2", "commit").
+		read("s1", map[int]string{1: "a,b", 2: "x"})
+	r := Check(b.h)
+	require.Empty(t, r.Anomalies)
+	require.Len(t, r.Txns, 3)
+}
+
+func TestWriteSkew(t *testing.T) {
+	b := new(historyBuilder).
+		exec("s1", "begin").
+		exec("s2", "begin").
+		read("s1", map[int]string{1: "", 2: ""}).
+		read("s2", map[int]string{1: "", 2: ""}).
+		exec("s1", "update t set v = concat(v, ',a') where k = 1").
+		exec("s2", "update t set v = concat(v, ',b') where k = 2").
+		exec("s1", "commit").
+		exec("s2", "commit").
+		read("s3", map[int]string{1: "a", 2: "b"})
+	r := Check(b.h)
+	require.Equal(t, []string{WriteSkew}, types(r))
+	require.Equal(t, []int{1, 2}, r.Anomalies[0].Txns)
+	require.Equal(t, "T1(s1) -rw(2)-> T2(s2) -rw(1)-> T1(s1)", r.Anomalies[0].Message)
+}
+
+func TestLostUpdate(t *testing.T) {
+	b := new(historyBuilder).
+		exec("s0", "insert into t values (1, 'x')").
+		exec("s1", "begin").
+		exec("s2", "begin").
+		read("s1", map[int]string{1: "x"}).
+		read("s2", map[int]string{1: "x"}).
+		exec("s1", "update t set v = concat(v, ',a') where k = 1").
+		exec("s1", "commit").
+		exec("s2", "update t set v = concat(v, ',b') where k = 1").
+		exec("s2", "commit").
+		read("s3", map[int]string{1: "x,a,b"})
+	r := Check(b.h)
+	require.Equal(t, []string{LostUpdate, GSingle}, types(r))
+	require.Equal(t, []int{2, 3}, r.Anomalies[0].Txns)
+	require.Len(t, r.Of(GSingle)[0].Cycle, 2)
+}
+
+func TestDirtyReads(t *testing.T) {
+	b := new(historyBuilder).
+		exec("s1", "begin").
+		exec("s1", "insert into t values (1, 'a')").
+		exec("s1", "update t set v = concat(v, ',b') where k = 1").
+		read("s2", map[int]string{1: "a"}).
+		exec("s1", "commit").
+		exec("s3", "begin").
+		exec("s3", "insert into t values (2, 'c')").
+		read("s2", map[int]string{2: "c"}).
+		exec("s3", "rollback")
+	r := Check(b.h)
+	require.Equal(t, []string{G1a, G1b}, []string{r.Of(G1a)[0].Type, r.Of(G1b)[0].Type})
+	require.Len(t, r.Anomalies, 2)
+}
+
+func TestCycles(t *testing.T) {
+	// T1 and T2 observe each other's writes
+	b := new(historyBuilder).
+		exec("s1", "begin").
+		exec("s2", "begin").
+		exec("s1", "insert into t values (1, 'a')").
+		exec("s2", "insert into t values (2, 'b')").
+		read("s1", map[int]string{2: "b"}).
+		read("s2", map[int]string{1: "a"}).
+		exec("s1", "commit").
+		exec("s2", "commit")
+	require.Equal(t, []string{G1c}, types(Check(b.h)))
+
+	// T1 and T2 overwrite each other on different keys
+	b = new(historyBuilder).
+		exec("s1", "begin").
+		exec("s2", "begin").
+		exec("s1", "update t set v = concat(v, ',a1') where k = 1").
+		exec("s2", "update t set v = concat(v, ',b1') where k = 1").
+		exec("s2", "update t set v = concat(v, ',b2') where k = 2").
+		exec("s1", "update t set v = concat(v, ',a2') where k = 2").
+		exec("s1", "commit").
+		exec("s2", "commit").
+		read("s3", map[int]string{1: "a1,b1", 2: "b2,a2"})
+	require.Equal(t, []string{G0}, types(Check(b.h)))
+
+	// reads disagree with each other
+	b = new(historyBuilder).
+		exec("s1", "insert into t values (1, 'a')").
+		exec("s2", "insert into t values (1, 'b')").
+		read("s3", map[int]string{1: "a"}).
+		read("s3", map[int]string{1: "b"})
+	require.Equal(t, []string{Incompatible}, types(Check(b.h)))
+}
@@ -0,0 +1,146 @@
+package stmtflow
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/zyguan/sqlz"
+)
+
+// MaskPlaceholder replaces parts of values matched by masks.
+const MaskPlaceholder = "<masked>"
+
+// CompareOptions relaxes how results are compared.
+type CompareOptions struct {
+	// IgnoreColumns are names of columns to be ignored, case-insensitive.
+	IgnoreColumns []string `json:"ignoreColumns,omitempty"`
+	// Masks are regular expressions, matched parts of values are replaced by MaskPlaceholder.
+	Masks []string `json:"masks,omitempty"`
+	// Precision is the number of digits after the decimal point of FLOAT, DOUBLE and DECIMAL values.
+	Precision int `json:"precision,omitempty"`
+	// Unordered ignores the order of rows.
+	Unordered bool `json:"unordered,omitempty"`
+	// RowCount compares the number of rows only.
+	RowCount bool `json:"rowCount,omitempty"`
+}
+
+func (o CompareOptions) IsZero() bool {
+	return len(o.IgnoreColumns) == 0 && len(o.Masks) == 0 && o.Precision == 0 && !o.Unordered && !o.RowCount
+}
+
+// Merge returns options overridden by x, lists are concatenated.
+func (o CompareOptions) Merge(x *CompareOptions) CompareOptions {
+	if x == nil {
+		return o
+	}
+	o.IgnoreColumns = append(append([]string{}, o.IgnoreColumns...), x.IgnoreColumns...)
+	o.Masks = append(append([]string{}, o.Masks...), x.Masks...)
+	if x.Precision > 0 {
+		o.Precision = x.Precision
+	}
+	o.Unordered = o.Unordered || x.Unordered
+	o.RowCount = o.RowCount || x.RowCount
+	return o
+}
+
+// Validate checks whether masks are valid regular expressions.
+func (o CompareOptions) Validate() error {
+	for _, m := range o.Masks {
+		if _, err := regexp.Compile(m); err != nil {
+			return fmt.Errorf("invalid mask %q: %v", m, err)
+		}
+	}
+	return nil
+}
+
+// Ignored reports whether the column is ignored.
+func (o CompareOptions) Ignored(col string) bool {
+	for _, c := range o.IgnoreColumns {
+		if strings.EqualFold(c, col) {
+			return true
+		}
+	}
+	return false
+}
+
+// MapValue rounds numbers by the precision and then masks the value, typ is the column type, numbers are detected
+// by their contents if it's empty. Use Mapper to map many values.
+func (o CompareOptions) MapValue(raw []byte, typ string) []byte {
+	return o.Mapper().MapValue(raw, typ)
+}
+
+// Mapper compiles masks of the options, invalid masks are skipped.
+func (o CompareOptions) Mapper() ValueMapper {
+	m := ValueMapper{precision: o.Precision}
+	for _, x := range o.Masks {
+		if re, err := regexp.Compile(x); err == nil {
+			m.masks = append(m.masks, re)
+		}
+	}
+	return m
+}
+
+// ValueMapper maps values by compiled compare options, see CompareOptions.MapValue.
+type ValueMapper struct {
+	precision int
+	masks     []*regexp.Regexp
+}
+
+func (m ValueMapper) MapValue(raw []byte, typ string) []byte {
+	if raw == nil {
+		return raw
+	}
+	if m.precision > 0 {
+		isNum := typ == "FLOAT" || typ == "DOUBLE" || typ == "DECIMAL"
+		if len(typ) == 0 {
+			isNum = strings.Contains(string(raw), ".")
+		}
+		if f, err := strconv.ParseFloat(string(raw), 64); isNum && err == nil {
+			raw = []byte(strconv.FormatFloat(f, 'f', m.precision, 64))
+		}
+	}
+	return m.Mask(raw)
+}
+
+// Mask replaces parts matched by masks with MaskPlaceholder.
+func (m ValueMapper) Mask(raw []byte) []byte {
+	for _, re := range m.masks {
+		raw = re.ReplaceAll(raw, []byte(MaskPlaceholder))
+	}
+	return raw
+}
+
+// Apply builds digest options on the base options.
+func (o CompareOptions) Apply(base sqlz.DigestOptions) sqlz.DigestOptions {
+	d := base
+	d.Sort = d.Sort || o.Unordered
+	if len(o.IgnoreColumns) > 0 {
+		filter := base.Filter
+		d.Filter = func(i int, j int, raw []byte, def sqlz.ColumnDef) bool {
+			if o.Ignored(def.Name) {
+				return false
+			}
+			return filter == nil || filter(i, j, raw, def)
+		}
+	}
+	if len(o.Masks) > 0 || o.Precision > 0 {
+		mapper, m := base.Mapper, o.Mapper()
+		d.Mapper = func(i int, j int, raw []byte, def sqlz.ColumnDef) []byte {
+			if mapper != nil && o.Precision == 0 {
+				raw = mapper(i, j, raw, def)
+			}
+			return m.MapValue(raw, def.Type)
+		}
+	}
+	return d
+}
+
+func sameCompareOptions(o1 *CompareOptions, o2 *CompareOptions) bool {
+	if o1 == nil || o2 == nil {
+		return (o1 == nil || o1.IsZero()) && (o2 == nil || o2.IsZero())
+	}
+	return reflect.DeepEqual(*o1, *o2)
+}
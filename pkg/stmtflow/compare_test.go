@@ -0,0 +1,61 @@
+package stmtflow
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zyguan/sqlz"
+	"github.com/zyguan/tidb-test-util/pkg/stmtflow/stmtflowtest"
+)
+
+func TestCompareOptions(t *testing.T) {
+	sql := "select id, v, ts from t"
+	expect := newRet("s1", sql, stmtflowtest.NewRows([]string{"id", "v", "ts"}, []string{"1", "0.1234", "2022-01-01 10:00:00"}, []string{"2", "a", "2022-01-01 10:00:01"}), nil)
+	actual := newRet("s1", sql, stmtflowtest.NewRows([]string{"id", "v", "ts"}, []string{"1", "0.1231", "2022-03-04 11:11:11"}, []string{"2", "a", "2022-03-04 11:11:11"}), nil)
+
+	for _, tt := range []struct {
+		name  string
+		opts  CompareOptions
+		equal bool
+	}{
+		{"default", CompareOptions{}, false},
+		{"ignore", CompareOptions{IgnoreColumns: []string{"TS"}}, false},
+		{"mask", CompareOptions{Masks: []string{`\d{4}-\d\d-\d\d \d\d:\d\d:\d\d`}}, false},
+		{"precision", CompareOptions{Precision: 2}, false},
+		{"ignore+precision", CompareOptions{IgnoreColumns: []string{"ts"}, Precision: 2}, true},
+		{"mask+precision", CompareOptions{Masks: []string{`\d\d:\d\d:\d\d`, `\d{4}-\d\d-\d\d`}, Precision: 2}, true},
+		{"rowcount", CompareOptions{RowCount: true}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, msg := expect.Match(actual, tt.opts)
+			require.Equal(t, tt.equal, ok, msg)
+		})
+	}
+
+	fewer := newRet("s1", sql, stmtflowtest.NewRows([]string{"id", "v", "ts"}, []string{"1", "0.1231", "2022-03-04 11:11:11"}), nil)
+	ok, msg := expect.Match(fewer, CompareOptions{RowCount: true})
+	require.False(t, ok)
+	require.Contains(t, msg, "expect 2 rows, got 1")
+}
+
+func TestCompareOptionsOfStmt(t *testing.T) {
+	stmt := Stmt{Sess: "s1", SQL: "select id from t", Compare: &CompareOptions{Unordered: true}}
+	expect := NewReturnEvent("s1", Return{Stmt: stmt, Res: stmtflowtest.NewRows([]string{"id"}, []string{"1"}, []string{"2"})})
+	actual := NewReturnEvent("s1", Return{Stmt: stmt, Res: stmtflowtest.NewRows([]string{"id"}, []string{"2"}, []string{"1"})})
+	ok, msg := expect.Match(actual, CompareOptions{})
+	require.True(t, ok, msg)
+	ok, _ = expect.EqualTo(actual)
+	require.True(t, ok)
+
+	other := NewReturnEvent("s1", Return{Stmt: Stmt{Sess: "s1", SQL: "select id from t"}, Res: stmtflowtest.NewRows([]string{"id"}, []string{"1"}, []string{"2"})})
+	ok, _ = expect.Match(other, CompareOptions{})
+	require.False(t, ok)
+
+	merged := CompareOptions{IgnoreColumns: []string{"a"}, Precision: 3}.Merge(&CompareOptions{IgnoreColumns: []string{"b"}, Precision: 2, RowCount: true})
+	require.Equal(t, CompareOptions{IgnoreColumns: []string{"a", "b"}, Masks: []string{}, Precision: 2, RowCount: true}, merged)
+	require.Error(t, CompareOptions{Masks: []string{"("}}.Validate())
+
+	d := CompareOptions{Precision: 1}.Apply(DefaultDigestOptions)
+	require.Equal(t, "0.1", string(d.Mapper(0, 0, []byte("0.1234"), sqlz.ColumnDef{Type: "DOUBLE"})))
+	require.Equal(t, "0.1234", string(d.Mapper(0, 0, []byte("0.1234"), sqlz.ColumnDef{Type: "VARCHAR"})))
+}
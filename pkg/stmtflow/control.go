@@ -0,0 +1,139 @@
+package stmtflow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// CtlSession is the session of control steps, which are run by EvalOptions.Controller instead of a connection.
+const CtlSession = "ctl"
+
+// Controller runs commands of control steps, the output is recorded by the control event.
+type Controller interface {
+	Control(ctx context.Context, stmt Stmt) (string, error)
+}
+
+// DefaultController supports commands like:
+//
+//	failpoint enable <name> <term>
+//	failpoint disable <name>
+//	sleep <duration>
+//	exec <shell command>
+//
+// Failpoints are set via the HTTP API (/fail/) of the server the step is bound to. Since test files may come from
+// anywhere, exec is rejected unless AllowExec is set.
+type DefaultController struct {
+	// StatusAddrs are status addresses of servers by endpoint names, "" is for the default server.
+	StatusAddrs map[string]string
+	Client      *http.Client
+	AllowExec   bool
+}
+
+// ErrExecNotAllowed is returned by DefaultController for exec steps if AllowExec is not set.
+var ErrExecNotAllowed = errors.New("exec is not allowed")
+
+func (c *DefaultController) Control(ctx context.Context, stmt Stmt) (string, error) {
+	cmd, args := cutField(stmt.SQL)
+	switch cmd {
+	case "failpoint":
+		op, args := cutField(args)
+		name, term := cutField(args)
+		if len(name) == 0 || op != "enable" && op != "disable" || op == "enable" && len(term) == 0 {
+			return "", errors.New("usage: failpoint enable <name> <term> | failpoint disable <name>")
+		}
+		method := http.MethodPut
+		if op == "disable" {
+			method = http.MethodDelete
+		}
+		return c.failpoint(ctx, stmt.Endpoint, method, name, term)
+	case "sleep":
+		d, err := time.ParseDuration(args)
+		if err != nil {
+			return "", err
+		}
+		select {
+		case <-time.After(d):
+			return "", nil
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	case "exec":
+		if !c.AllowExec {
+			return "", ErrExecNotAllowed
+		}
+		if len(args) == 0 {
+			return "", errors.New("usage: exec <shell command>")
+		}
+		out, err := exec.CommandContext(ctx, "sh", "-c", args).CombinedOutput()
+		return string(out), err
+	default:
+		return "", errors.New("unknown control command: " + cmd)
+	}
+}
+
+func (c *DefaultController) failpoint(ctx context.Context, endpoint string, method string, name string, term string) (string, error) {
+	addr, ok := c.StatusAddrs[endpoint]
+	if !ok || len(addr) == 0 {
+		return "", errors.New("no status address for endpoint: " + endpoint)
+	}
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(addr, "/")+"/fail/"+name, strings.NewReader(term))
+	if err != nil {
+		return "", err
+	}
+	cli := c.Client
+	if cli == nil {
+		cli = http.DefaultClient
+	}
+	resp, err := cli.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("%s %s: %s %s", method, name, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// CtlText formats a control step like `/* ctl: sleep 1s */`.
+func (s Stmt) CtlText() string {
+	sess := s.Sess
+	if len(s.Endpoint) > 0 {
+		sess += "@" + s.Endpoint
+	}
+	return "/* " + sess + ": " + s.SQL + " */"
+}
+
+// cutField splits s into the first field and the rest, both are trimmed.
+func cutField(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	if k := strings.IndexAny(s, " \t\r\n"); k >= 0 {
+		return s[:k], strings.TrimSpace(s[k+1:])
+	}
+	return s, ""
+}
+
+// RunControl runs a control step by c, errors are recorded by the result rather than returned.
+func (s Stmt) RunControl(ctx context.Context, c Controller) Control {
+	ret := Control{Stmt: s, T: [2]time.Time{time.Now(), time.Time{}}}
+	if c == nil {
+		ret.Err = errors.New("no controller")
+	} else {
+		ret.Output, ret.Err = c.Control(ctx, s)
+	}
+	ret.T[1] = time.Now()
+	return ret
+}
@@ -0,0 +1,110 @@
+package stmtflow
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type failpointServer struct {
+	lock sync.Mutex
+	fps  map[string]string
+}
+
+func (s *failpointServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	name := strings.TrimPrefix(r.URL.Path, "/fail/")
+	switch r.Method {
+	case http.MethodPut:
+		term, _ := ioutil.ReadAll(r.Body)
+		s.fps[name] = string(term)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if _, ok := s.fps[name]; !ok {
+			http.Error(w, "failpoint not found", http.StatusBadRequest)
+			return
+		}
+		delete(s.fps, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestDefaultController(t *testing.T) {
+	fps := &failpointServer{fps: map[string]string{}}
+	srv := httptest.NewServer(fps)
+	defer srv.Close()
+
+	ctx := context.Background()
+	c := &DefaultController{StatusAddrs: map[string]string{"": srv.URL, "tidb2": strings.TrimPrefix(srv.URL, "http://")}}
+	ctl := func(sql string, ep string) (string, error) {
+		return c.Control(ctx, Stmt{Sess: CtlSession, SQL: sql, Flags: S_CTL, Endpoint: ep})
+	}
+
+	_, err := ctl("failpoint enable github.com/pingcap/tidb/executor/mockOOM 1*return(true)->pause", "")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"github.com/pingcap/tidb/executor/mockOOM": "1*return(true)->pause"}, fps.fps)
+	_, err = ctl("failpoint disable github.com/pingcap/tidb/executor/mockOOM", "tidb2")
+	require.NoError(t, err)
+	require.Empty(t, fps.fps)
+	_, err = ctl("failpoint disable github.com/pingcap/tidb/executor/mockOOM", "")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failpoint not found")
+	_, err = ctl("failpoint enable github.com/pingcap/tidb/executor/mockOOM", "")
+	require.Error(t, err)
+	_, err = ctl("failpoint enable x return", "tidb3")
+	require.Error(t, err)
+
+	_, err = ctl("exec echo hello", "")
+	require.Equal(t, ErrExecNotAllowed, err)
+	c.AllowExec = true
+	out, err := ctl("exec echo hello", "")
+	require.NoError(t, err)
+	require.Equal(t, "hello\n", out)
+	_, err = ctl("sleep 1ms", "")
+	require.NoError(t, err)
+	_, err = ctl("oops", "")
+	require.Error(t, err)
+}
+
+func TestEvalControlSteps(t *testing.T) {
+	var h History
+	stmts := []Stmt{
+		{Sess: CtlSession, SQL: "exec echo hello", Flags: S_CTL},
+		{Sess: CtlSession, SQL: "sleep oops", Flags: S_CTL},
+	}
+	opts := EvalOptions{Callback: h.Collect, Controller: &DefaultController{AllowExec: true}}
+	require.NoError(t, Run(context.Background(), nil, stmts, opts))
+	require.Len(t, h, 2)
+	require.Equal(t, EventControl, h[0].Kind)
+	require.Equal(t, "hello\n", h[0].Control().Output)
+	require.Error(t, h[1].Control().Err)
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, h.DumpText(buf, TextDumpOptions{}))
+	require.Equal(t, `/* ctl: exec echo hello */
+-- ctl >> ok
+/* ctl: sleep oops */
+-- ctl >> E-1: time: invalid duration "oops"
+`, buf.String())
+
+	js, err := json.Marshal(h)
+	require.NoError(t, err)
+	var h2 History
+	require.NoError(t, json.Unmarshal(js, &h2))
+	require.True(t, DiffHistory(h, h2, CompareOptions{}).Empty())
+
+	h2[1] = NewControlEvent(CtlSession, Control{Stmt: stmts[1]})
+	d := DiffHistory(h, h2, CompareOptions{})
+	require.Equal(t, DiffError, d.Events[0].Reason)
+}
@@ -0,0 +1,366 @@
+package stmtflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/zyguan/sqlz"
+)
+
+const (
+	DiffMissing    = "missing"
+	DiffUnexpected = "unexpected"
+	DiffKind       = "kind"
+	DiffStmt       = "stmt"
+	DiffBlock      = "block"
+	DiffError      = "error"
+	DiffResult     = "result"
+	DiffCaptured   = "captured"
+	DiffOrder      = "order"
+)
+
+// HistoryDiff holds the first divergence of each session, ordered by their positions in histories.
+type HistoryDiff struct {
+	Events []EventDiff `json:"events"`
+}
+
+// EventDiff describes a pair of diverged events. Index is the position of the event in its session, Pos is the
+// position in the whole history.
+type EventDiff struct {
+	Session string    `json:"session"`
+	Index   int       `json:"index"`
+	Pos     int       `json:"pos"`
+	Reason  string    `json:"reason"`
+	Message string    `json:"message"`
+	Expect  *Event    `json:"expect,omitempty"`
+	Actual  *Event    `json:"actual,omitempty"`
+	Rows    *RowsDiff `json:"rows,omitempty"`
+}
+
+// RowsDiff holds rows of diverged result sets, Mismatch lists indexes of rows that differ.
+type RowsDiff struct {
+	Columns       []string   `json:"columns"`
+	ActualColumns []string   `json:"actualColumns,omitempty"`
+	Expect        [][]string `json:"expect"`
+	Actual        [][]string `json:"actual"`
+	Mismatch      []int      `json:"mismatch"`
+}
+
+// DiffHistory aligns events of each session and finds where the actual history diverges from the expected one,
+// results are compared like Event.Match.
+func DiffHistory(expect History, actual History, opts CompareOptions) HistoryDiff {
+	var (
+		d        HistoryDiff
+		sessions []string
+		exp      = map[string][]int{}
+		act      = map[string][]int{}
+	)
+	for i, e := range expect {
+		if _, ok := exp[e.Session]; !ok {
+			sessions = append(sessions, e.Session)
+		}
+		exp[e.Session] = append(exp[e.Session], i)
+	}
+	for i, e := range actual {
+		if _, ok := exp[e.Session]; !ok {
+			if _, ok := act[e.Session]; !ok {
+				sessions = append(sessions, e.Session)
+			}
+		}
+		act[e.Session] = append(act[e.Session], i)
+	}
+	for _, s := range sessions {
+		xs, ys := exp[s], act[s]
+		for i := 0; i < len(xs) || i < len(ys); i++ {
+			var ed *EventDiff
+			if i >= len(ys) {
+				e := expect[xs[i]]
+				ed = &EventDiff{Pos: xs[i], Reason: DiffMissing, Message: "missing " + e.EventMeta.String(), Expect: &e}
+			} else if i >= len(xs) {
+				e := actual[ys[i]]
+				ed = &EventDiff{Pos: ys[i], Reason: DiffUnexpected, Message: "unexpected " + e.EventMeta.String(), Actual: &e}
+			} else if ed = diffEvent(expect[xs[i]], actual[ys[i]], opts); ed != nil {
+				ed.Pos = xs[i]
+			}
+			if ed != nil {
+				ed.Session, ed.Index = s, i
+				d.Events = append(d.Events, *ed)
+				break
+			}
+		}
+	}
+	if len(d.Events) == 0 {
+		// events of each session are the same, but they may be interleaved differently.
+		for i := range expect {
+			if expect[i].EventMeta != actual[i].EventMeta {
+				e1, e2 := expect[i], actual[i]
+				d.Events = append(d.Events, EventDiff{
+					Session: e1.Session, Index: -1, Pos: i, Reason: DiffOrder, Expect: &e1, Actual: &e2,
+					Message: fmt.Sprintf("expect %s, got %s", e1.EventMeta, e2.EventMeta),
+				})
+				break
+			}
+		}
+	}
+	sort.SliceStable(d.Events, func(i, j int) bool { return d.Events[i].Pos < d.Events[j].Pos })
+	return d
+}
+
+func diffEvent(e1 Event, e2 Event, c CompareOptions) *EventDiff {
+	ok, msg := e1.Match(e2, c)
+	if ok {
+		return nil
+	}
+	ed := &EventDiff{Message: msg, Expect: &e1, Actual: &e2}
+	switch {
+	case e1.Kind != e2.Kind:
+		ed.Reason = DiffKind
+	case e1.Kind == EventBlock:
+		ed.Reason = DiffBlock
+	case e1.Kind == EventInvoke:
+		ed.Reason = DiffStmt
+	case e1.Kind == EventTimeout:
+		ed.Reason = DiffStmt
+	case e1.Kind == EventControl:
+		ed.Reason = DiffError
+		if c1, c2 := e1.Control(), e2.Control(); !c1.Stmt.Equal(c2.Stmt) {
+			ed.Reason = DiffStmt
+		}
+	default:
+		r1, r2 := e1.Return(), e2.Return()
+		c = c.Merge(r1.Stmt.Compare)
+		if !r1.Stmt.Equal(r2.Stmt) {
+			ed.Reason = DiffStmt
+		} else if x := diffCaptured(r1, r2, c); len(x) > 0 && strings.HasSuffix(msg, x) {
+			// captured states are compared at last, so results are the same
+			ed.Reason = DiffCaptured
+		} else if r1.Err != nil || r2.Err != nil {
+			ed.Reason = DiffError
+		} else {
+			ed.Reason = DiffResult
+			if !r1.Res.IsExecResult() && !r2.Res.IsExecResult() {
+				o := c.Apply(DefaultDigestOptions)
+				o.Sort = o.Sort || r1.Stmt.Flags&S_UNORDERED > 0
+				ed.Rows = diffRows(r1.Res, r2.Res, o, c.RowCount)
+			}
+		}
+	}
+	return ed
+}
+
+func diffRows(r1 *sqlz.ResultSet, r2 *sqlz.ResultSet, o sqlz.DigestOptions, countOnly bool) *RowsDiff {
+	rd := &RowsDiff{Columns: columnsOf(r1), Mismatch: []int{}}
+	if cols := columnsOf(r2); !sameStrings(rd.Columns, cols) {
+		rd.ActualColumns = cols
+	}
+	var keys1, keys2 []string
+	rd.Expect, keys1 = rowsOf(r1, o)
+	rd.Actual, keys2 = rowsOf(r2, o)
+	for i := 0; i < len(keys1) || i < len(keys2); i++ {
+		if i >= len(keys1) || i >= len(keys2) || !countOnly && keys1[i] != keys2[i] {
+			rd.Mismatch = append(rd.Mismatch, i)
+		}
+	}
+	return rd
+}
+
+func columnsOf(rs *sqlz.ResultSet) []string {
+	cols := make([]string, rs.NCols())
+	for j := range cols {
+		cols[j] = rs.ColumnDef(j).Name
+	}
+	return cols
+}
+
+// rowsOf returns rows for display and keys for comparison, rows are sorted by keys if o.Sort is set.
+func rowsOf(rs *sqlz.ResultSet, o sqlz.DigestOptions) ([][]string, []string) {
+	rows, keys := make([][]string, rs.NRows()), make([]string, rs.NRows())
+	for i := range rows {
+		rows[i] = make([]string, rs.NCols())
+		key := new(strings.Builder)
+		for j := range rows[i] {
+			raw, _ := rs.RawValue(i, j)
+			if raw == nil {
+				rows[i][j] = "NULL"
+			} else {
+				rows[i][j] = string(raw)
+			}
+			if o.Filter != nil && !o.Filter(i, j, raw, rs.ColumnDef(j)) {
+				continue
+			}
+			if o.Mapper != nil && raw != nil {
+				raw = o.Mapper(i, j, raw, rs.ColumnDef(j))
+			}
+			if raw == nil {
+				key.WriteString("\x01NULL")
+			} else {
+				key.WriteString("\x00" + string(raw))
+			}
+		}
+		keys[i] = key.String()
+	}
+	if o.Sort {
+		idx := make([]int, len(rows))
+		for i := range idx {
+			idx[i] = i
+		}
+		sort.SliceStable(idx, func(i, j int) bool { return keys[idx[i]] < keys[idx[j]] })
+		sortedRows, sortedKeys := make([][]string, len(rows)), make([]string, len(keys))
+		for i, k := range idx {
+			sortedRows[i], sortedKeys[i] = rows[k], keys[k]
+		}
+		rows, keys = sortedRows, sortedKeys
+	}
+	return rows, keys
+}
+
+// Where returns the source position of the statement of diverged events, or "" if it's unknown.
+func (ed EventDiff) Where() string {
+	for _, e := range []*Event{ed.Actual, ed.Expect} {
+		if e == nil {
+			continue
+		}
+		if s, ok := e.Statement(); ok && s.Pos != nil {
+			return s.Pos.String()
+		}
+	}
+	return ""
+}
+
+func (d HistoryDiff) Empty() bool { return len(d.Events) == 0 }
+
+func (d HistoryDiff) DumpJson(w io.Writer, opts JsonDumpOptions) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent(opts.Prefix, opts.Indent)
+	return enc.Encode(d)
+}
+
+const (
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorCyan   = "\x1b[36m"
+	colorReset  = "\x1b[0m"
+)
+
+// DumpText writes the diff in a readable form, ANSI colors are used if color is set.
+func (d HistoryDiff) DumpText(w io.Writer, color bool) error {
+	paint := func(c string, s string) string {
+		if !color {
+			return s
+		}
+		return c + s + colorReset
+	}
+	for _, ed := range d.Events {
+		where := fmt.Sprintf("event#%d", ed.Pos)
+		if ed.Index >= 0 {
+			where = fmt.Sprintf("%s event#%d", ed.Session, ed.Index)
+		}
+		if src := ed.Where(); len(src) > 0 {
+			where += " at " + src
+		}
+		if _, err := fmt.Fprintln(w, paint(colorCyan, fmt.Sprintf("@@ %s: %s mismatch @@", where, ed.Reason))); err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "   "+ed.Message)
+		if ed.Rows != nil {
+			fmt.Fprintln(w, "   "+ed.Expect.Return().SQL)
+			ed.Rows.dumpText(w, paint)
+			continue
+		}
+		for _, x := range []struct {
+			e    *Event
+			mark string
+			c    string
+		}{{ed.Expect, "-", colorRed}, {ed.Actual, "+", colorGreen}} {
+			if x.e == nil {
+				continue
+			}
+			buf := new(strings.Builder)
+			x.e.DumpText(buf, TextDumpOptions{Verbose: true})
+			for _, line := range strings.Split(strings.TrimRight(buf.String(), "\n"), "\n") {
+				fmt.Fprintln(w, paint(x.c, x.mark+" "+line))
+			}
+		}
+	}
+	return nil
+}
+
+func (rd *RowsDiff) dumpText(w io.Writer, paint func(c string, s string) string) {
+	actualCols := rd.Columns
+	if rd.ActualColumns != nil {
+		actualCols = rd.ActualColumns
+	}
+	left, right := formatRows(rd.Columns, rd.Expect), formatRows(actualCols, rd.Actual)
+	width := 0
+	for _, l := range left {
+		if n := utf8.RuneCountInString(l); n > width {
+			width = n
+		}
+	}
+	mismatch := make(map[int]bool, len(rd.Mismatch))
+	for _, i := range rd.Mismatch {
+		mismatch[i] = true
+	}
+	fmt.Fprintln(w, "  "+padRight("expect", width)+"   actual")
+	for i := 0; i < len(left) || i < len(right); i++ {
+		l, r, mark := "", "", " "
+		if i < len(left) {
+			l = left[i]
+		}
+		if i < len(right) {
+			r = right[i]
+		}
+		if i < 2 && rd.ActualColumns != nil || i >= 2 && mismatch[i-2] {
+			mark = "!"
+		}
+		line := mark + " " + padRight(l, width) + "   " + r
+		if mark != " " {
+			line = paint(colorYellow, line)
+		}
+		fmt.Fprintln(w, strings.TrimRight(line, " "))
+	}
+}
+
+// formatRows formats a header line, a separator line and then a line for each row.
+func formatRows(cols []string, rows [][]string) []string {
+	widths := make([]int, len(cols))
+	for j, c := range cols {
+		widths[j] = utf8.RuneCountInString(c)
+	}
+	for _, row := range rows {
+		for j, v := range row {
+			if n := utf8.RuneCountInString(v); j < len(widths) && n > widths[j] {
+				widths[j] = n
+			}
+		}
+	}
+	format := func(vals []string) string {
+		buf := new(strings.Builder)
+		buf.WriteString("|")
+		for j, v := range vals {
+			buf.WriteString(" " + padRight(v, widths[j]) + " |")
+		}
+		return buf.String()
+	}
+	seps := make([]string, len(cols))
+	for j := range seps {
+		seps[j] = strings.Repeat("-", widths[j])
+	}
+	lines := []string{format(cols), format(seps)}
+	for _, row := range rows {
+		lines = append(lines, format(row))
+	}
+	return lines
+}
+
+func padRight(s string, width int) string {
+	if n := utf8.RuneCountInString(s); n < width {
+		return s + strings.Repeat(" ", width-n)
+	}
+	return s
+}
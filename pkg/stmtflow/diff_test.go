@@ -0,0 +1,101 @@
+package stmtflow
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zyguan/sqlz"
+	"github.com/zyguan/tidb-test-util/pkg/stmtflow/stmtflowtest"
+)
+
+func newRet(sess string, sql string, rs *sqlz.ResultSet, err error) Event {
+	return NewReturnEvent(sess, Return{Stmt: Stmt{Sess: sess, SQL: sql}, Res: rs, Err: err})
+}
+
+func TestDiffHistory(t *testing.T) {
+	ok := sqlz.NewFromResult(driver.RowsAffected(1))
+	base := History{
+		NewInvokeEvent("s1", Invoke{Stmt: Stmt{Sess: "s1", SQL: "update t set v = 2"}}),
+		newRet("s1", "update t set v = 2", ok, nil),
+		NewInvokeEvent("s2", Invoke{Stmt: Stmt{Sess: "s2", SQL: "select * from t"}}),
+		newRet("s2", "select * from t", stmtflowtest.NewRows([]string{"id", "v"}, []string{"1", "2"}, []string{"2", "2"}), nil),
+	}
+	require.True(t, DiffHistory(base, base, CompareOptions{}).Empty())
+
+	actual := append(History{}, base...)
+	actual[3] = newRet("s2", "select * from t", stmtflowtest.NewRows([]string{"id", "v"}, []string{"1", "2"}, []string{"2", "3"}), nil)
+	d := DiffHistory(base, actual, CompareOptions{})
+	require.Len(t, d.Events, 1)
+	require.Equal(t, DiffResult, d.Events[0].Reason)
+	require.Equal(t, "s2", d.Events[0].Session)
+	require.Equal(t, 1, d.Events[0].Index)
+	require.Equal(t, 3, d.Events[0].Pos)
+	require.Equal(t, []int{1}, d.Events[0].Rows.Mismatch)
+	require.Equal(t, [][]string{{"2", "3"}}, d.Events[0].Rows.Actual[1:])
+
+	actual[1] = newRet("s1", "update t set v = 2", nil, &Error{1213, "deadlock"})
+	d = DiffHistory(base, actual, CompareOptions{})
+	require.Len(t, d.Events, 2)
+	require.Equal(t, DiffError, d.Events[0].Reason)
+	require.Equal(t, DiffResult, d.Events[1].Reason)
+
+	d = DiffHistory(base, History{base[0], NewBlockEvent("s1"), base[2], base[3]}, CompareOptions{})
+	require.Len(t, d.Events, 1)
+	require.Equal(t, DiffKind, d.Events[0].Reason)
+
+	d = DiffHistory(base, base[:3], CompareOptions{})
+	require.Equal(t, DiffMissing, d.Events[0].Reason)
+	require.Nil(t, d.Events[0].Actual)
+
+	d = DiffHistory(base[:2], base, CompareOptions{})
+	require.Len(t, d.Events, 1)
+	require.Equal(t, DiffUnexpected, d.Events[0].Reason)
+	require.Nil(t, d.Events[0].Expect)
+
+	d = DiffHistory(base, History{base[2], base[3], base[0], base[1]}, CompareOptions{})
+	require.Len(t, d.Events, 1)
+	require.Equal(t, DiffOrder, d.Events[0].Reason)
+	require.Equal(t, 0, d.Events[0].Pos)
+}
+
+func TestDiffUnorderedRows(t *testing.T) {
+	expect := History{newRet("s1", "select * from t", stmtflowtest.NewRows([]string{"id"}, []string{"1"}, []string{"2"}), nil)}
+	actual := History{newRet("s1", "select * from t", stmtflowtest.NewRows([]string{"id"}, []string{"2"}, []string{"1"}), nil)}
+	require.Equal(t, DiffResult, DiffHistory(expect, actual, CompareOptions{}).Events[0].Reason)
+	require.True(t, DiffHistory(expect, actual, CompareOptions{Unordered: true}).Empty())
+
+	actual = History{newRet("s1", "select * from t", stmtflowtest.NewRows([]string{"id"}, []string{"3"}, []string{"1"}), nil)}
+	d := DiffHistory(expect, actual, CompareOptions{Unordered: true})
+	require.Equal(t, [][]string{{"1"}, {"3"}}, d.Events[0].Rows.Actual)
+	require.Equal(t, []int{1}, d.Events[0].Rows.Mismatch)
+}
+
+func TestDiffDumpText(t *testing.T) {
+	expect := History{newRet("s1", "select * from t", stmtflowtest.NewRows([]string{"id", "v"}, []string{"1", "a"}), nil)}
+	actual := History{newRet("s1", "select * from t", stmtflowtest.NewRows([]string{"id", "v"}, []string{"1", "bb"}), nil)}
+	buf := new(bytes.Buffer)
+	require.NoError(t, DiffHistory(expect, actual, CompareOptions{}).DumpText(buf, false))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Equal(t, "@@ s1 event#0: result mismatch @@", lines[0])
+	require.Equal(t, []string{
+		"  expect       actual",
+		"  | id | v |   | id | v  |",
+		"  | -- | - |   | -- | -- |",
+		"! | 1  | a |   | 1  | bb |",
+	}, lines[3:])
+
+	buf.Reset()
+	actual = History{newRet("s1", "select * from t", nil, &Error{1105, "oops"})}
+	require.NoError(t, DiffHistory(expect, actual, CompareOptions{}).DumpText(buf, true))
+	require.Contains(t, buf.String(), colorGreen+"+ -- s1 >> E1105: oops"+colorReset)
+
+	buf.Reset()
+	stmt := Stmt{Sess: "s1", SQL: "select * from t", Pos: &Pos{File: "a.t.sql", Line: 3, Col: 1}}
+	expect = History{newRet("s1", "select * from t", stmtflowtest.NewRows([]string{"id"}, []string{"1"}), nil)}
+	actual = History{NewReturnEvent("s1", Return{Stmt: stmt, Res: stmtflowtest.NewRows([]string{"id"}, []string{"2"})})}
+	require.NoError(t, DiffHistory(expect, actual, CompareOptions{}).DumpText(buf, false))
+	require.True(t, strings.HasPrefix(buf.String(), "@@ s1 event#0 at a.t.sql:3:1: result mismatch @@"))
+}
@@ -6,7 +6,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -44,6 +46,21 @@ type Pool struct {
 	wg    sync.WaitGroup
 	conns map[string]*sql.Conn
 	flags map[string]byte
+	ids   map[string]int64
+	// srcs are dbs connections come from, which are used to kill statements through side connections.
+	srcs map[string]*sql.DB
+	// stuck connections might still be in use, they are closed in background.
+	stuck map[string]bool
+}
+
+func NewPool() *Pool {
+	return &Pool{
+		conns: map[string]*sql.Conn{},
+		flags: map[string]byte{},
+		ids:   map[string]int64{},
+		srcs:  map[string]*sql.DB{},
+		stuck: map[string]bool{},
+	}
 }
 
 type BorrowedConn struct {
@@ -93,11 +110,57 @@ func (p *Pool) Return(s string) error {
 	return nil
 }
 
+func (p *Pool) ConnID(s string) (int64, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	id, ok := p.ids[s]
+	return id, ok
+}
+
+// SetConnID records the connection id of a session, which is used by block observers.
+func (p *Pool) SetConnID(s string, id int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.ids[s] = id
+}
+
+// Kill kills the running statement of a session (or the connection if query is false) through a side connection
+// to the same server, the connection id must be known.
+func (p *Pool) Kill(ctx context.Context, s string, query bool) error {
+	p.lock.Lock()
+	id, ok := p.ids[s]
+	src := p.srcs[s]
+	p.lock.Unlock()
+	if !ok || src == nil {
+		return ErrConnNotExist
+	}
+	c, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	target := strconv.FormatInt(id, 10)
+	if query {
+		target = "query " + target
+	}
+	// `kill tidb` always kills on the server in use, fall back to the mysql syntax if it's not supported.
+	_, err = c.ExecContext(ctx, "kill tidb "+target)
+	if e, ok := WrapError(err).(*Error); ok && e.Code == 1064 {
+		_, err = c.ExecContext(ctx, "kill "+target)
+	}
+	return err
+}
+
 func (p *Pool) Wait() { p.wg.Wait() }
 
 func (p *Pool) Close() error {
 	var fstErr error
-	for _, c := range p.conns {
+	for s, c := range p.conns {
+		if p.stuck[s] {
+			// closing a connection in use blocks until the statement returns
+			go c.Close()
+			continue
+		}
 		if err := c.Close(); fstErr == nil && err != nil {
 			fstErr = err
 		}
@@ -105,6 +168,13 @@ func (p *Pool) Close() error {
 	return fstErr
 }
 
+const (
+	// DefaultRetryDelay is the delay before the first retry of a statement without a RetryDelay.
+	DefaultRetryDelay = 10 * time.Millisecond
+	// MaxRetryDelay caps delays between retries.
+	MaxRetryDelay = time.Second
+)
+
 type StmtStatus string
 
 const (
@@ -125,12 +195,106 @@ const (
 	S_QUERY uint = 1 << iota
 	S_WAIT
 	S_UNORDERED
+	// S_WARNINGS, S_EXEC_INFO and S_TXN_STATE ask Poll to capture warnings, exec metadata and the transaction state
+	// after the statement, nothing extra is sent to the server unless they are set.
+	S_WARNINGS
+	S_EXEC_INFO
+	S_TXN_STATE
+	// S_CTL marks a control step, its SQL is a command for EvalOptions.Controller, see CtlSession.
+	S_CTL
+
+	S_CAPTURE = S_WARNINGS | S_EXEC_INFO | S_TXN_STATE
 )
 
 type Stmt struct {
 	Sess  string `json:"s"`
 	SQL   string `json:"q"`
 	Flags uint   `json:"flags,omitempty"`
+
+	// Endpoint is the name of the server the session connects to, see EvalOptions.Endpoints.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// ExpectErrors lists error codes the statement is expected to fail with.
+	ExpectErrors []int `json:"errors,omitempty"`
+	// Retry is the max number of retries if the statement fails with an error in RetryOn (or any error if
+	// RetryOn is empty).
+	Retry   int   `json:"retry,omitempty"`
+	RetryOn []int `json:"retryOn,omitempty"`
+	// RetryDelay is the delay before the first retry, it's doubled for each later retry up to MaxRetryDelay.
+	// DefaultRetryDelay is used if it's 0.
+	RetryDelay time.Duration `json:"retryDelay,omitempty"`
+	// Timeout overrides EvalOptions.BlockTime for the statement.
+	Timeout time.Duration `json:"timeout,omitempty"`
+	// Sleep is the time to wait before sending the statement.
+	Sleep time.Duration `json:"sleep,omitempty"`
+	// Let captures variables after the statement succeeds, they can be referenced as ${name} by later statements.
+	Let []Capture `json:"let,omitempty"`
+	// Compare overrides options to compare results of the statement.
+	Compare *CompareOptions `json:"compare,omitempty"`
+	// Pos is where the statement comes from, it's ignored by Equal and never serialized, since it depends on where
+	// the file is loaded from.
+	Pos *Pos `json:"-"`
+}
+
+// Pos is a position in a source file, Line and Col start from 1.
+type Pos struct {
+	File string `json:"file,omitempty"`
+	Line int    `json:"line"`
+	Col  int    `json:"col"`
+}
+
+func (p Pos) String() string {
+	if len(p.File) == 0 {
+		return fmt.Sprintf("%d:%d", p.Line, p.Col)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Col)
+}
+
+// Where returns the position of the statement, or "" if it's unknown.
+func (s Stmt) Where() string {
+	if s.Pos == nil {
+		return ""
+	}
+	return s.Pos.String()
+}
+
+// Capture binds the value of Expr to Name, the first value of the result set is used if Expr is empty.
+type Capture struct {
+	Name string `json:"name"`
+	Expr string `json:"expr,omitempty"`
+}
+
+func (s Stmt) Equal(other Stmt) bool {
+	return s.Sess == other.Sess && s.SQL == other.SQL && s.Flags == other.Flags && s.Endpoint == other.Endpoint &&
+		sameInts(s.ExpectErrors, other.ExpectErrors) && s.Retry == other.Retry && sameInts(s.RetryOn, other.RetryOn) &&
+		s.RetryDelay == other.RetryDelay && s.Timeout == other.Timeout && s.Sleep == other.Sleep && sameCaptures(s.Let, other.Let) &&
+		sameCompareOptions(s.Compare, other.Compare)
+}
+
+// ShouldRetry reports whether the statement should be retried after the n-th failure with err.
+func (s Stmt) ShouldRetry(n int, err error) bool {
+	if err == nil || n > s.Retry {
+		return false
+	}
+	if len(s.RetryOn) == 0 {
+		return true
+	}
+	return hasInt(s.RetryOn, WrapError(err).(*Error).Code)
+}
+
+// RetryBackoff returns the delay before the n-th retry.
+func (s Stmt) RetryBackoff(n int) time.Duration {
+	d := s.RetryDelay
+	if d <= 0 {
+		d = DefaultRetryDelay
+	}
+	for i := 1; i < n && d < MaxRetryDelay; i++ {
+		d *= 2
+	}
+	if d > MaxRetryDelay {
+		d = MaxRetryDelay
+	}
+	return d
 }
 
 func (s Stmt) Session() string { return s.Sess }
@@ -146,30 +310,89 @@ func (s Stmt) Poll(ctx context.Context, c *BorrowedConn, w time.Duration) (Sessi
 	go func() {
 		defer c.Return()
 
-		if s.Flags&S_QUERY > 0 {
-			t0 := time.Now()
-			rows, err := c.QueryContext(ctx, s.SQL)
-			if err != nil {
-				f <- Return{s, nil, WrapError(err), [2]time.Time{t0, time.Now()}}
-				return
+		t0 := time.Now()
+		for n := 1; ; n++ {
+			res, err := s.exec(ctx, c)
+			if s.ShouldRetry(n, err) {
+				select {
+				case <-time.After(s.RetryBackoff(n)):
+					continue
+				case <-ctx.Done():
+				}
 			}
-			defer rows.Close()
-			res, err := sqlz.ReadFromRows(rows)
-			f <- Return{s, res, WrapError(err), [2]time.Time{t0, time.Now()}}
-		} else {
-			t0 := time.Now()
-			res, err := c.ExecContext(ctx, s.SQL)
-			if err != nil {
-				f <- Return{s, nil, WrapError(err), [2]time.Time{t0, time.Now()}}
-				return
+			ret := Return{Stmt: s, Res: res, Err: WrapError(err), T: [2]time.Time{t0, time.Now()}}
+			// warnings must be read before any other statement
+			if s.Flags&S_WARNINGS > 0 {
+				ret.Warnings = queryWarnings(ctx, c)
+			}
+			if err == nil && len(s.Let) > 0 {
+				ret.Vars = s.capture(ctx, c, res)
+			}
+			if err == nil && s.Flags&S_EXEC_INFO > 0 && res.IsExecResult() {
+				ret.Exec = &ExecInfo{RowsAffected: res.ExecResult().RowsAffected, LastInsertId: res.ExecResult().LastInsertId}
 			}
-			f <- Return{s, sqlz.NewFromResult(res), nil, [2]time.Time{t0, time.Now()}}
+			if s.Flags&S_TXN_STATE > 0 {
+				ret.Txn = queryTxnState(ctx, c)
+			}
+			f <- ret
+			return
 		}
 	}()
 	r := RunningStmt{s, f}
 	return r.Poll(ctx, c, w)
 }
 
+func (s Stmt) exec(ctx context.Context, c *BorrowedConn) (*sqlz.ResultSet, error) {
+	if s.Flags&S_QUERY > 0 {
+		rows, err := c.QueryContext(ctx, s.SQL)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		return sqlz.ReadFromRows(rows)
+	}
+	res, err := c.ExecContext(ctx, s.SQL)
+	if err != nil {
+		return nil, err
+	}
+	return sqlz.NewFromResult(res), nil
+}
+
+func (s Stmt) capture(ctx context.Context, c *BorrowedConn, res *sqlz.ResultSet) map[string]string {
+	var (
+		vars  = map[string]string{}
+		names []string
+		exprs []string
+	)
+	for _, x := range s.Let {
+		if len(x.Expr) == 0 {
+			if v, ok := res.RawValue(0, 0); ok && v != nil {
+				vars[x.Name] = string(v)
+			}
+			continue
+		}
+		names = append(names, x.Name)
+		exprs = append(exprs, x.Expr)
+	}
+	if len(exprs) == 0 {
+		return vars
+	}
+	vals := make([]sql.NullString, len(exprs))
+	dest := make([]interface{}, len(vals))
+	for i := range vals {
+		dest[i] = &vals[i]
+	}
+	if err := c.QueryRowContext(ctx, "select "+strings.Join(exprs, ", ")).Scan(dest...); err != nil {
+		return vars
+	}
+	for i, v := range vals {
+		if v.Valid {
+			vars[names[i]] = v.String
+		}
+	}
+	return vars
+}
+
 type RunningStmt struct {
 	Stmt
 	future <-chan Return
@@ -209,19 +432,48 @@ func (s CompletedStmt) Poll(ctx context.Context, c *BorrowedConn, w time.Duratio
 	return s, nil
 }
 
-type Block struct{}
+type Block struct {
+	BlockedBy []string
+}
 
 type Resume struct{}
 
 type Invoke struct {
 	Stmt
+	// Exec is the SQL actually sent to the server if variables are substituted.
+	Exec string
 }
 
 type Return struct {
 	Stmt
-	Res *sqlz.ResultSet
-	Err error
-	T   [2]time.Time
+	Res  *sqlz.ResultSet
+	Err  error
+	T    [2]time.Time
+	Vars map[string]string
+
+	// Warnings, Exec and Txn are captured only if the statement asks for them, see S_CAPTURE.
+	Warnings []Warning
+	Exec     *ExecInfo
+	Txn      *TxnState
+}
+
+// Timeout is the terminal event of an evaluation interrupted by its context, statements which have not returned
+// are listed.
+type Timeout struct {
+	Err     error
+	Running []Stmt
+	Pending []Stmt
+	T       time.Time
+}
+
+// Control is the result of a control step.
+type Control struct {
+	Stmt
+	// Exec is the command actually run if variables are substituted.
+	Exec   string
+	Output string
+	Err    error
+	T      [2]time.Time
 }
 
 type Waitable interface{ Wait() }
@@ -235,6 +487,31 @@ type EvalOptions struct {
 	PingTime  time.Duration
 	BlockTime time.Duration
 	Callback  func(e Event)
+	Observer  BlockObserver
+	// Endpoints are named servers sessions can be bound to, sessions without an endpoint connect to the default db.
+	Endpoints map[string]*sql.DB
+	// Controller runs control steps.
+	Controller Controller
+	// Sessions are settings of sessions, which are applied when their connections are opened.
+	Sessions map[string]SessionOptions
+	// OnSession is called with the info of each session once its connection is ready.
+	OnSession func(s string, info SessionInfo)
+	// KillOnAbort kills running statements after an evaluation is interrupted, otherwise they are waited for until
+	// CloseTime and then given up.
+	KillOnAbort bool
+	// CloseTime bounds the time to kill running statements after an evaluation is interrupted, DefaultCloseTime is
+	// used if it's not set.
+	CloseTime time.Duration
+	// Sink receives events after Callback, the first error of it fails the evaluation once statements are done.
+	Sink EventSink
+	// Source names the evaluation for Sink.
+	Source string
+}
+
+// NeedsConnID reports whether connection ids of sessions are required, they are used by block observers and for
+// killing running statements.
+func (opts EvalOptions) NeedsConnID() bool {
+	return opts.Observer != nil || opts.KillOnAbort
 }
 
 func Run(ctx context.Context, db *sql.DB, stmts []Stmt, opts EvalOptions) error {
@@ -247,7 +524,7 @@ func Run(ctx context.Context, db *sql.DB, stmts []Stmt, opts EvalOptions) error
 }
 
 func Eval(ctx context.Context, db *sql.DB, stmts []Stmt, opts EvalOptions) (WaitableCloser, error) {
-	pool, head, err := initForEval(ctx, db, stmts)
+	pool, head, err := initForEval(ctx, db, stmts, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -255,6 +532,36 @@ func Eval(ctx context.Context, db *sql.DB, stmts []Stmt, opts EvalOptions) (Wait
 	if callback == nil {
 		callback = func(_ Event) {}
 	}
+	var sinkErr error
+	if opts.Sink != nil {
+		cb := callback
+		callback = func(e Event) {
+			cb(e)
+			if err := opts.Sink.Send(opts.Source, e); err != nil && sinkErr == nil {
+				sinkErr = err
+			}
+		}
+	}
+	if err = eval(ctx, db, pool, head, opts, callback); err != nil {
+		abort(ctx, pool, head, err, opts, callback)
+	} else if sinkErr != nil {
+		err = fmt.Errorf("send event: %w", sinkErr)
+	}
+	return pool, err
+}
+
+func eval(ctx context.Context, db *sql.DB, pool *Pool, head *stmtNode, opts EvalOptions, callback func(Event)) (err error) {
+	var stmts []Stmt
+	for p := head.next; p != nil; p = p.next {
+		stmts = append(stmts, p.origin)
+	}
+	vars, subst := map[string]string{}, DeclaresVars(stmts)
+	substitute := func(sql string) (string, error) {
+		if !subst {
+			return sql, nil
+		}
+		return Substitute(sql, vars)
+	}
 	for head.next != nil {
 		for p := head; p.next != nil; p = p.next {
 			stmt := p.next.stmt
@@ -271,29 +578,67 @@ func Eval(ctx context.Context, db *sql.DB, stmts []Stmt, opts EvalOptions) (Wait
 					case <-done:
 						p.waited = true
 					case <-ctx.Done():
-						return pool, ctx.Err()
+						return ctx.Err()
 					}
 					break
 				}
+				if stmt.Statement().Flags&S_CTL > 0 {
+					ctl := stmt.Statement()
+					if ctl.SQL, err = substitute(ctl.SQL); err != nil {
+						return err
+					}
+					ret := ctl.RunControl(ctx, opts.Controller)
+					if ret.Stmt = p.next.origin; ctl.SQL != ret.SQL {
+						ret.Exec = ctl.SQL
+					}
+					callback(NewControlEvent(ctl.Session(), ret))
+					p.next = p.next.next
+					break
+				}
 				c, err := pool.Borrow(stmt.Session())
 				if err != nil {
 					if err == ErrConnBorrowed {
 						continue
 					}
-					return pool, err
+					return err
+				}
+				if d := stmt.Statement().Sleep; d > 0 {
+					select {
+					case <-time.After(d):
+					case <-ctx.Done():
+						c.Return()
+						return ctx.Err()
+					}
+				}
+				blockTime := opts.BlockTime
+				if d := stmt.Statement().Timeout; d > 0 {
+					blockTime = d
 				}
-				callback(NewInvokeEvent(stmt.Session(), Invoke{stmt.Statement()}))
-				s, err := stmt.Poll(ctx, c, opts.BlockTime)
+				inv := Invoke{Stmt: p.next.origin}
+				if exec, err := substitute(inv.SQL); err != nil {
+					c.Return()
+					return err
+				} else if exec != inv.SQL {
+					inv.Exec = exec
+					substituted := inv.Stmt
+					substituted.SQL = exec
+					stmt = substituted
+				}
+				callback(NewInvokeEvent(stmt.Session(), inv))
+				s, err := stmt.Poll(ctx, c, blockTime)
 				if err != nil {
-					if err == ErrPollTimeout {
-						callback(NewBlockEvent(stmt.Session()))
+					// the statement is running unless it's not sent at all
+					if s != nil {
 						p.next.stmt = s
+					}
+					if err == ErrPollTimeout {
+						callback(NewBlockEvent(stmt.Session(), observeBlock(ctx, db, pool, stmt.Session(), opts.Observer)...))
 						continue
 					}
-					return pool, err
+					return err
 				}
 				// Assert typeof(s) == CompletedStmt
-				callback(NewReturnEvent(stmt.Session(), s.Result()))
+				callback(NewReturnEvent(stmt.Session(), p.next.returned(s.Result(), vars)))
 				p.next = p.next.next
 				pool.Return(s.Session())
 				break
@@ -304,48 +649,154 @@ func Eval(ctx context.Context, db *sql.DB, stmts []Stmt, opts EvalOptions) (Wait
 						p.next.stmt = s
 						continue
 					}
-					return pool, err
+					return err
 				}
 				// Assert typeof(s) == CompletedStmt
 				callback(NewResumeEvent(stmt.Session()))
-				callback(NewReturnEvent(stmt.Session(), s.Result()))
+				callback(NewReturnEvent(stmt.Session(), p.next.returned(s.Result(), vars)))
 				p.next = p.next.next
 				pool.Return(s.Session())
 				break
 			} else {
-				return pool, errors.New("invalid statement status: " + string(stmt.Status()))
+				return errors.New("invalid statement status: " + string(stmt.Status()))
 			}
 		}
 	}
-	return pool, nil
+	return nil
+}
+
+func sameInts(xs []int, ys []int) bool {
+	if len(xs) != len(ys) {
+		return false
+	}
+	for i := range xs {
+		if xs[i] != ys[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func hasInt(xs []int, x int) bool {
+	for _, y := range xs {
+		if x == y {
+			return true
+		}
+	}
+	return false
 }
 
 type stmtNode struct {
 	stmt SessionStmt
 	next *stmtNode
 
+	origin Stmt
 	waited bool
 }
 
-func initForEval(ctx context.Context, db *sql.DB, stmts []Stmt) (*Pool, *stmtNode, error) {
-	p := &Pool{
-		conns: map[string]*sql.Conn{},
-		flags: map[string]byte{},
+// returned restores the original statement of a result and collects captured variables.
+func (n *stmtNode) returned(ret Return, vars map[string]string) Return {
+	ret.Stmt = n.origin
+	for k, v := range ret.Vars {
+		vars[k] = v
+	}
+	return ret
+}
+
+var varPattern = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// DeclaresVars reports whether any of stmts captures variables. References are substituted only for tests declaring
+// variables, so that `${` in sql of other tests is sent as is.
+func DeclaresVars(stmts []Stmt) bool {
+	for _, stmt := range stmts {
+		if len(stmt.Let) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Substitute replaces ${name} in sql by values of vars.
+func Substitute(sql string, vars map[string]string) (string, error) {
+	var err error
+	out := varPattern.ReplaceAllStringFunc(sql, func(ref string) string {
+		name := ref[2 : len(ref)-1]
+		v, ok := vars[name]
+		if !ok && err == nil {
+			err = errors.New("undefined variable: " + name)
+		}
+		return v
+	})
+	return out, err
+}
+
+func sameCaptures(xs []Capture, ys []Capture) bool {
+	if len(xs) != len(ys) {
+		return false
+	}
+	for i := range xs {
+		if xs[i] != ys[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func initForEval(ctx context.Context, db *sql.DB, stmts []Stmt, opts EvalOptions) (*Pool, *stmtNode, error) {
+	p := NewPool()
+	eps := make(map[string]string, 2)
+	for _, stmt := range stmts {
+		s := stmt.Session()
+		if stmt.Flags&S_CTL > 0 {
+			continue
+		} else if ep, ok := eps[s]; !ok || len(ep) == 0 {
+			eps[s] = stmt.Endpoint
+		} else if len(stmt.Endpoint) > 0 && stmt.Endpoint != ep {
+			return nil, nil, errors.New("session " + s + " is bound to both " + ep + " and " + stmt.Endpoint)
+		}
 	}
 	h := &stmtNode{}
 	m := make(map[string]bool, 2)
 	for i := len(stmts) - 1; i >= 0; i-- {
 		stmt := stmts[i]
 		s := stmt.Session()
-		h.next = &stmtNode{stmt, h.next, false}
-		if !m[s] {
-			c, err := db.Conn(ctx)
+		h.next = &stmtNode{stmt, h.next, stmt, false}
+		if !m[s] && stmt.Flags&S_CTL == 0 {
+			src := db
+			if ep := eps[s]; len(ep) > 0 {
+				if src = opts.Endpoints[ep]; src == nil {
+					return nil, nil, errors.New("unknown endpoint: " + ep)
+				}
+			}
+			so := opts.Sessions[s]
+			if so.Source != nil {
+				src = so.Source
+			}
+			c, err := src.Conn(ctx)
 			if err != nil {
 				return nil, nil, err
 			}
 			if err = p.Put(s, c); err != nil {
 				return nil, nil, err
 			}
+			p.srcs[s] = src
+			var id int64
+			if opts.NeedsConnID() || opts.OnSession != nil {
+				if err = c.QueryRowContext(ctx, "select connection_id()").Scan(&id); err != nil {
+					return nil, nil, err
+				}
+				p.SetConnID(s, id)
+			}
+			if err = so.apply(ctx, c); err != nil {
+				return nil, nil, fmt.Errorf("setup session %s: %w", s, err)
+			}
+			if opts.OnSession != nil {
+				info, err := so.describe(ctx, c, id)
+				if err != nil {
+					return nil, nil, fmt.Errorf("describe session %s: %w", s, err)
+				}
+				opts.OnSession(s, info)
+			}
 			m[s] = true
 		}
 	}
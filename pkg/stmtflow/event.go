@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
 	"time"
 
@@ -16,14 +17,20 @@ import (
 )
 
 const (
-	EventBlock  = "Block"
-	EventResume = "Resume"
-	EventInvoke = "Invoke"
-	EventReturn = "Return"
+	EventBlock   = "Block"
+	EventResume  = "Resume"
+	EventInvoke  = "Invoke"
+	EventReturn  = "Return"
+	EventControl = "Control"
+	EventTimeout = "Timeout"
 )
 
-func NewBlockEvent(s string) Event {
-	return Event{EventMeta: EventMeta{EventBlock, s}}
+func NewBlockEvent(s string, blockedBy ...string) Event {
+	e := Event{EventMeta: EventMeta{EventBlock, s}}
+	if len(blockedBy) > 0 {
+		e.blk = &Block{BlockedBy: blockedBy}
+	}
+	return e
 }
 
 func NewResumeEvent(s string) Event {
@@ -38,6 +45,15 @@ func NewReturnEvent(s string, ret Return) Event {
 	return Event{EventMeta: EventMeta{EventReturn, s}, ret: &ret}
 }
 
+func NewControlEvent(s string, ctl Control) Event {
+	return Event{EventMeta: EventMeta{EventControl, s}, ctl: &ctl}
+}
+
+// NewTimeoutEvent makes the terminal event of an interrupted evaluation, it doesn't belong to any session.
+func NewTimeoutEvent(t Timeout) Event {
+	return Event{EventMeta: EventMeta{EventTimeout, ""}, tmo: &t}
+}
+
 type EventMeta struct {
 	Kind    string `json:"kind"`
 	Session string `json:"session"`
@@ -49,34 +65,72 @@ func (e EventMeta) String() string {
 
 type Event struct {
 	EventMeta
+	blk *Block
 	inv *Invoke
 	ret *Return
+	ctl *Control
+	tmo *Timeout
+}
+
+type eventBlock struct {
+	EventMeta
+	BlockedBy []string `json:"blockedBy,omitempty"`
 }
 
 type eventInvoke struct {
 	EventMeta
-	Stmt Stmt `json:"stmt"`
+	Stmt Stmt   `json:"stmt"`
+	Exec string `json:"exec,omitempty"`
 }
 
 type eventReturn struct {
 	EventMeta
-	Stmt   Stmt            `json:"stmt"`
-	T      []int64         `json:"t"`
-	Data   [][]interface{} `json:"data,omitempty"`
-	Result *string         `json:"result,omitempty"`
-	Error  *Error          `json:"error,omitempty"`
+	Stmt   Stmt              `json:"stmt"`
+	T      []int64           `json:"t"`
+	Data   [][]interface{}   `json:"data,omitempty"`
+	Result *string           `json:"result,omitempty"`
+	Error  *Error            `json:"error,omitempty"`
+	Vars   map[string]string `json:"vars,omitempty"`
+
+	Warnings []Warning `json:"warnings,omitempty"`
+	Exec     *ExecInfo `json:"exec,omitempty"`
+	Txn      *TxnState `json:"txn,omitempty"`
+}
+
+type eventTimeout struct {
+	EventMeta
+	T       int64  `json:"t"`
+	Error   *Error `json:"error,omitempty"`
+	Running []Stmt `json:"running,omitempty"`
+	Pending []Stmt `json:"pending,omitempty"`
+}
+
+type eventControl struct {
+	EventMeta
+	Stmt   Stmt    `json:"stmt"`
+	Exec   string  `json:"exec,omitempty"`
+	T      []int64 `json:"t"`
+	Output string  `json:"output,omitempty"`
+	Error  *Error  `json:"error,omitempty"`
 }
 
 func (e Event) MarshalJSON() ([]byte, error) {
 	switch e.Kind {
-	case EventBlock, EventResume:
+	case EventBlock:
+		blk := eventBlock{EventMeta: e.EventMeta}
+		if e.blk != nil {
+			blk.BlockedBy = e.blk.BlockedBy
+		}
+		return json.Marshal(blk)
+	case EventResume:
 		return json.Marshal(e.EventMeta)
 	case EventInvoke:
-		inv := eventReturn{EventMeta: e.EventMeta}
+		inv := eventInvoke{EventMeta: e.EventMeta}
 		if e.inv == nil {
 			return nil, errors.New("invoke data is missing")
 		}
 		inv.Stmt = e.inv.Stmt
+		inv.Exec = e.inv.Exec
 		return json.Marshal(inv)
 	case EventReturn:
 		ret := eventReturn{EventMeta: e.EventMeta}
@@ -85,6 +139,8 @@ func (e Event) MarshalJSON() ([]byte, error) {
 		}
 		ret.Stmt = e.ret.Stmt
 		ret.T = []int64{e.ret.T[0].UnixNano(), e.ret.T[1].UnixNano()}
+		ret.Vars = e.ret.Vars
+		ret.Warnings, ret.Exec, ret.Txn = e.ret.Warnings, e.ret.Exec, e.ret.Txn
 		if err := e.ret.Err; err != nil {
 			ret.Error = WrapError(err).(*Error)
 			return json.Marshal(ret)
@@ -109,6 +165,25 @@ func (e Event) MarshalJSON() ([]byte, error) {
 			}
 		}
 		return json.Marshal(ret)
+	case EventControl:
+		if e.ctl == nil {
+			return nil, errors.New("control data is missing")
+		}
+		ctl := eventControl{EventMeta: e.EventMeta, Stmt: e.ctl.Stmt, Exec: e.ctl.Exec, Output: e.ctl.Output}
+		ctl.T = []int64{e.ctl.T[0].UnixNano(), e.ctl.T[1].UnixNano()}
+		if e.ctl.Err != nil {
+			ctl.Error = WrapError(e.ctl.Err).(*Error)
+		}
+		return json.Marshal(ctl)
+	case EventTimeout:
+		if e.tmo == nil {
+			return nil, errors.New("timeout data is missing")
+		}
+		tmo := eventTimeout{EventMeta: e.EventMeta, T: e.tmo.T.UnixNano(), Running: e.tmo.Running, Pending: e.tmo.Pending}
+		if e.tmo.Err != nil {
+			tmo.Error = WrapError(e.tmo.Err).(*Error)
+		}
+		return json.Marshal(tmo)
 	default:
 		return nil, errors.New("unknown event: " + e.Kind)
 	}
@@ -122,14 +197,23 @@ func (e *Event) UnmarshalJSON(data []byte) error {
 	}
 	e.EventMeta = meta
 	switch e.Kind {
-	case EventBlock, EventResume:
+	case EventBlock:
+		var blk eventBlock
+		if err = json.Unmarshal(data, &blk); err != nil {
+			return err
+		}
+		if len(blk.BlockedBy) > 0 {
+			e.blk = &Block{BlockedBy: blk.BlockedBy}
+		}
+		return nil
+	case EventResume:
 		return nil
 	case EventInvoke:
 		var inv eventInvoke
 		if err = json.Unmarshal(data, &inv); err != nil {
 			return err
 		}
-		e.inv = &Invoke{Stmt: inv.Stmt}
+		e.inv = &Invoke{Stmt: inv.Stmt, Exec: inv.Exec}
 		return nil
 	case EventReturn:
 		var ret eventReturn
@@ -138,6 +222,11 @@ func (e *Event) UnmarshalJSON(data []byte) error {
 		}
 		e.ret = &Return{}
 		e.ret.Stmt = ret.Stmt
+		e.ret.Vars = ret.Vars
+		e.ret.Warnings, e.ret.Exec, e.ret.Txn = ret.Warnings, ret.Exec, ret.Txn
+		if ret.Stmt.Flags&S_WARNINGS > 0 && ret.Warnings == nil {
+			e.ret.Warnings = []Warning{}
+		}
 		if len(ret.T) > 0 {
 			e.ret.T[0] = time.Unix(0, ret.T[0])
 		}
@@ -157,28 +246,87 @@ func (e *Event) UnmarshalJSON(data []byte) error {
 		}
 		e.ret.Res = new(sqlz.ResultSet)
 		return e.ret.Res.Decode(raw)
+	case EventControl:
+		var ctl eventControl
+		if err = json.Unmarshal(data, &ctl); err != nil {
+			return err
+		}
+		e.ctl = &Control{Stmt: ctl.Stmt, Exec: ctl.Exec, Output: ctl.Output}
+		if len(ctl.T) > 1 {
+			e.ctl.T = [2]time.Time{time.Unix(0, ctl.T[0]), time.Unix(0, ctl.T[1])}
+		}
+		if ctl.Error != nil {
+			e.ctl.Err = ctl.Error
+		}
+		return nil
+	case EventTimeout:
+		var tmo eventTimeout
+		if err = json.Unmarshal(data, &tmo); err != nil {
+			return err
+		}
+		e.tmo = &Timeout{Running: tmo.Running, Pending: tmo.Pending, T: time.Unix(0, tmo.T)}
+		if tmo.Error != nil {
+			e.tmo.Err = tmo.Error
+		}
+		return nil
 	default:
 		return errors.New("unknown event: " + e.Kind)
 	}
 }
 
 func (e *Event) EqualTo(other Event, opts ...sqlz.DigestOptions) (bool, string) {
+	var o sqlz.DigestOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	return e.equalTo(other, o, CompareOptions{})
+}
+
+// Match is like EqualTo, but results are compared by DefaultDigestOptions relaxed by the given options, which are
+// overridden by options of the expected statement.
+func (e *Event) Match(other Event, opts CompareOptions) (bool, string) {
+	return e.equalTo(other, DefaultDigestOptions, opts)
+}
+
+// whereOf returns the position of the actual statement, expected statements usually come from json which drops
+// positions.
+func whereOf(actual Stmt, expect Stmt) string {
+	if pos := actual.Where(); len(pos) > 0 {
+		return pos
+	}
+	return expect.Where()
+}
+
+func (e *Event) equalTo(other Event, o sqlz.DigestOptions, c CompareOptions) (bool, string) {
 	if e.EventMeta != other.EventMeta {
 		return false, fmt.Sprintf("expect %+v, got %+v", e.EventMeta, other.EventMeta)
 	}
 	tag := e.EventMeta.String()
-	if e.Kind == EventInvoke {
+	if e.Kind == EventBlock {
+		// blockers are only checked when they are expected explicitly
+		thisBlk, thatBlk := e.Block(), other.Block()
+		if len(thisBlk.BlockedBy) > 0 && !sameStrings(thisBlk.BlockedBy, thatBlk.BlockedBy) {
+			return false, fmt.Sprintf(tag+": expect blocked by %v, got %v", thisBlk.BlockedBy, thatBlk.BlockedBy)
+		}
+	} else if e.Kind == EventInvoke {
 		thisInv, thatInv := e.Invoke(), other.Invoke()
 		tag += "(" + thisInv.Stmt.SQL + ")"
-		if thisInv.Stmt != thatInv.Stmt {
+		if pos := whereOf(thatInv.Stmt, thisInv.Stmt); len(pos) > 0 {
+			tag += " at " + pos
+		}
+		if !thisInv.Stmt.Equal(thatInv.Stmt) {
 			return false, fmt.Sprintf(tag+": expect %+v, got %+v", thisInv.Stmt, thatInv.Stmt)
 		}
 	} else if e.Kind == EventReturn {
 		thisRet, thatRet := e.Return(), other.Return()
 		tag += "(" + thisRet.Stmt.SQL + ")"
-		if thisRet.Stmt != thatRet.Stmt {
+		if pos := whereOf(thatRet.Stmt, thisRet.Stmt); len(pos) > 0 {
+			tag += " at " + pos
+		}
+		if !thisRet.Stmt.Equal(thatRet.Stmt) {
 			return false, fmt.Sprintf(tag+": expect %+v, got %+v", thisRet.Stmt, thatRet.Stmt)
 		}
+		c = c.Merge(thisRet.Stmt.Compare)
 		if thisRet.Err != nil {
 			if thatRet.Err == nil {
 				return false, fmt.Sprintf(tag+": expect (%s), got ok", thisRet.Err.Error())
@@ -195,12 +343,13 @@ func (e *Event) EqualTo(other Event, opts ...sqlz.DigestOptions) (bool, string)
 			if r1.IsExecResult() != r2.IsExecResult() {
 				return false, fmt.Sprintf(tag+": expect [%s], got [%s]", r1, r2)
 			}
-			if !r1.IsExecResult() {
-				var o sqlz.DigestOptions
-				if len(opts) > 0 {
-					o = opts[0]
+			if !r1.IsExecResult() && c.RowCount {
+				if r1.NRows() != r2.NRows() {
+					return false, fmt.Sprintf(tag+": expect %d rows, got %d", r1.NRows(), r2.NRows())
 				}
+			} else if !r1.IsExecResult() {
 				h1, h2 := "", ""
+				o = c.Apply(o)
 				o.Sort = o.Sort || thisRet.Stmt.Flags&S_UNORDERED > 0
 				h1 = r1.DataDigest(o)
 				h2 = r2.DataDigest(o)
@@ -209,14 +358,66 @@ func (e *Event) EqualTo(other Event, opts ...sqlz.DigestOptions) (bool, string)
 				}
 			}
 		}
+		if msg := diffCaptured(thisRet, thatRet, c); len(msg) > 0 {
+			return false, tag + ": " + msg
+		}
+	} else if e.Kind == EventControl {
+		// outputs are not compared, they are usually not deterministic
+		thisCtl, thatCtl := e.Control(), other.Control()
+		tag += "(" + thisCtl.Stmt.SQL + ")"
+		if pos := whereOf(thatCtl.Stmt, thisCtl.Stmt); len(pos) > 0 {
+			tag += " at " + pos
+		}
+		if !thisCtl.Stmt.Equal(thatCtl.Stmt) {
+			return false, fmt.Sprintf(tag+": expect %+v, got %+v", thisCtl.Stmt, thatCtl.Stmt)
+		}
+		if thisCtl.Err == nil && thatCtl.Err != nil {
+			return false, fmt.Sprintf(tag+": expect ok, got (%s)", thatCtl.Err.Error())
+		} else if thisCtl.Err != nil && thatCtl.Err == nil {
+			return false, fmt.Sprintf(tag+": expect (%s), got ok", thisCtl.Err.Error())
+		}
+	} else if e.Kind == EventTimeout {
+		// statements left are compared, errors are not since they depend on how the context is done
+		thisTmo, thatTmo := e.Timeout(), other.Timeout()
+		if !sameStmts(thisTmo.Running, thatTmo.Running) {
+			return false, fmt.Sprintf(tag+": expect running %s, got %s", stmtsText(thisTmo.Running), stmtsText(thatTmo.Running))
+		}
+		if !sameStmts(thisTmo.Pending, thatTmo.Pending) {
+			return false, fmt.Sprintf(tag+": expect pending %s, got %s", stmtsText(thisTmo.Pending), stmtsText(thatTmo.Pending))
+		}
 	}
 	return true, ""
 }
 
+func (e *Event) Block() Block {
+	if e.blk == nil {
+		return Block{}
+	}
+	return *e.blk
+}
+
 func (e *Event) Invoke() Invoke { return *e.inv }
 
 func (e *Event) Return() Return { return *e.ret }
 
+func (e *Event) Control() Control { return *e.ctl }
+
+func (e *Event) Timeout() Timeout { return *e.tmo }
+
+// Statement returns the statement of an invoke, return or control event.
+func (e *Event) Statement() (Stmt, bool) {
+	switch {
+	case e.Kind == EventInvoke && e.inv != nil:
+		return e.inv.Stmt, true
+	case e.Kind == EventReturn && e.ret != nil:
+		return e.ret.Stmt, true
+	case e.Kind == EventControl && e.ctl != nil:
+		return e.ctl.Stmt, true
+	default:
+		return Stmt{}, false
+	}
+}
+
 func (e *Event) DumpText(w io.Writer, opts TextDumpOptions) {
 	switch e.Kind {
 	case EventInvoke:
@@ -250,17 +451,56 @@ func (e *Event) DumpText(w io.Writer, opts TextDumpOptions) {
 			} else {
 				fmt.Fprintf(w, "-- %s >> %s\n", e.Session, ret.Res.String())
 			}
-			if opts.WithLat {
-				fmt.Fprintf(w, "-- %s    %s ~ %s (cost %s)\n", e.Session,
-					ret.T[0].Format("15:04:05.000"), ret.T[1].Format("15:04:05.000"), ret.T[1].Sub(ret.T[0]))
-			}
 		} else {
 			fmt.Fprintf(w, "-- %s >> %s\n", e.Session, ret.Err.Error())
 		}
+		for _, warn := range ret.Warnings {
+			fmt.Fprintf(w, "-- %s    %s\n", e.Session, warn)
+		}
+		if x := ret.Exec; x != nil {
+			fmt.Fprintf(w, "-- %s    rows affected %d, last insert id %d\n", e.Session, x.RowsAffected, x.LastInsertId)
+		}
+		if x := ret.Txn; x != nil && x.Active {
+			fmt.Fprintf(w, "-- %s    in transaction\n", e.Session)
+		} else if x != nil {
+			fmt.Fprintf(w, "-- %s    not in transaction\n", e.Session)
+		}
+		if ret.Err == nil && opts.WithLat {
+			fmt.Fprintf(w, "-- %s    %s ~ %s (cost %s)\n", e.Session,
+				ret.T[0].Format("15:04:05.000"), ret.T[1].Format("15:04:05.000"), ret.T[1].Sub(ret.T[0]))
+		}
 	case EventBlock:
-		fmt.Fprintf(w, "-- %s >> blocked\n", e.Session)
+		if blk := e.Block(); len(blk.BlockedBy) > 0 && opts.WithBlockers {
+			fmt.Fprintf(w, "-- %s >> blocked by %s\n", e.Session, strings.Join(blk.BlockedBy, ", "))
+		} else {
+			fmt.Fprintf(w, "-- %s >> blocked\n", e.Session)
+		}
 	case EventResume:
 		fmt.Fprintf(w, "-- %s >> resumed\n", e.Session)
+	case EventTimeout:
+		tmo := e.Timeout()
+		msg := "timeout"
+		if tmo.Err != nil {
+			msg += ": " + WrapError(tmo.Err).(*Error).Message
+		}
+		fmt.Fprintf(w, "-- %s\n", msg)
+		for _, x := range []struct {
+			state string
+			stmts []Stmt
+		}{{"running", tmo.Running}, {"pending", tmo.Pending}} {
+			for _, s := range x.stmts {
+				fmt.Fprintf(w, "--    %s %s: %s\n", x.state, s.Sess, s.SQL)
+			}
+		}
+	case EventControl:
+		ctl := e.Control()
+		fmt.Fprintln(w, ctl.Stmt.CtlText())
+		// outputs are not compared (see equalTo), so they are not dumped either, they are kept by json only
+		if ctl.Err != nil {
+			fmt.Fprintf(w, "-- %s >> %s\n", e.Session, WrapError(ctl.Err).Error())
+		} else {
+			fmt.Fprintf(w, "-- %s >> ok\n", e.Session)
+		}
 	}
 }
 
@@ -295,17 +535,41 @@ type History []Event
 type JsonDumpOptions struct {
 	Prefix string
 	Indent string
+	// Sessions are dumped as metadata of the history if it's not empty, see HistoryFile.
+	Sessions Sessions
 }
 
 func (h History) DumpJson(w io.Writer, opts JsonDumpOptions) error {
 	enc := json.NewEncoder(w)
 	enc.SetIndent(opts.Prefix, opts.Indent)
+	if len(opts.Sessions) > 0 {
+		return enc.Encode(HistoryFile{Sessions: opts.Sessions, History: h})
+	}
 	return enc.Encode(h)
 }
 
+// HistoryFile is a history with its metadata, it's how a history is dumped with sessions. A plain history (an array
+// of events) is decoded as a file without metadata.
+type HistoryFile struct {
+	Sessions Sessions `json:"sessions,omitempty"`
+	History  History  `json:"history"`
+}
+
+func (f *HistoryFile) UnmarshalJSON(data []byte) error {
+	if data = bytes.TrimSpace(data); len(data) > 0 && data[0] == '[' {
+		*f = HistoryFile{}
+		return json.Unmarshal(data, &f.History)
+	}
+	type plain HistoryFile
+	return json.Unmarshal(data, (*plain)(f))
+}
+
 type TextDumpOptions struct {
 	Verbose bool
 	WithLat bool
+	// WithBlockers prints blockers found by observers, they are left out by default, so that texts are the same
+	// whether or not locks are observed.
+	WithBlockers bool
 }
 
 func (h History) DumpText(w io.Writer, opts TextDumpOptions) error {
@@ -315,6 +579,41 @@ func (h History) DumpText(w io.Writer, opts TextDumpOptions) error {
 	return nil
 }
 
+func sameStmts(xs []Stmt, ys []Stmt) bool {
+	if len(xs) != len(ys) {
+		return false
+	}
+	for i := range xs {
+		if !xs[i].Equal(ys[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func stmtsText(stmts []Stmt) string {
+	texts := make([]string, len(stmts))
+	for i, s := range stmts {
+		texts[i] = s.Sess + ":" + s.SQL
+	}
+	return "[" + strings.Join(texts, ", ") + "]"
+}
+
+func sameStrings(xs []string, ys []string) bool {
+	if len(xs) != len(ys) {
+		return false
+	}
+	xs, ys = append([]string{}, xs...), append([]string{}, ys...)
+	sort.Strings(xs)
+	sort.Strings(ys)
+	for i := range xs {
+		if xs[i] != ys[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func (h *History) Collect(e Event) { *h = append(*h, e) }
 
 func TextDumper(w io.Writer, opts TextDumpOptions) func(Event) {
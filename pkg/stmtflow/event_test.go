@@ -1,6 +1,7 @@
 package stmtflow
 
 import (
+	"database/sql/driver"
 	"encoding/base64"
 	"encoding/json"
 	"testing"
@@ -43,8 +44,14 @@ func TestEventSerde(t *testing.T) {
 	}{
 		{name: "invalid", event: Event{EventMeta: EventMeta{Kind: "oops"}}, fail: true},
 		{name: "block", event: NewBlockEvent("t")},
+		{name: "block", event: NewBlockEvent("t", "s1", "s2")},
 		{name: "resume", event: NewResumeEvent("t")},
-		{name: "invoke", event: NewInvokeEvent("t", Invoke{Stmt: Stmt{"t", "select 1", S_QUERY}})},
+		{name: "invoke", event: NewInvokeEvent("t", Invoke{Stmt: Stmt{Sess: "t", SQL: "select 1", Flags: S_QUERY}})},
+		{name: "invoke", event: NewInvokeEvent("t", Invoke{Stmt: Stmt{Sess: "t", SQL: "kill ${conn}"}, Exec: "kill 42"})},
+		{name: "invoke", event: NewInvokeEvent("t", Invoke{Stmt: Stmt{Sess: "t", SQL: "select 1", Endpoint: "tidb2"}})},
+		{name: "invoke", event: NewInvokeEvent("t", Invoke{Stmt: Stmt{Sess: "t", SQL: "select now()", Compare: &CompareOptions{Masks: []string{`\d+`}, RowCount: true}}})},
+		{name: "invoke", event: NewInvokeEvent("t", Invoke{Stmt: Stmt{Sess: "t", SQL: "begin", Let: []Capture{{Name: "ts", Expr: "@@tidb_current_ts"}}}})},
+		{name: "invoke", event: NewInvokeEvent("t", Invoke{Stmt: Stmt{Sess: "t", SQL: "update t set v = 1", ExpectErrors: []int{1213}, Retry: 3, RetryOn: []int{8002, 9007}, Timeout: 2 * time.Second, Sleep: 500 * time.Millisecond}})},
 		{name: "return", event: newRetEvent(t, "t", "", &Error{0, "oops"})},
 		{name: "return", event: newRetEvent(t, "t", resultData[0], nil)},
 		{name: "return", event: newRetEvent(t, "t", resultData[1], nil)},
@@ -65,8 +72,11 @@ func TestEventSerde(t *testing.T) {
 			require.NoError(t, err)
 			var ev Event
 			require.NoError(t, json.Unmarshal(js, &ev))
+			if tt.event.Kind == EventBlock {
+				require.Equal(t, tt.event.Block(), ev.Block())
+			}
 			if tt.event.Kind == EventInvoke {
-				require.Equal(t, tt.event.inv.Stmt, ev.inv.Stmt)
+				require.Equal(t, tt.event.Invoke(), ev.Invoke())
 			}
 			if tt.event.Kind == EventReturn {
 				require.Equal(t, tt.event.ret.T[0].Format(time.RFC3339Nano), ev.ret.T[0].Format(time.RFC3339Nano))
@@ -100,3 +110,74 @@ func BenchmarkEvent_UnmarshalJSON(b *testing.B) {
 		json.Unmarshal(bs, &ev)
 	}
 }
+
+func TestBlockEventEqualTo(t *testing.T) {
+	plain, byS1, byS2 := NewBlockEvent("t"), NewBlockEvent("t", "s1"), NewBlockEvent("t", "s2")
+	ok, _ := plain.EqualTo(byS1)
+	require.True(t, ok, "blockers are ignored if not expected")
+	ok, _ = byS1.EqualTo(byS1)
+	require.True(t, ok)
+	ok, msg := byS1.EqualTo(byS2)
+	require.False(t, ok, msg)
+	ok, msg = byS1.EqualTo(plain)
+	require.False(t, ok, msg)
+}
+
+func TestStmtPosNotSerialized(t *testing.T) {
+	stmt := Stmt{Sess: "s1", SQL: "select 1", Pos: &Pos{File: "/home/me/a.t.sql", Line: 3, Col: 1}}
+	js, err := json.Marshal(NewInvokeEvent("s1", Invoke{Stmt: stmt}))
+	require.NoError(t, err)
+	require.NotContains(t, string(js), "a.t.sql")
+	var e Event
+	require.NoError(t, json.Unmarshal(js, &e))
+	require.Nil(t, e.Invoke().Pos)
+	require.Equal(t, "/home/me/a.t.sql:3:1", stmt.Where())
+
+	// mismatches are located by the actual statement, since expected ones come from json
+	actual := NewReturnEvent("s1", Return{Stmt: stmt, Err: &Error{Code: 1105, Message: "oops"}})
+	expect := NewReturnEvent("s1", Return{Stmt: e.Invoke().Stmt, Res: sqlz.NewFromResult(driver.RowsAffected(0))})
+	ok, msg := expect.Match(actual, CompareOptions{})
+	require.False(t, ok)
+	require.Contains(t, msg, "(select 1) at /home/me/a.t.sql:3:1: expect a result")
+}
+
+func TestStmtShouldRetry(t *testing.T) {
+	s := Stmt{Retry: 2, RetryOn: []int{8002}}
+	require.True(t, s.ShouldRetry(1, &Error{Code: 8002}))
+	require.True(t, s.ShouldRetry(2, &Error{Code: 8002}))
+	require.False(t, s.ShouldRetry(3, &Error{Code: 8002}))
+	require.False(t, s.ShouldRetry(1, &Error{Code: 1213}))
+	require.False(t, s.ShouldRetry(1, nil))
+	s.RetryOn = nil
+	require.True(t, s.ShouldRetry(1, &Error{Code: 1213}))
+	require.False(t, Stmt{}.ShouldRetry(1, &Error{Code: 1213}))
+}
+
+func TestStmtRetryBackoff(t *testing.T) {
+	var ds []time.Duration
+	for n := 1; n <= 4; n++ {
+		ds = append(ds, Stmt{}.RetryBackoff(n))
+	}
+	require.Equal(t, []time.Duration{DefaultRetryDelay, 2 * DefaultRetryDelay, 4 * DefaultRetryDelay, 8 * DefaultRetryDelay}, ds)
+	s := Stmt{RetryDelay: 300 * time.Millisecond}
+	require.Equal(t, 300*time.Millisecond, s.RetryBackoff(1))
+	require.Equal(t, 600*time.Millisecond, s.RetryBackoff(2))
+	require.Equal(t, MaxRetryDelay, s.RetryBackoff(3))
+	require.Equal(t, MaxRetryDelay, s.RetryBackoff(100))
+	require.Equal(t, MaxRetryDelay, Stmt{RetryDelay: time.Minute}.RetryBackoff(1))
+}
+
+func TestSubstitute(t *testing.T) {
+	vars := map[string]string{"conn": "42", "ts": "430000000000000000"}
+	sql, err := Substitute("kill ${conn}", vars)
+	require.NoError(t, err)
+	require.Equal(t, "kill 42", sql)
+	sql, err = Substitute("select * from t as of timestamp ${ts} where id = ${conn}", vars)
+	require.NoError(t, err)
+	require.Equal(t, "select * from t as of timestamp 430000000000000000 where id = 42", sql)
+	sql, err = Substitute("select '$conn', '${}'", vars)
+	require.NoError(t, err)
+	require.Equal(t, "select '$conn', '${}'", sql)
+	_, err = Substitute("kill ${oops}", vars)
+	require.Error(t, err)
+}
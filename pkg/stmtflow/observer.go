@@ -0,0 +1,142 @@
+package stmtflow
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"sync"
+)
+
+// BlockObserver finds out which sessions are blocking a blocked session.
+type BlockObserver interface {
+	BlockedBy(ctx context.Context, db *sql.DB, pool *Pool, sess string) ([]string, error)
+}
+
+// lockWaitQueries return pairs of (waiting connection id, blocking connection id).
+// Waits in deadlocks are counted as well, since a wait may be resolved as a deadlock before it's observed.
+var lockWaitQueries = []string{
+	// TiDB v5.1+ clusters, transactions may come from any server
+	`select t1.SESSION_ID, t2.SESSION_ID from information_schema.DATA_LOCK_WAITS w
+join information_schema.CLUSTER_TIDB_TRX t1 on w.TRX_ID = t1.ID
+join information_schema.CLUSTER_TIDB_TRX t2 on w.CURRENT_HOLDING_TRX_ID = t2.ID
+union
+select t1.SESSION_ID, t2.SESSION_ID from information_schema.CLUSTER_DEADLOCKS d
+join information_schema.CLUSTER_TIDB_TRX t1 on d.TRY_LOCK_TRX_ID = t1.ID
+join information_schema.CLUSTER_TIDB_TRX t2 on d.TRX_HOLDING_LOCK = t2.ID`,
+	// TiDB v5.1+
+	`select t1.SESSION_ID, t2.SESSION_ID from information_schema.DATA_LOCK_WAITS w
+join information_schema.TIDB_TRX t1 on w.TRX_ID = t1.ID
+join information_schema.TIDB_TRX t2 on w.CURRENT_HOLDING_TRX_ID = t2.ID
+union
+select t1.SESSION_ID, t2.SESSION_ID from information_schema.DEADLOCKS d
+join information_schema.TIDB_TRX t1 on d.TRY_LOCK_TRX_ID = t1.ID
+join information_schema.TIDB_TRX t2 on d.TRX_HOLDING_LOCK = t2.ID`,
+	// MySQL 8.0
+	`select r.PROCESSLIST_ID, b.PROCESSLIST_ID from performance_schema.data_lock_waits w
+join performance_schema.threads r on w.REQUESTING_THREAD_ID = r.THREAD_ID
+join performance_schema.threads b on w.BLOCKING_THREAD_ID = b.THREAD_ID`,
+	// MySQL 5.7
+	`select r.trx_mysql_thread_id, b.trx_mysql_thread_id from information_schema.innodb_lock_waits w
+join information_schema.innodb_trx r on w.requesting_trx_id = r.trx_id
+join information_schema.innodb_trx b on w.blocking_trx_id = b.trx_id`,
+}
+
+// LockWaitObserver queries lock views via a side connection to find blockers.
+type LockWaitObserver struct {
+	lock  sync.Mutex
+	query string
+}
+
+func (o *LockWaitObserver) BlockedBy(ctx context.Context, db *sql.DB, pool *Pool, sess string) ([]string, error) {
+	self, ok := pool.ConnID(sess)
+	if !ok {
+		return nil, ErrConnNotExist
+	}
+	sessions := map[int64]string{}
+	pool.lock.Lock()
+	for s, id := range pool.ids {
+		sessions[id] = s
+	}
+	pool.lock.Unlock()
+	waits, err := o.lockWaits(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	var blockers []string
+	for _, w := range waits {
+		if w[0] != self {
+			continue
+		}
+		if s, ok := sessions[w[1]]; ok && s != sess {
+			blockers = append(blockers, s)
+		}
+	}
+	sort.Strings(blockers)
+	return dedupStrings(blockers), nil
+}
+
+func (o *LockWaitObserver) lockWaits(ctx context.Context, db *sql.DB) ([][2]int64, error) {
+	o.lock.Lock()
+	query := o.query
+	o.lock.Unlock()
+	if len(query) > 0 {
+		return queryLockWaits(ctx, db, query)
+	}
+	var fstErr error
+	for _, q := range lockWaitQueries {
+		waits, err := queryLockWaits(ctx, db, q)
+		if err != nil {
+			if fstErr == nil {
+				fstErr = err
+			}
+			continue
+		}
+		o.lock.Lock()
+		o.query = q
+		o.lock.Unlock()
+		return waits, nil
+	}
+	return nil, fstErr
+}
+
+func queryLockWaits(ctx context.Context, db *sql.DB, query string) ([][2]int64, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var waits [][2]int64
+	for rows.Next() {
+		var w [2]sql.NullInt64
+		if err = rows.Scan(&w[0], &w[1]); err != nil {
+			return nil, err
+		}
+		if w[0].Valid && w[1].Valid {
+			waits = append(waits, [2]int64{w[0].Int64, w[1].Int64})
+		}
+	}
+	return waits, rows.Err()
+}
+
+func observeBlock(ctx context.Context, db *sql.DB, pool *Pool, sess string, o BlockObserver) []string {
+	if o == nil {
+		return nil
+	}
+	// the observer is best-effort, a blocked event is still valid without blockers.
+	blockers, _ := o.BlockedBy(ctx, db, pool, sess)
+	return blockers
+}
+
+func dedupStrings(xs []string) []string {
+	if len(xs) < 2 {
+		return xs
+	}
+	k := 1
+	for i := 1; i < len(xs); i++ {
+		if xs[i] != xs[k-1] {
+			xs[k] = xs[i]
+			k++
+		}
+	}
+	return xs[:k]
+}
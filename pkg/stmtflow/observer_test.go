@@ -0,0 +1,83 @@
+package stmtflow
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// lockViews is a fake driver serving lock views of a TiDB server without cluster tables.
+type lockViews struct{ waits [][2]int64 }
+
+func (v *lockViews) Open(name string) (driver.Conn, error) { return v, nil }
+
+func (v *lockViews) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+func (v *lockViews) Close() error              { return nil }
+func (v *lockViews) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+
+func (v *lockViews) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if strings.Contains(query, "CLUSTER_") || !strings.Contains(query, "information_schema.DEADLOCKS") {
+		return nil, errors.New("table doesn't exist")
+	}
+	return &waitRows{waits: v.waits}, nil
+}
+
+type waitRows struct{ waits [][2]int64 }
+
+func (r *waitRows) Columns() []string { return []string{"waiting", "blocking"} }
+func (r *waitRows) Close() error      { return nil }
+
+func (r *waitRows) Next(dest []driver.Value) error {
+	if len(r.waits) == 0 {
+		return io.EOF
+	}
+	dest[0], dest[1] = r.waits[0][0], r.waits[0][1]
+	r.waits = r.waits[1:]
+	return nil
+}
+
+func init() {
+	sql.Register("lockviews", &lockViews{waits: [][2]int64{{1, 2}, {1, 3}, {1, 2}, {2, 3}, {1, 9}}})
+}
+
+func TestLockWaitObserver(t *testing.T) {
+	db, err := sql.Open("lockviews", "")
+	require.NoError(t, err)
+	defer db.Close()
+	pool := NewPool()
+	for s, id := range map[string]int64{"s1": 1, "s2": 2, "s3": 3} {
+		pool.SetConnID(s, id)
+	}
+
+	o := &LockWaitObserver{}
+	blockers, err := o.BlockedBy(context.Background(), db, pool, "s1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"s2", "s3"}, blockers)
+	// the first query that works is kept
+	require.Contains(t, o.query, "information_schema.DEADLOCKS")
+	require.NotContains(t, o.query, "CLUSTER_")
+	blockers, err = o.BlockedBy(context.Background(), db, pool, "s3")
+	require.NoError(t, err)
+	require.Empty(t, blockers)
+	_, err = o.BlockedBy(context.Background(), db, pool, "s4")
+	require.Equal(t, ErrConnNotExist, err)
+}
+
+func TestDumpBlockers(t *testing.T) {
+	e := NewBlockEvent("s1", "s2", "s3")
+	buf := new(bytes.Buffer)
+	e.DumpText(buf, TextDumpOptions{Verbose: true})
+	require.Equal(t, "-- s1 >> blocked\n", buf.String())
+	buf.Reset()
+	e.DumpText(buf, TextDumpOptions{WithBlockers: true})
+	require.Equal(t, "-- s1 >> blocked by s2, s3\n", buf.String())
+}
@@ -0,0 +1,129 @@
+package stmtflow
+
+import (
+	"math/rand"
+)
+
+// Schedule is an interleaving of per-session statement sequences, each element is the index of a sequence.
+type Schedule []int
+
+// SplitSessions splits statements into per-session sequences, sessions are ordered by their first appearance.
+func SplitSessions(stmts []Stmt) ([]string, [][]Stmt) {
+	var (
+		sessions []string
+		seqs     [][]Stmt
+		index    = map[string]int{}
+	)
+	for _, stmt := range stmts {
+		k, ok := index[stmt.Sess]
+		if !ok {
+			k = len(sessions)
+			index[stmt.Sess] = k
+			sessions = append(sessions, stmt.Sess)
+			seqs = append(seqs, nil)
+		}
+		seqs[k] = append(seqs[k], stmt)
+	}
+	return sessions, seqs
+}
+
+// ScheduleOf returns the schedule of the given statements.
+func ScheduleOf(stmts []Stmt) Schedule {
+	var (
+		sched = make(Schedule, len(stmts))
+		index = map[string]int{}
+	)
+	for i, stmt := range stmts {
+		k, ok := index[stmt.Sess]
+		if !ok {
+			k = len(index)
+			index[stmt.Sess] = k
+		}
+		sched[i] = k
+	}
+	return sched
+}
+
+// Merge interleaves per-session sequences by the schedule.
+func Merge(seqs [][]Stmt, sched Schedule) []Stmt {
+	var (
+		stmts = make([]Stmt, 0, len(sched))
+		next  = make([]int, len(seqs))
+	)
+	for _, k := range sched {
+		stmts = append(stmts, seqs[k][next[k]])
+		next[k]++
+	}
+	return stmts
+}
+
+// EnumSchedules enumerates all valid schedules of seqs in lexicographic order until fn returns false.
+func EnumSchedules(seqs [][]Stmt, fn func(sched Schedule) bool) {
+	var (
+		n      = 0
+		remain = make([]int, len(seqs))
+	)
+	for i, seq := range seqs {
+		remain[i] = len(seq)
+		n += len(seq)
+	}
+	sched := make(Schedule, 0, n)
+	var walk func() bool
+	walk = func() bool {
+		if len(sched) == n {
+			return fn(append(Schedule{}, sched...))
+		}
+		for k := range remain {
+			if remain[k] == 0 {
+				continue
+			}
+			remain[k]--
+			sched = append(sched, k)
+			ok := walk()
+			sched = sched[:len(sched)-1]
+			remain[k]++
+			if !ok {
+				return false
+			}
+		}
+		return true
+	}
+	walk()
+}
+
+// SampleSchedule returns a random schedule of seqs, every valid schedule is equally likely to be chosen.
+func SampleSchedule(seqs [][]Stmt, r *rand.Rand) Schedule {
+	var (
+		n      = 0
+		remain = make([]int, len(seqs))
+	)
+	for i, seq := range seqs {
+		remain[i] = len(seq)
+		n += len(seq)
+	}
+	sched := make(Schedule, 0, n)
+	for left := n; left > 0; left-- {
+		x := r.Intn(left)
+		for k := range remain {
+			if x < remain[k] {
+				sched = append(sched, k)
+				remain[k]--
+				break
+			}
+			x -= remain[k]
+		}
+	}
+	return sched
+}
+
+func (s Schedule) String() string {
+	bs := make([]byte, len(s))
+	for i, k := range s {
+		if k < 10 {
+			bs[i] = byte('0' + k)
+		} else {
+			bs[i] = byte('a' + k - 10)
+		}
+	}
+	return string(bs)
+}
@@ -0,0 +1,72 @@
+package stmtflow
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newStmts(sessAndSQLs ...string) []Stmt {
+	var stmts []Stmt
+	for i := 0; i+1 < len(sessAndSQLs); i += 2 {
+		stmts = append(stmts, Stmt{Sess: sessAndSQLs[i], SQL: sessAndSQLs[i+1]})
+	}
+	return stmts
+}
+
+func bySession(stmts []Stmt) map[string][]Stmt {
+	m := map[string][]Stmt{}
+	for _, stmt := range stmts {
+		m[stmt.Sess] = append(m[stmt.Sess], stmt)
+	}
+	return m
+}
+
+func TestSplitAndMerge(t *testing.T) {
+	stmts := newStmts("s1", "begin", "s2", "begin", "s1", "update", "s2", "update", "s1", "commit", "s2", "commit")
+	sessions, seqs := SplitSessions(stmts)
+	require.Equal(t, []string{"s1", "s2"}, sessions)
+	require.Len(t, seqs, 2)
+	require.Len(t, seqs[0], 3)
+	require.Len(t, seqs[1], 3)
+	sched := ScheduleOf(stmts)
+	require.Equal(t, "010101", sched.String())
+	require.Equal(t, stmts, Merge(seqs, sched))
+}
+
+func TestEnumSchedules(t *testing.T) {
+	stmts := newStmts("s1", "a", "s1", "b", "s2", "c", "s2", "d")
+	_, seqs := SplitSessions(stmts)
+	var all []string
+	EnumSchedules(seqs, func(sched Schedule) bool {
+		all = append(all, sched.String())
+		require.Equal(t, bySession(stmts), bySession(Merge(seqs, sched)))
+		return true
+	})
+	require.Equal(t, []string{"0011", "0101", "0110", "1001", "1010", "1100"}, all)
+
+	cnt := 0
+	EnumSchedules(seqs, func(sched Schedule) bool {
+		cnt++
+		return cnt < 4
+	})
+	require.Equal(t, 4, cnt)
+}
+
+func TestSampleSchedule(t *testing.T) {
+	stmts := newStmts("s1", "a", "s1", "b", "s2", "c", "s2", "d")
+	_, seqs := SplitSessions(stmts)
+	r := rand.New(rand.NewSource(42))
+	seen := map[string]int{}
+	for i := 0; i < 600; i++ {
+		sched := SampleSchedule(seqs, r)
+		require.Equal(t, bySession(stmts), bySession(Merge(seqs, sched)))
+		seen[sched.String()]++
+	}
+	require.Len(t, seen, 6)
+	for _, cnt := range seen {
+		require.InDelta(t, 100, cnt, 40)
+	}
+	require.Equal(t, SampleSchedule(seqs, rand.New(rand.NewSource(1))), SampleSchedule(seqs, rand.New(rand.NewSource(1))))
+}
@@ -0,0 +1,122 @@
+package stmtflow
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// SessionOptions are settings applied to the connection of a session before any statement is sent.
+type SessionOptions struct {
+	// Vars are session variables to set, values are sql expressions, eg. `'READ-COMMITTED'` or `1`.
+	Vars map[string]string `json:"vars,omitempty"`
+	// DB is the default database of the session.
+	DB string `json:"db,omitempty"`
+	// Source overrides the db (or the endpoint) the session connects to, eg. to log in as another user.
+	Source *sql.DB `json:"-"`
+}
+
+// SessionInfo describes the connection of a session after settings are applied, it's metadata of a history rather
+// than an event.
+type SessionInfo struct {
+	ConnID int64             `json:"connId"`
+	User   string            `json:"user"`
+	DB     string            `json:"db,omitempty"`
+	Vars   map[string]string `json:"vars,omitempty"`
+}
+
+// String formats the info like `conn 42, user root@%, db test, vars a=1 b=2`.
+func (i SessionInfo) String() string {
+	buf := new(strings.Builder)
+	fmt.Fprintf(buf, "conn %d, user %s", i.ConnID, i.User)
+	if len(i.DB) > 0 {
+		buf.WriteString(", db " + i.DB)
+	}
+	names := make([]string, 0, len(i.Vars))
+	for name := range i.Vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for k, name := range names {
+		if k == 0 {
+			buf.WriteString(", vars")
+		}
+		buf.WriteString(" " + name + "=" + i.Vars[name])
+	}
+	return buf.String()
+}
+
+// Sessions collects SessionInfo reported by EvalOptions.OnSession.
+type Sessions map[string]SessionInfo
+
+func (ss *Sessions) Collect(s string, info SessionInfo) {
+	if *ss == nil {
+		*ss = Sessions{}
+	}
+	(*ss)[s] = info
+}
+
+var varName = regexp.MustCompile(`^\w+$`)
+
+func (o SessionOptions) names() ([]string, error) {
+	names := make([]string, 0, len(o.Vars))
+	for name := range o.Vars {
+		if !varName.MatchString(name) {
+			return nil, errors.New("invalid variable name: " + name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// QuoteIdent quotes an identifier by backticks, embedded backticks are doubled.
+func QuoteIdent(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// apply sets the default database and then variables (in the order of names) of a connection.
+func (o SessionOptions) apply(ctx context.Context, c *sql.Conn) error {
+	names, err := o.names()
+	if err != nil {
+		return err
+	}
+	if len(o.DB) > 0 {
+		if _, err = c.ExecContext(ctx, "use "+QuoteIdent(o.DB)); err != nil {
+			return err
+		}
+	}
+	for _, name := range names {
+		if _, err = c.ExecContext(ctx, "set @@session."+name+" = "+o.Vars[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// describe reads the current user, the default database and values of variables set by o.
+func (o SessionOptions) describe(ctx context.Context, c *sql.Conn, id int64) (SessionInfo, error) {
+	info := SessionInfo{ConnID: id}
+	var db sql.NullString
+	if err := c.QueryRowContext(ctx, "select current_user(), database()").Scan(&info.User, &db); err != nil {
+		return info, err
+	}
+	info.DB = db.String
+	names, err := o.names()
+	if err != nil || len(names) == 0 {
+		return info, err
+	}
+	info.Vars = make(map[string]string, len(names))
+	for _, name := range names {
+		var v sql.NullString
+		if err = c.QueryRowContext(ctx, "select @@session."+name).Scan(&v); err != nil {
+			return info, err
+		}
+		info.Vars[name] = v.String
+	}
+	return info, nil
+}
@@ -0,0 +1,66 @@
+package stmtflow
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionOptions(t *testing.T) {
+	db, err := sql.Open("hang", "")
+	require.NoError(t, err)
+	defer db.Close()
+
+	var (
+		h  History
+		ss Sessions
+	)
+	opts := EvalOptions{
+		Callback:  h.Collect,
+		OnSession: ss.Collect,
+		Sessions: map[string]SessionOptions{
+			"s1": {DB: "test2", Vars: map[string]string{"tidb_txn_mode": "'pessimistic'", "transaction_isolation": "'READ-COMMITTED'"}},
+		},
+	}
+	require.NoError(t, Run(context.Background(), db, []Stmt{{Sess: "s1", SQL: "noop"}, {Sess: "s2", SQL: "noop"}}, opts))
+	// settings are not events
+	require.Equal(t, []string{"s1:invoke", "s1:return", "s2:invoke", "s2:return"}, metasOf(h))
+	require.Len(t, ss, 2)
+	require.Equal(t, "test2", ss["s1"].DB)
+	require.Equal(t, map[string]string{"tidb_txn_mode": "pessimistic", "transaction_isolation": "READ-COMMITTED"}, ss["s1"].Vars)
+	require.Equal(t, "root@%", ss["s2"].User)
+	require.Nil(t, ss["s2"].Vars)
+	require.NotEqual(t, ss["s1"].ConnID, ss["s2"].ConnID)
+
+	// backticks of the database name are escaped
+	ss = nil
+	opts.Sessions["s1"] = SessionOptions{DB: "a`; drop database b; `c"}
+	require.NoError(t, Run(context.Background(), db, []Stmt{{Sess: "s1", SQL: "noop"}}, opts))
+	require.Equal(t, "a`; drop database b; `c", ss["s1"].DB)
+	require.Equal(t, 1, countLogs("use `a``; drop database b; ``c`"))
+
+	opts.Sessions["s1"] = SessionOptions{Vars: map[string]string{"x; drop table t": "1"}}
+	require.Error(t, Run(context.Background(), db, []Stmt{{Sess: "s1", SQL: "noop"}}, opts))
+}
+
+func TestHistoryFile(t *testing.T) {
+	h := History{NewInvokeEvent("s1", Invoke{Stmt: Stmt{Sess: "s1", SQL: "noop"}}), NewResumeEvent("s1")}
+	sessions := Sessions{"s1": {ConnID: 7, User: "u1@%", DB: "test", Vars: map[string]string{"b": "2", "a": "1"}}}
+	require.Equal(t, "conn 7, user u1@%, db test, vars a=1 b=2", sessions["s1"].String())
+	require.Equal(t, "conn 8, user root@%", SessionInfo{ConnID: 8, User: "root@%"}.String())
+
+	// sessions are dumped as metadata, plain histories are still accepted
+	for _, ss := range []Sessions{sessions, nil} {
+		buf := new(bytes.Buffer)
+		require.NoError(t, h.DumpJson(buf, JsonDumpOptions{Sessions: ss}))
+		require.Equal(t, len(ss) == 0, bytes.HasPrefix(buf.Bytes(), []byte("[")))
+		var f HistoryFile
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &f))
+		require.Equal(t, ss, f.Sessions)
+		require.Equal(t, metasOf(h), metasOf(f.History))
+	}
+}
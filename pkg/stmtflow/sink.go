@@ -0,0 +1,224 @@
+package stmtflow
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+)
+
+// ErrSinkClosed is returned when events are sent to a closed sink.
+var ErrSinkClosed = errors.New("sink closed")
+
+// EventSink receives events of evaluations, src tells which evaluation (eg. a test) an event comes from, see
+// EvalOptions.Source. Unlike EvalOptions.Callback, sinks must be safe for concurrent use, since evaluations of
+// parallel tests may share a sink. Send may block to apply back-pressure, errors are reported by Send or Close.
+type EventSink interface {
+	Send(src string, e Event) error
+	Close() error
+}
+
+// Envelope is an event together with its source, it's the unit written by JsonlSink and sent by ChanSink.
+type Envelope struct {
+	Src   string `json:"src,omitempty"`
+	Event Event  `json:"event"`
+}
+
+// SinkFunc adapts a function to an EventSink, it's the function's responsibility to be concurrency safe.
+type SinkFunc func(src string, e Event) error
+
+func (f SinkFunc) Send(src string, e Event) error { return f(src, e) }
+
+func (f SinkFunc) Close() error { return nil }
+
+// JsonlSink writes events as JSON lines, the writer is closed with the sink if it's an io.Closer.
+type JsonlSink struct {
+	lock sync.Mutex
+	w    io.Writer
+	enc  *json.Encoder
+}
+
+func NewJsonlSink(w io.Writer) *JsonlSink {
+	return &JsonlSink{w: w, enc: json.NewEncoder(w)}
+}
+
+func (s *JsonlSink) Send(src string, e Event) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.enc == nil {
+		return ErrSinkClosed
+	}
+	return s.enc.Encode(Envelope{src, e})
+}
+
+func (s *JsonlSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.enc == nil {
+		return nil
+	}
+	s.enc = nil
+	if c, ok := s.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// ChanSink sends events to a channel, which is closed with the sink. Send blocks if the channel is full, until the
+// event is received or the sink is closed.
+type ChanSink struct {
+	ch      chan<- Envelope
+	gate    sendGate
+	closing chan struct{}
+}
+
+func NewChanSink(ch chan<- Envelope) *ChanSink {
+	return &ChanSink{ch: ch, closing: make(chan struct{})}
+}
+
+func (s *ChanSink) Send(src string, e Event) error {
+	if !s.gate.enter() {
+		return ErrSinkClosed
+	}
+	defer s.gate.leave()
+	select {
+	case s.ch <- Envelope{src, e}:
+		return nil
+	case <-s.closing:
+		return ErrSinkClosed
+	}
+}
+
+// Close closes the channel, blocked sends are aborted with ErrSinkClosed.
+func (s *ChanSink) Close() error {
+	if s.gate.close() {
+		close(s.closing)
+		s.gate.wait()
+		close(s.ch)
+	}
+	return nil
+}
+
+// BufferedSink delivers events to another sink in background, so that evaluations are not blocked by slow sinks
+// until the buffer is full. Once the underlying sink fails, the error is returned by later sends and Close, and
+// the rest events are dropped.
+type BufferedSink struct {
+	sink  EventSink
+	queue chan Envelope
+	done  chan struct{}
+	gate  sendGate
+
+	mu  sync.Mutex
+	err error
+}
+
+func NewBufferedSink(sink EventSink, size int) *BufferedSink {
+	s := &BufferedSink{sink: sink, queue: make(chan Envelope, size), done: make(chan struct{})}
+	go s.deliver()
+	return s
+}
+
+func (s *BufferedSink) deliver() {
+	defer close(s.done)
+	for x := range s.queue {
+		// events are drained even after a failure, so that senders are never blocked by a dead sink
+		if s.Err() != nil {
+			continue
+		}
+		if err := s.sink.Send(x.Src, x.Event); err != nil {
+			s.mu.Lock()
+			s.err = err
+			s.mu.Unlock()
+		}
+	}
+}
+
+// Err returns the first error of the underlying sink.
+func (s *BufferedSink) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *BufferedSink) Send(src string, e Event) error {
+	if err := s.Err(); err != nil {
+		return err
+	}
+	if !s.gate.enter() {
+		return ErrSinkClosed
+	}
+	defer s.gate.leave()
+	// no lock is held here, the queue is drained by deliver until all senders leave
+	s.queue <- Envelope{src, e}
+	return nil
+}
+
+// Close flushes buffered events and closes the underlying sink.
+func (s *BufferedSink) Close() error {
+	if s.gate.close() {
+		s.gate.wait()
+		close(s.queue)
+	}
+	<-s.done
+	err := s.sink.Close()
+	if e := s.Err(); e != nil {
+		return e
+	}
+	return err
+}
+
+// sendGate tracks senders in flight, so that a channel is closed only after all of them leave. The lock is held
+// only to enter or close the gate, never while sending.
+type sendGate struct {
+	mu      sync.Mutex
+	closed  bool
+	senders sync.WaitGroup
+}
+
+func (g *sendGate) enter() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return false
+	}
+	g.senders.Add(1)
+	return true
+}
+
+func (g *sendGate) leave() { g.senders.Done() }
+
+// close closes the gate, it returns false if the gate has been closed.
+func (g *sendGate) close() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return false
+	}
+	g.closed = true
+	return true
+}
+
+func (g *sendGate) wait() { g.senders.Wait() }
+
+// MultiSink sends events to all sinks, the first error is returned.
+type MultiSink []EventSink
+
+func (ss MultiSink) Send(src string, e Event) error {
+	var fstErr error
+	for _, s := range ss {
+		if err := s.Send(src, e); fstErr == nil && err != nil {
+			fstErr = err
+		}
+	}
+	return fstErr
+}
+
+func (ss MultiSink) Close() error {
+	var fstErr error
+	for _, s := range ss {
+		if err := s.Close(); fstErr == nil && err != nil {
+			fstErr = err
+		}
+	}
+	return fstErr
+}
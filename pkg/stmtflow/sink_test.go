@@ -0,0 +1,147 @@
+package stmtflow
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBufferedJsonlSink(t *testing.T) {
+	db, err := sql.Open("hang", "")
+	require.NoError(t, err)
+	defer db.Close()
+
+	buf := new(bytes.Buffer)
+	sink := NewBufferedSink(NewJsonlSink(buf), 1)
+	stmts := []Stmt{{Sess: "s1", SQL: "noop"}, {Sess: "s2", SQL: "noop"}}
+	hs := make([]History, 4)
+	var wg sync.WaitGroup
+	for i := range hs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			opts := EvalOptions{Callback: hs[i].Collect, Sink: sink, Source: "t" + strconv.Itoa(i)}
+			require.NoError(t, Run(context.Background(), db, stmts, opts))
+		}(i)
+	}
+	wg.Wait()
+	require.NoError(t, sink.Close())
+	require.Equal(t, ErrSinkClosed, sink.Send("", NewResumeEvent("s1")))
+
+	got := map[string]History{}
+	sc := bufio.NewScanner(buf)
+	for sc.Scan() {
+		var x Envelope
+		require.NoError(t, json.Unmarshal(sc.Bytes(), &x))
+		got[x.Src] = append(got[x.Src], x.Event)
+	}
+	require.Len(t, got, len(hs))
+	for i, h := range hs {
+		require.True(t, DiffHistory(h, got["t"+strconv.Itoa(i)], CompareOptions{}).Empty())
+	}
+}
+
+func TestSinkErrors(t *testing.T) {
+	db, err := sql.Open("hang", "")
+	require.NoError(t, err)
+	defer db.Close()
+
+	fail := errors.New("viewer is gone")
+	sent := 0
+	sink := NewBufferedSink(SinkFunc(func(src string, e Event) error {
+		sent++
+		return fail
+	}), 0)
+	err = Run(context.Background(), db, []Stmt{{Sess: "s1", SQL: "noop"}, {Sess: "s1", SQL: "noop"}}, EvalOptions{Sink: sink})
+	require.True(t, errors.Is(err, fail))
+	require.Equal(t, fail, sink.Close())
+	require.Equal(t, 1, sent)
+}
+
+func TestChanSink(t *testing.T) {
+	ch := make(chan Envelope)
+	sink := MultiSink{NewChanSink(ch), NewJsonlSink(new(bytes.Buffer))}
+	go func() {
+		sink.Send("a", NewResumeEvent("s1"))
+		sink.Send("b", NewResumeEvent("s2"))
+		sink.Close()
+	}()
+	var got []string
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case x, ok := <-ch:
+			if !ok {
+				require.Equal(t, []string{"a:s1:resume", "b:s2:resume"}, got)
+				return
+			}
+			got = append(got, x.Src+":"+x.Event.EventMeta.String())
+		case <-timeout:
+			t.Fatal("events are not delivered")
+		}
+	}
+}
+
+func TestSinkCloseWithBlockedSenders(t *testing.T) {
+	var lock sync.Mutex
+	sent, accepted := 0, 0
+	slow := SinkFunc(func(src string, e Event) error {
+		time.Sleep(10 * time.Millisecond)
+		lock.Lock()
+		defer lock.Unlock()
+		sent++
+		return nil
+	})
+	sink := NewBufferedSink(slow, 1)
+	ch := make(chan Envelope)
+	chSink := NewChanSink(ch)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			// a sender may come after Close, but an accepted event must be delivered
+			err := sink.Send("t"+strconv.Itoa(i), NewResumeEvent("s1"))
+			if err == nil {
+				lock.Lock()
+				accepted++
+				lock.Unlock()
+			} else {
+				require.Equal(t, ErrSinkClosed, err)
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			// nobody receives, blocked sends are aborted by Close
+			require.Equal(t, ErrSinkClosed, chSink.Send("t"+strconv.Itoa(i), NewResumeEvent("s1")))
+		}(i)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		require.NoError(t, sink.Close())
+		require.NoError(t, chSink.Close())
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close is blocked by senders")
+	}
+	wg.Wait()
+	require.Equal(t, accepted, sent)
+	require.Greater(t, sent, 1)
+	_, ok := <-ch
+	require.False(t, ok)
+}
@@ -0,0 +1,20 @@
+// Package stmtflowtest provides utilities for tests of stmtflow histories.
+package stmtflowtest
+
+import "github.com/zyguan/sqlz"
+
+// NewRows makes a result set of the given columns and rows, values are kept as raw texts.
+func NewRows(cols []string, rows ...[]string) *sqlz.ResultSet {
+	defs := make([]sqlz.ColumnDef, len(cols))
+	for i, c := range cols {
+		defs[i] = sqlz.ColumnDef{Name: c}
+	}
+	rs := sqlz.New(defs)
+	for _, row := range rows {
+		dest := rs.AllocateRow()
+		for j, v := range row {
+			*dest[j].(*[]byte) = []byte(v)
+		}
+	}
+	return rs
+}
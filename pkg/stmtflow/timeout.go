@@ -0,0 +1,94 @@
+package stmtflow
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultCloseTime is the default of EvalOptions.CloseTime.
+const DefaultCloseTime = 10 * time.Second
+
+// abort cleans up an evaluation which fails with cause. If it's interrupted by the context, a terminal timeout event
+// is emitted. Running statements are killed by `KILL QUERY` and then `KILL`, connections still in use after
+// opts.CloseTime are given up, so that waiting for and closing the pool are not blocked by stuck statements.
+func abort(ctx context.Context, pool *Pool, head *stmtNode, cause error, opts EvalOptions, callback func(Event)) {
+	if ctx.Err() != nil {
+		callback(NewTimeoutEvent(timeoutOf(head, ctx.Err())))
+	}
+	closeTime := opts.CloseTime
+	if closeTime <= 0 {
+		closeTime = DefaultCloseTime
+	}
+	deadline := time.Now().Add(closeTime)
+	kctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	for i, query := range []bool{true, false} {
+		sessions := pool.inUse()
+		if len(sessions) == 0 {
+			return
+		}
+		if opts.KillOnAbort {
+			for _, s := range sessions {
+				pool.Kill(kctx, s, query)
+			}
+		}
+		wait := time.Until(deadline)
+		if i == 0 {
+			wait /= 2
+		}
+		if waitPool(pool, wait) {
+			return
+		}
+	}
+	pool.abandon()
+}
+
+func timeoutOf(head *stmtNode, err error) Timeout {
+	t := Timeout{Err: err, T: time.Now()}
+	for p := head.next; p != nil; p = p.next {
+		if p.stmt.Status() == Running {
+			t.Running = append(t.Running, p.origin)
+		} else {
+			t.Pending = append(t.Pending, p.origin)
+		}
+	}
+	return t
+}
+
+// waitPool waits for all connections of the pool to be returned, it reports false if they are not returned in d.
+func waitPool(pool *Pool, d time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		pool.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+// inUse returns sessions whose connections are borrowed.
+func (p *Pool) inUse() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var sessions []string
+	for s, f := range p.flags {
+		if f&flagInUse > 0 {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions
+}
+
+// abandon returns connections in use by force, they are closed in background by Close.
+func (p *Pool) abandon() {
+	for _, s := range p.inUse() {
+		p.lock.Lock()
+		p.stuck[s] = true
+		p.lock.Unlock()
+		p.Return(s)
+	}
+}
@@ -0,0 +1,254 @@
+package stmtflow
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// hangServer is a fake server of the hang driver: `hang` blocks until it's killed by `kill [tidb] query`, `stuck`
+// blocks forever, `fail` fails and other statements return immediately. It also supports `use` and `set @@session`
+// for tests of session settings.
+type hangServer struct {
+	lock  sync.Mutex
+	seq   int64
+	kills map[int64]chan struct{}
+	log   []string
+}
+
+func (s *hangServer) Open(name string) (driver.Conn, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.seq++
+	s.kills[s.seq] = make(chan struct{})
+	return &hangConn{srv: s, id: s.seq, vars: map[string]string{}}, nil
+}
+
+type hangConn struct {
+	srv  *hangServer
+	id   int64
+	db   string
+	vars map[string]string
+}
+
+func (c *hangConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+func (c *hangConn) Close() error              { return nil }
+func (c *hangConn) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+
+func (c *hangConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.srv.lock.Lock()
+	c.srv.log = append(c.srv.log, query)
+	c.srv.lock.Unlock()
+	switch {
+	case query == "select connection_id()":
+		return &hangRows{cols: []string{"id"}, vals: []driver.Value{c.id}}, nil
+	case query == "select current_user(), database()":
+		return &hangRows{cols: []string{"user", "db"}, vals: []driver.Value{"root@%", c.db}}, nil
+	case strings.HasPrefix(query, "select @@session."):
+		return &hangRows{cols: []string{"v"}, vals: []driver.Value{c.vars[strings.TrimPrefix(query, "select @@session.")]}}, nil
+	}
+	return nil, errors.New("not supported")
+}
+
+func (c *hangConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.srv.lock.Lock()
+	c.srv.log = append(c.srv.log, query)
+	killed := c.srv.kills[c.id]
+	c.srv.lock.Unlock()
+	switch {
+	case query == "hang":
+		<-killed
+		return nil, errors.New("query interrupted")
+	case query == "stuck":
+		select {}
+	case query == "fail":
+		return nil, errors.New("failed")
+	case strings.HasPrefix(query, "use "):
+		c.db = strings.ReplaceAll(strings.Trim(strings.TrimPrefix(query, "use "), "`"), "``", "`")
+	case strings.HasPrefix(query, "set @@session."):
+		kv := strings.SplitN(strings.TrimPrefix(query, "set @@session."), " = ", 2)
+		c.vars[kv[0]] = strings.Trim(kv[1], "'")
+	case strings.HasPrefix(query, "kill tidb query "):
+		id, _ := strconv.ParseInt(strings.TrimPrefix(query, "kill tidb query "), 10, 64)
+		c.srv.lock.Lock()
+		close(c.srv.kills[id])
+		c.srv.kills[id] = make(chan struct{})
+		c.srv.lock.Unlock()
+	}
+	return driver.RowsAffected(0), nil
+}
+
+type hangRows struct {
+	cols []string
+	vals []driver.Value
+}
+
+func (r *hangRows) Columns() []string { return r.cols }
+func (r *hangRows) Close() error      { return nil }
+
+func (r *hangRows) Next(dest []driver.Value) error {
+	if r.vals == nil {
+		return io.EOF
+	}
+	copy(dest, r.vals)
+	r.vals = nil
+	return nil
+}
+
+var hangDriver = &hangServer{kills: map[int64]chan struct{}{}}
+
+func init() { sql.Register("hang", hangDriver) }
+
+func TestEvalTimeout(t *testing.T) {
+	db, err := sql.Open("hang", "")
+	require.NoError(t, err)
+	defer db.Close()
+
+	var h History
+	stmts := []Stmt{
+		{Sess: "s1", SQL: "hang"},
+		{Sess: "s2", SQL: "noop"},
+		{Sess: "s1", SQL: "noop"},
+	}
+	opts := EvalOptions{Callback: h.Collect, BlockTime: 20 * time.Millisecond, PingTime: 10 * time.Millisecond, KillOnAbort: true, CloseTime: time.Second}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	t0 := time.Now()
+	err = Run(ctx, db, stmts, opts)
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.Less(t, int64(time.Since(t0)), int64(time.Second))
+
+	require.Equal(t, []string{"s1:invoke", "s1:block", "s2:invoke", "s2:return", ":timeout"}, metasOf(h))
+	tmo := h[len(h)-1].Timeout()
+	require.Len(t, tmo.Running, 1)
+	require.Equal(t, "hang", tmo.Running[0].SQL)
+	require.Len(t, tmo.Pending, 1)
+	require.Equal(t, "s1", tmo.Pending[0].Sess)
+	hangDriver.lock.Lock()
+	require.Contains(t, strings.Join(hangDriver.log, ";"), "kill tidb query ")
+	hangDriver.lock.Unlock()
+
+	var h2 History
+	js, err := json.Marshal(h)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(js, &h2))
+	require.True(t, DiffHistory(h, h2, CompareOptions{}).Empty())
+	require.Equal(t, "-- timeout: context deadline exceeded\n--    running s1: hang\n--    pending s1: noop\n", dumpText(h2[len(h2)-1]))
+}
+
+func TestEvalTimeoutStuck(t *testing.T) {
+	db, err := sql.Open("hang", "")
+	require.NoError(t, err)
+
+	var h History
+	opts := EvalOptions{Callback: h.Collect, BlockTime: 20 * time.Millisecond, KillOnAbort: true, CloseTime: 200 * time.Millisecond}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	t0 := time.Now()
+	err = Run(ctx, db, []Stmt{{Sess: "s1", SQL: "stuck"}}, opts)
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.Less(t, int64(time.Since(t0)), int64(time.Second))
+	require.Equal(t, EventTimeout, h[len(h)-1].Kind)
+}
+
+func TestEvalConnIDOnDemand(t *testing.T) {
+	db, err := sql.Open("hang", "")
+	require.NoError(t, err)
+	defer db.Close()
+
+	stmts := []Stmt{{Sess: "s1", SQL: "noop"}, {Sess: "s2", SQL: "noop"}}
+	n0 := countLogs("select connection_id()")
+	require.NoError(t, Run(context.Background(), db, stmts, EvalOptions{BlockTime: time.Second}))
+	require.Equal(t, n0, countLogs("select connection_id()"))
+
+	opts := EvalOptions{BlockTime: time.Second, KillOnAbort: true}
+	require.True(t, opts.NeedsConnID())
+	require.NoError(t, Run(context.Background(), db, stmts, opts))
+	require.Equal(t, n0+2, countLogs("select connection_id()"))
+}
+
+func TestEvalLiteralVarRef(t *testing.T) {
+	db, err := sql.Open("hang", "")
+	require.NoError(t, err)
+	defer db.Close()
+
+	// sql of tests without captures is sent as is
+	var h History
+	n0 := countLogs("update t set v = '${x}'")
+	stmts := []Stmt{{Sess: "s1", SQL: "update t set v = '${x}'"}}
+	require.NoError(t, Run(context.Background(), db, stmts, EvalOptions{Callback: h.Collect, BlockTime: time.Second}))
+	require.Equal(t, n0+1, countLogs("update t set v = '${x}'"))
+	require.Equal(t, []string{"s1:invoke", "s1:return"}, metasOf(h))
+	require.Empty(t, h[0].Invoke().Exec)
+	require.Nil(t, h[1].Return().Err)
+
+	// references are checked once the test declares variables
+	stmts = append(stmts, Stmt{Sess: "s1", SQL: "noop", Let: []Capture{{Name: "y", Expr: "1"}}})
+	err = Run(context.Background(), db, stmts, EvalOptions{BlockTime: time.Second})
+	require.EqualError(t, err, "undefined variable: x")
+	require.Equal(t, n0+1, countLogs("update t set v = '${x}'"))
+}
+
+func countLogs(query string) int {
+	hangDriver.lock.Lock()
+	defer hangDriver.lock.Unlock()
+	n := 0
+	for _, q := range hangDriver.log {
+		if q == query {
+			n++
+		}
+	}
+	return n
+}
+
+func TestEvalRetry(t *testing.T) {
+	db, err := sql.Open("hang", "")
+	require.NoError(t, err)
+	defer db.Close()
+
+	var h History
+	opts := EvalOptions{Callback: h.Collect, BlockTime: time.Second, CloseTime: time.Second}
+	n0, t0 := countLogs("fail"), time.Now()
+	require.NoError(t, Run(context.Background(), db, []Stmt{{Sess: "s1", SQL: "fail", Retry: 2, RetryDelay: 30 * time.Millisecond}}, opts))
+	// retries wait for 30ms and 60ms
+	require.GreaterOrEqual(t, int64(time.Since(t0)), int64(90*time.Millisecond))
+	require.Equal(t, 3, countLogs("fail")-n0)
+	require.Equal(t, []string{"s1:invoke", "s1:return"}, metasOf(h))
+	require.NotNil(t, h[1].Return().Err)
+
+	// retries are canceled with the context
+	h = nil
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	n0, t0 = countLogs("fail"), time.Now()
+	err = Run(ctx, db, []Stmt{{Sess: "s1", SQL: "fail", Retry: 3, RetryDelay: time.Minute}}, opts)
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.Less(t, int64(time.Since(t0)), int64(5*time.Second))
+	require.Equal(t, 1, countLogs("fail")-n0)
+}
+
+func metasOf(h History) []string {
+	metas := make([]string, len(h))
+	for i, e := range h {
+		metas[i] = e.EventMeta.String()
+	}
+	return metas
+}
+
+func dumpText(e Event) string {
+	buf := new(strings.Builder)
+	e.DumpText(buf, TextDumpOptions{})
+	return buf.String()
+}